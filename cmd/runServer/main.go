@@ -2,9 +2,27 @@ package main
 
 import (
 	"github.com/sirupsen/logrus"
+	"math/rand"
+	"os"
+	"time"
 	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/desired"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/gateway"
+	"vpntoproxy/internal/healing"
+	"vpntoproxy/internal/library"
 	"vpntoproxy/internal/log"
+	"vpntoproxy/internal/policy"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/scheduler"
 	"vpntoproxy/internal/server"
+	"vpntoproxy/internal/storage"
+	"vpntoproxy/internal/vpn"
 )
 
 func main() {
@@ -12,7 +30,122 @@ func main() {
 
 	log.SetDefaultSettings()
 
-	hs := server.New(conf.Server.Port)
+	rand.Seed(time.Now().UnixNano())
+
+	var runtime docker.ContainerRuntime
+	if conf.Docker.DryRun {
+		logrus.Warn("Dry run mode, containers are not created in Docker")
+		runtime = docker.NewFake()
+	} else {
+		cli, err := docker.New()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		runtime = cli
+	}
+
+	store, err := storage.Open(conf.Storage.Path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	manager := vpn.NewManager(runtime, registry.New(store))
+	if err := manager.Reconcile(); err != nil {
+		logrus.Error(err)
+	}
+
+	if conf.Scheduler.Enabled {
+		sch := scheduler.New(manager)
+		if conf.Healing.Enabled {
+			sch.Subscribe(healing.New(manager).Observe)
+		}
+		sch.Start()
+		defer sch.Stop()
+	}
+
+	lib, err := library.New(store, conf.Storage.ConfigsDir)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	providers, err := provider.New()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	creds := credentials.New(store)
+	resolver := rotation.New(lib, providers)
+
+	policies := policy.New(store)
+	runner := policy.NewRunner(policies, manager, resolver)
+	manager.SetRotationPlan(runner.NextRotation)
+
+	pools := pool.New(store)
+	controller := pool.NewController(pools, manager, resolver, creds, providers)
+
+	services := &server.Services{
+		Manager:     manager,
+		Library:     lib,
+		Credentials: creds,
+		Providers:   providers,
+		Policies:    policies,
+		Runner:      runner,
+		Pools:       pools,
+		Controller:  controller,
+	}
+
+	if conf.Gateway.Enabled {
+		routes, err := routing.New()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		routes.Start()
+		defer routes.Stop()
+		services.Routes = routes
+
+		gw, err := gateway.New(manager, routes)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if err := gw.Start(); err != nil {
+			logrus.Fatal(err)
+		}
+		defer gw.Stop()
+		services.Gateway = gw
+		runner.SetDrainer(gw)
+	}
+
+	runner.Start()
+	defer runner.Stop()
+
+	// файл состояния применяется в фоне, сервер при этом уже принимает запросы,
+	// а контроллер пулов начинает сверку после применения
+	services.Applier = desired.NewApplier(manager, lib, providers, resolver, creds, pools, controller, services.Routes)
+	applied := make(chan struct{})
+	if conf.State.Apply {
+		go func() {
+			defer close(applied)
+			if err := applyState(services.Applier, conf.State); err != nil {
+				logrus.Errorf("State file %s: %s", conf.State.Path, err)
+			}
+		}()
+		// хранилище закрывается только после завершения применения
+		defer func() {
+			<-applied
+		}()
+	} else {
+		close(applied)
+	}
+
+	controller.Start(applied)
+	defer controller.Stop()
+
+	hs := server.New(conf.Server.Port, services)
 	go hs.Run()
 	logrus.Infof("Successfully started server on %d", conf.Server.Port)
 
@@ -26,3 +159,25 @@ func main() {
 
 	hs.GracefulShutdown()
 }
+
+// Сверка с файлом желаемого состояния при запуске, отсутствующий файл пропускается
+func applyState(applier *desired.Applier, cnf *config.State) error {
+	state, err := desired.Load(cnf.Path)
+	if os.IsNotExist(err) {
+		logrus.Debug("State file not found: ", cnf.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plan, err := applier.Apply(state, cnf.Prune, false)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("State file %s applied: %d changes, %d unchanged, %d failed",
+		cnf.Path, len(plan.Changes), plan.Unchanged, plan.Failed)
+
+	return nil
+}
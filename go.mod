@@ -24,9 +24,11 @@ require (
 	github.com/sirupsen/logrus v1.8.0
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/webview/webview v0.0.0-20210216142346-e0bfdf0e5d90
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20210220033124-5f55cee0dc0d
 	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba // indirect
 	google.golang.org/grpc v1.35.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	gotest.tools/v3 v3.0.3 // indirect
 )
@@ -25,11 +25,19 @@ var conf *Config
 
 // structure containing pointers to grouped parameters
 type Config struct {
-	Basic  *Basic
-	Server *Server
-	Docker *Docker
-	Proxy  *Proxy
-	Log    *Log
+	Basic     *Basic
+	Server    *Server
+	Docker    *Docker
+	Proxy     *Proxy
+	Log       *Log
+	Storage   *Storage
+	Scheduler *Scheduler
+	Healing   *Healing
+	Gateway   *Gateway
+	Routing   *Routing
+	Providers *Providers
+	Pools     *Pools
+	State     *State
 }
 
 // structure of basic parameters
@@ -44,19 +52,101 @@ type Server struct {
 
 // structure of parameters for working with containers
 type Docker struct {
-	ImageName     string   `json:"image_name" default:"vpnwithproxy"`
-	MaxAttempts   int      `json:"max_attempts" default:"10"`
-	ServicePrefix string   `json:"service_prefix" default:"vpn_"`
-	DNS           []string `json:"dns" default:"[\"8.8.8.8\", \"8.8.4.4\"]"`
-	ProxyPort     int      `json:"proxy_port" default:"1080"`
-	ProxyUser     string   `json:"proxy_user" default:"user"`
-	ProxyPassword string   `json:"proxy_password" default:"password"`
+	ImageName string `json:"image_name" default:"vpnwithproxy"`
+	// image of wireguard tunnels, built on top of image_name
+	WireGuardImage string   `json:"wireguard_image" default:"wgwithproxy" desc:"Image of WireGuard tunnels"`
+	ServicePrefix  string   `json:"service_prefix" default:"vpn_"`
+	NameTemplate   string   `json:"name_template" default:"{config}" desc:"Template of tunnel container names: {config}, {country}, {type} and {index}"`
+	DNS            []string `json:"dns" default:"[\"8.8.8.8\", \"8.8.4.4\"]"`
+	ProxyPort      int      `json:"proxy_port" default:"1080"`
+	ProxyUser      string   `json:"proxy_user" default:"user"`
+	ProxyPassword  string   `json:"proxy_password" default:"password"`
+	DryRun         bool     `json:"dry_run" default:"false" desc:"Use in-memory container runtime instead of Docker"`
+	AdoptUnlabeled bool     `json:"adopt_unlabeled" default:"false" desc:"Register unlabeled containers of the tunnel images on startup"`
+	StopTimeout    int      `json:"stop_timeout" default:"10" desc:"Seconds to wait for a graceful container stop before it is killed"`
+	RotateTimeout  int      `json:"rotate_timeout" default:"60" desc:"Seconds to wait for a rotated tunnel to connect and pass the proxy check"`
 }
 
 // structure of parameters for proxying traffic through a container
 type Proxy struct {
-	StartingPort int    `json:"starting_port" default:"9001"`
+	StartingPort int    `json:"starting_port" default:"9001" desc:"First host port of tunnel proxies"`
+	EndingPort   int    `json:"ending_port" default:"9500" desc:"Last host port of tunnel proxies"`
 	TestURL      string `json:"test_url" default:"http://httpbin.org/ip"`
+	Host         string `json:"host" default:"127.0.0.1" desc:"Host on which tunnel proxy ports are reachable"`
+	// ip echo service settings
+	TestFormat     string `json:"test_format" default:"json" desc:"Format of test url response: json or plain"`
+	TestField      string `json:"test_field" default:"origin" desc:"Field with IP in json response of test url"`
+	TestTimeout    int    `json:"test_timeout" default:"15" desc:"Timeout of proxy check request in seconds"`
+	LeakCheck      bool   `json:"leak_check" default:"true" desc:"Fail proxy check if exit IP matches direct IP of the host"`
+	DirectURL      string `json:"direct_url" default:"" desc:"Url returning direct IP of the host, test url is used if empty"`
+	DirectCacheTTL int    `json:"direct_cache_ttl" default:"300" desc:"Lifetime of the cached direct IP of the host in seconds"`
+}
+
+// structure of data storage parameters
+type Storage struct {
+	Path       string `json:"path" default:"data/vpntoproxy.db" desc:"Path to the tunnel registry database"`
+	ConfigsDir string `json:"configs_dir" default:"data/configs" desc:"Directory of vpn configs uploaded through the API"`
+	SecretsDir string `json:"secrets_dir" default:"data/secrets" desc:"Directory of vpn credential files mounted into tunnel containers"`
+}
+
+// structure of parameters for periodic tunnel health checks
+type Scheduler struct {
+	Enabled     bool `json:"enabled" default:"true" desc:"Periodically check vpn and proxy of every tunnel"`
+	Interval    int  `json:"interval" default:"60" desc:"Interval between checks in seconds"`
+	Jitter      int  `json:"jitter" default:"10" desc:"Maximum random delay before check of a tunnel in seconds"`
+	Concurrency int  `json:"concurrency" default:"4" desc:"Maximum number of tunnels checked at the same time"`
+	HistorySize int  `json:"history_size" default:"20" desc:"Number of health records kept per tunnel"`
+}
+
+// structure of parameters for automatic recovery of unhealthy tunnels
+type Healing struct {
+	Enabled          bool `json:"enabled" default:"true" desc:"Restart or recreate tunnels that fail health checks"`
+	FailureThreshold int  `json:"failure_threshold" default:"3" desc:"Consecutive failed checks before recovery"`
+	MaxRetries       int  `json:"max_retries" default:"5" desc:"Recovery attempts before the tunnel is marked failed"`
+	BackoffBase      int  `json:"backoff_base" default:"30" desc:"Delay after the first recovery attempt in seconds"`
+	BackoffMax       int  `json:"backoff_max" default:"600" desc:"Maximum delay between recovery attempts in seconds"`
+}
+
+// structure of parameters of the host-side proxy balancing connections between tunnels
+type Gateway struct {
+	Enabled     bool   `json:"enabled" default:"true" desc:"Listen on a single socks5 port for all healthy tunnels"`
+	Host        string `json:"host" default:"127.0.0.1"`
+	Port        int    `json:"port" default:"1080"`
+	User        string `json:"user" default:"" desc:"Gateway user, authentication is disabled if empty"`
+	Password    string `json:"password" default:""`
+	Strategy    string `json:"strategy" default:"round_robin" desc:"round_robin, least_connections or random"`
+	DialTimeout int    `json:"dial_timeout" default:"10" desc:"Timeout of connection through a tunnel in seconds"`
+	SessionTTL  int    `json:"session_ttl" default:"600" desc:"Lifetime of a sticky session since its last use in seconds"`
+	HttpPort    int    `json:"http_port" default:"8118" desc:"Port of http proxy front-end, disabled if 0"`
+	// separate http proxy port for every tunnel
+	TunnelHttpPorts        bool `json:"tunnel_http_ports" default:"false" desc:"Open a separate http proxy port for every tunnel"`
+	TunnelHttpStartingPort int  `json:"tunnel_http_starting_port" default:"9501"`
+}
+
+// structure of parameters of the gateway routing rules
+type Routing struct {
+	Path           string `json:"path" default:"configs/routes.json" desc:"Path to the file with ordered routing rules"`
+	ReloadInterval int    `json:"reload_interval" default:"5" desc:"Interval of checking the rules file for changes in seconds"`
+}
+
+// structure of parameters of vpn providers
+type Providers struct {
+	Path     string `json:"path" default:"configs/vpn_providers.json" desc:"Path to the file with vpn provider definitions"`
+	CacheTTL int    `json:"cache_ttl" default:"600" desc:"Lifetime of cached provider server lists in seconds"`
+	Timeout  int    `json:"timeout" default:"30" desc:"Timeout of provider requests in seconds"`
+}
+
+// structure of parameters of the tunnel pool controller
+type Pools struct {
+	Interval     int `json:"interval" default:"30" desc:"Interval between pool reconciliations in seconds"`
+	StartupGrace int `json:"startup_grace" default:"180" desc:"Seconds a pool tunnel may stay unhealthy before it is replaced"`
+}
+
+// structure of parameters of the declarative state file
+type State struct {
+	Path  string `json:"path" default:"configs/tunnels.yaml" desc:"YAML or JSON file with desired tunnels, pools, routes and credentials"`
+	Apply bool   `json:"apply" default:"true" desc:"Apply the state file on startup"`
+	Prune bool   `json:"prune" default:"false" desc:"Delete tunnels and pools missing from the state file"`
 }
 
 // structure of log parameters
@@ -74,6 +164,7 @@ type Log struct {
 // - data from the file (if file not exist, a configuration file is created, filling it with default parameters from the structure)
 // - data from environment variables
 // - transmitted data from flags
+// Parameters missing from an existing file get default values.
 func make() *Config {
 	// instantiating configuration
 	conf = &Config{}
@@ -229,7 +320,7 @@ func iterateTemplate(template interface{}, setDefault bool) (err error) {
 					fieldValue := reflect.New(fieldType.Type)
 					if setDefault {
 						// setting the field value to the default
-						if fieldValue.CanInterface() {
+						if defaultValue != "" && fieldValue.CanInterface() {
 							// filling the field value with default value
 							if err := json.Unmarshal([]byte(defaultValue), fieldValue.Interface()); err != nil {
 								return err
@@ -289,6 +380,12 @@ func readFile(name string, template interface{}) (interface{}, error) {
 		return nil, err
 	}
 
+	// filling the template with default values first, so that parameters added after the file
+	// was created get their defaults instead of zero values
+	if err := iterateTemplate(template, true); err != nil {
+		return nil, err
+	}
+
 	// filling the template with data from a file
 	err = json.Unmarshal(bytes, &template)
 	if err != nil {
@@ -0,0 +1,138 @@
+// пакет хранения учётных данных vpn провайдеров
+package credentials
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+	"vpntoproxy/internal/storage"
+)
+
+const bucket = "credentials"
+
+// Ошибка отсутствия набора учётных данных
+var ErrNotFound = fmt.Errorf("Credentials not found")
+
+// Учётные данные vpn: имя пользователя и пароль (auth-user-pass) и пароль закрытого ключа (askpass)
+type Credentials struct {
+	User         string `json:"user,omitempty"`
+	Password     string `json:"password,omitempty"`
+	CertPassword string `json:"cert_password,omitempty"`
+}
+
+// Проверка наличия имени пользователя и пароля
+func (c *Credentials) HasAuth() bool {
+	return c != nil && c.User != ""
+}
+
+// Проверка наличия пароля закрытого ключа
+func (c *Credentials) HasCertPassword() bool {
+	return c != nil && c.CertPassword != ""
+}
+
+// Сохранённый набор учётных данных
+type Set struct {
+	Name string `json:"name"`
+	Credentials
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Сведения о наборе без секретов, отдаются в ответах API
+type Info struct {
+	Name            string    `json:"name"`
+	User            string    `json:"user,omitempty"`
+	HasPassword     bool      `json:"has_password"`
+	HasCertPassword bool      `json:"has_cert_password"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Сведения о наборе без паролей
+func (s *Set) Info() *Info {
+	return &Info{
+		Name:            s.Name,
+		User:            s.User,
+		HasPassword:     s.Password != "",
+		HasCertPassword: s.CertPassword != "",
+		CreatedAt:       s.CreatedAt,
+		UpdatedAt:       s.UpdatedAt,
+	}
+}
+
+type Store struct {
+	store *storage.Storage
+}
+
+// Инициализация хранилища учётных данных
+func New(store *storage.Storage) *Store {
+	return &Store{store: store}
+}
+
+// Сохранение набора, существующий набор с тем же именем заменяется
+func (s *Store) Save(name string, creds *Credentials) (*Set, error) {
+	now := time.Now()
+
+	set, err := s.Get(name)
+	switch {
+	case err == ErrNotFound:
+		set = &Set{Name: name, CreatedAt: now}
+	case err != nil:
+		return nil, err
+	}
+
+	set.Credentials = *creds
+	set.UpdatedAt = now
+
+	if err := s.store.Put(bucket, name, set); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// Получение набора вместе с паролями
+func (s *Store) Get(name string) (*Set, error) {
+	set := &Set{}
+	if err := s.store.Get(bucket, name, set); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// Получение списка наборов без паролей, упорядоченного по имени
+func (s *Store) List() ([]*Info, error) {
+	res := make([]*Info, 0)
+
+	err := s.store.List(bucket, func(key string, data []byte) error {
+		set := &Set{}
+		if err := json.Unmarshal(data, set); err != nil {
+			return err
+		}
+		res = append(res, set.Info())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// Удаление набора
+func (s *Store) Delete(name string) error {
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+
+	return s.store.Delete(bucket, name)
+}
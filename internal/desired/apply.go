@@ -0,0 +1,648 @@
+package desired
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/vpn"
+)
+
+// Разделы состояния
+const (
+	KindCredentials = "credentials"
+	KindRoutes      = "routes"
+	KindTunnel      = "tunnel"
+	KindPool        = "pool"
+)
+
+// Действия над объектами
+const (
+	ActionCreate   = "create"
+	ActionUpdate   = "update"
+	ActionRecreate = "recreate"
+	ActionStart    = "start"
+	ActionStop     = "stop"
+	ActionDelete   = "delete"
+)
+
+// Изменение, приводящее объект к желаемому состоянию
+type Change struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// отличия текущего состояния от желаемого, секреты не выводятся
+	Diff  []string `json:"diff,omitempty"`
+	Error string   `json:"error,omitempty"`
+
+	apply func() error
+}
+
+// План сверки и результат его выполнения
+type Plan struct {
+	DryRun  bool      `json:"dry_run"`
+	Prune   bool      `json:"prune"`
+	Changes []*Change `json:"changes"`
+	// количество объектов, совпадающих с желаемым состоянием
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// Приведение туннелей, пулов, маршрутов и учётных данных к желаемому состоянию
+type Applier struct {
+	manager     *vpn.Manager
+	library     *library.Library
+	providers   *provider.Registry
+	resolver    *rotation.Resolver
+	credentials *credentials.Store
+	pools       *pool.Store
+	controller  *pool.Controller
+	// nil, если шлюз выключен
+	routes *routing.Engine
+
+	// одновременно выполняется одна сверка
+	mu sync.Mutex
+}
+
+// Инициализация сверки состояния
+func NewApplier(manager *vpn.Manager, lib *library.Library, providers *provider.Registry, resolver *rotation.Resolver,
+	creds *credentials.Store, pools *pool.Store, controller *pool.Controller, routes *routing.Engine) *Applier {
+	return &Applier{
+		manager:     manager,
+		library:     lib,
+		providers:   providers,
+		resolver:    resolver,
+		credentials: creds,
+		pools:       pools,
+		controller:  controller,
+		routes:      routes,
+	}
+}
+
+// Сверка с желаемым состоянием. При dryRun изменения только перечисляются,
+// при prune удаляются туннели и пулы, отсутствующие в описании. Туннели пулов не удаляются
+func (a *Applier) Apply(state *State, prune bool, dryRun bool) (*Plan, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	plan := &Plan{DryRun: dryRun, Prune: prune, Changes: make([]*Change, 0)}
+
+	// порядок важен: туннели используют учётные данные, маршруты и пулы ссылаются на туннели
+	steps := []func(*State, *Plan) error{a.planCredentials, a.planTunnels, a.planPools, a.planRoutes}
+	if prune {
+		steps = append(steps, a.planPrune)
+	}
+	for _, step := range steps {
+		if err := step(state, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range plan.Changes {
+		if c.Error == "" && !dryRun {
+			logrus.Infof("Apply %s %s: %s", c.Kind, c.Name, c.Action)
+			if err := c.apply(); err != nil {
+				c.Error = err.Error()
+			}
+		}
+		if c.Error != "" {
+			plan.Failed++
+			logrus.Errorf("Apply %s %s failed: %s", c.Kind, c.Name, c.Error)
+		}
+	}
+
+	return plan, nil
+}
+
+func (p *Plan) add(c *Change) {
+	p.Changes = append(p.Changes, c)
+}
+
+// Наборы учётных данных создаются или заменяются, сохранённые вне описания не удаляются
+func (a *Applier) planCredentials(state *State, plan *Plan) error {
+	for i := range state.Credentials {
+		c := state.Credentials[i]
+
+		set, err := a.credentials.Get(c.Name)
+		switch {
+		case err == credentials.ErrNotFound:
+			plan.add(&Change{Kind: KindCredentials, Name: c.Name, Action: ActionCreate, apply: func() error {
+				_, err := a.credentials.Save(c.Name, &c.Credentials)
+				return err
+			}})
+			continue
+		case err != nil:
+			return err
+		}
+
+		diff := make([]string, 0)
+		if set.User != c.User {
+			diff = append(diff, "user changed")
+		}
+		if set.Password != c.Password {
+			diff = append(diff, "password changed")
+		}
+		if set.CertPassword != c.CertPassword {
+			diff = append(diff, "cert_password changed")
+		}
+		if len(diff) == 0 {
+			plan.Unchanged++
+			continue
+		}
+
+		plan.add(&Change{Kind: KindCredentials, Name: c.Name, Action: ActionUpdate, Diff: diff, apply: func() error {
+			_, err := a.credentials.Save(c.Name, &c.Credentials)
+			return err
+		}})
+	}
+
+	return nil
+}
+
+// Туннели без контейнера и с другой конфигурацией пересоздаются,
+// страна и метки меняются на месте, состояние приводится запуском или остановкой
+func (a *Applier) planTunnels(state *State, plan *Plan) error {
+	existing, err := a.tunnelsByName()
+	if err != nil {
+		return err
+	}
+
+	for i := range state.Tunnels {
+		d := &state.Tunnels[i]
+
+		t := existing[fullName(d.Name)]
+		if t == nil {
+			plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionCreate, apply: func() error {
+				return a.create(d, false)
+			}})
+			continue
+		}
+
+		recreate, err := a.drift(d, t)
+		if err != nil {
+			plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionRecreate, Error: err.Error()})
+			continue
+		}
+
+		var country *string
+		labels := make([]string, 0)
+		// страна туннеля провайдера меняется только пересозданием, см. providerDrift
+		if d.Provider == "" && d.Country != "" && strings.ToLower(d.Country) != t.Country {
+			country = &d.Country
+			labels = append(labels, fmt.Sprintf("country: %q -> %q", t.Country, strings.ToLower(d.Country)))
+		}
+		var tags []string
+		if d.Tags != nil && !equalStrings(d.Tags, t.Tags) {
+			tags = d.Tags
+			labels = append(labels, fmt.Sprintf("tags: %v -> %v", t.Tags, d.Tags))
+		}
+
+		// новый туннель создаётся сразу с нужными страной, метками и состоянием
+		if len(recreate) > 0 {
+			plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionRecreate, Diff: append(recreate, labels...),
+				apply: func() error {
+					return a.create(d, true)
+				}})
+			continue
+		}
+
+		changed := false
+
+		if len(labels) > 0 {
+			changed = true
+			plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionUpdate, Diff: labels, apply: func() error {
+				_, err := a.manager.Label(t, country, tags)
+				return err
+			}})
+		}
+
+		if desired := d.desiredState(); desired != t.DesiredState {
+			changed = true
+			diff := []string{fmt.Sprintf("state: %s -> %s", t.DesiredState, desired)}
+			if desired == registry.StateStopped {
+				plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionStop, Diff: diff, apply: func() error {
+					_, err := a.manager.Stop(t, 0)
+					return err
+				}})
+			} else {
+				plan.add(&Change{Kind: KindTunnel, Name: d.Name, Action: ActionStart, Diff: diff, apply: func() error {
+					_, err := a.manager.Start(t)
+					return err
+				}})
+			}
+		}
+
+		if !changed {
+			plan.Unchanged++
+		}
+	}
+
+	return nil
+}
+
+// Отличия туннеля от описания, требующие пересоздания
+func (a *Applier) drift(d *Tunnel, t *registry.Tunnel) ([]string, error) {
+	diff := make([]string, 0)
+
+	if t.ObservedState == registry.StateMissing {
+		diff = append(diff, "container is missing")
+	}
+	if t.Pool != "" {
+		diff = append(diff, fmt.Sprintf("tunnel belongs to pool %s", t.Pool))
+	}
+
+	typ, path := d.Type, ""
+	switch {
+	case d.Path != "":
+		path = d.Path
+		if typ == "" {
+			typ = vpn.TypeByExtension(d.Path)
+		}
+	case d.Config != "":
+		cfg, err := a.library.Get(d.Config)
+		if err != nil {
+			return nil, fmt.Errorf("Config %s: %s", d.Config, err)
+		}
+		path = a.library.Path(cfg)
+		typ = cfg.Type
+	case d.Provider != t.Provider:
+		// сервер провайдера выбирается только при создании туннеля
+		diff = append(diff, fmt.Sprintf("provider: %q -> %q", t.Provider, d.Provider))
+	case d.Provider != "":
+		servers, err := a.providerDrift(d, t)
+		if err != nil {
+			return nil, err
+		}
+		diff = append(diff, servers...)
+	}
+
+	if path != "" && path != t.ConfigPath {
+		diff = append(diff, fmt.Sprintf("path: %q -> %q", t.ConfigPath, path))
+	}
+	if typ != "" && typeName(typ) != typeName(t.Type) {
+		diff = append(diff, fmt.Sprintf("type: %q -> %q", typeName(t.Type), typeName(typ)))
+	}
+
+	creds, err := a.credentialsName(d, typ)
+	if err != nil {
+		return nil, err
+	}
+	if creds != t.Credentials {
+		diff = append(diff, fmt.Sprintf("credentials: %q -> %q", t.Credentials, creds))
+	}
+
+	return diff, nil
+}
+
+// Несоответствие сервера туннеля провайдера стране, городу и серверу описания.
+// Туннель продолжал бы выходить в сеть через прежний сервер, поэтому смена метки страны не подходит
+func (a *Applier) providerDrift(d *Tunnel, t *registry.Tunnel) ([]string, error) {
+	diff := make([]string, 0)
+
+	if d.Country != "" && strings.ToLower(d.Country) != t.Country {
+		diff = append(diff, fmt.Sprintf("country: %q -> %q", t.Country, strings.ToLower(d.Country)))
+	}
+
+	current := strings.TrimSuffix(filepath.Base(t.ConfigPath), filepath.Ext(t.ConfigPath))
+	if d.Server != "" && provider.ConfigName(d.Provider, &provider.Server{ID: d.Server}) != current {
+		diff = append(diff, fmt.Sprintf("server: %q -> %q", current, d.Server))
+	}
+
+	if d.City == "" || len(diff) > 0 {
+		return diff, nil
+	}
+
+	servers, err := a.providers.Servers(d.Provider, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Provider %s: %s", d.Provider, err)
+	}
+	for i := range servers {
+		if provider.ConfigName(d.Provider, &servers[i]) != current {
+			continue
+		}
+		if !strings.EqualFold(servers[i].City, d.City) {
+			diff = append(diff, fmt.Sprintf("city: %q -> %q", servers[i].City, d.City))
+		}
+		return diff, nil
+	}
+
+	return append(diff, fmt.Sprintf("server %q is no longer offered by provider %s", current, d.Provider)), nil
+}
+
+// Создание туннеля по описанию, при replace существующий туннель с тем же именем заменяется
+func (a *Applier) create(d *Tunnel, replace bool) error {
+	opts := &vpn.Options{Type: d.Type, Path: d.Path, Name: d.Name, Country: d.Country, Tags: d.Tags}
+	if replace {
+		opts.OnConflict = vpn.ConflictReplace
+	}
+
+	var cfg *library.Config
+	var err error
+	switch {
+	case d.Config != "":
+		if cfg, err = a.library.Get(d.Config); err != nil {
+			return fmt.Errorf("Config %s: %s", d.Config, err)
+		}
+	case d.Provider != "":
+		server, err := a.providers.Pick(d.Provider, &provider.Filter{Country: d.Country, City: d.City, Server: d.Server})
+		if err != nil {
+			return err
+		}
+		if cfg, err = a.resolver.ServerConfig(d.Provider, server); err != nil {
+			return err
+		}
+		opts.Provider = d.Provider
+	}
+
+	if cfg != nil {
+		opts.Type = cfg.Type
+		opts.Path = a.library.Path(cfg)
+		if opts.Country == "" {
+			opts.Country = cfg.Country
+		}
+		if opts.Tags == nil {
+			opts.Tags = cfg.Tags
+		}
+	} else if opts.Type == "" {
+		opts.Type = vpn.TypeByExtension(d.Path)
+	}
+
+	name, err := a.credentialsName(d, opts.Type)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		set, err := a.credentials.Get(name)
+		if err != nil {
+			return fmt.Errorf("Credentials %s: %s", name, err)
+		}
+		opts.Credentials = &set.Credentials
+		opts.CredentialsName = set.Name
+	}
+
+	info, err := a.manager.Create(opts)
+	if err != nil {
+		return err
+	}
+
+	if d.desiredState() == registry.StateStopped {
+		_, err = a.manager.Stop(info.Tunnel, 0)
+	}
+
+	return err
+}
+
+// Имя набора учётных данных туннеля, без явного набора используется набор из описания провайдера
+func (a *Applier) credentialsName(d *Tunnel, typ string) (string, error) {
+	if d.Credentials != "" || d.Provider == "" || typ == vpn.TypeWireGuard {
+		return d.Credentials, nil
+	}
+
+	_, def, err := a.providers.Get(d.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	return def.Credentials, nil
+}
+
+// Пулы создаются или заменяются, контроллер пулов сразу начинает сверку
+func (a *Applier) planPools(state *State, plan *Plan) error {
+	for i := range state.Pools {
+		p := &state.Pools[i]
+
+		current, err := a.pools.Get(p.Name)
+		switch {
+		case err == pool.ErrNotFound:
+			plan.add(&Change{Kind: KindPool, Name: p.Name, Action: ActionCreate, apply: func() error {
+				if _, err := a.pools.Add(p); err != nil {
+					return err
+				}
+				a.controller.Trigger()
+				return nil
+			}})
+			continue
+		case err != nil:
+			return err
+		}
+
+		diff := poolDiff(current, p)
+		if len(diff) == 0 {
+			plan.Unchanged++
+			continue
+		}
+
+		plan.add(&Change{Kind: KindPool, Name: p.Name, Action: ActionUpdate, Diff: diff, apply: func() error {
+			if _, err := a.pools.Replace(p.Name, p); err != nil {
+				return err
+			}
+			a.controller.Trigger()
+			return nil
+		}})
+	}
+
+	return nil
+}
+
+// Список правил заменяется целиком, если отличается от описания. Без раздела routes правила не меняются
+func (a *Applier) planRoutes(state *State, plan *Plan) error {
+	if state.Routes == nil {
+		return nil
+	}
+
+	if a.routes == nil {
+		plan.add(&Change{Kind: KindRoutes, Name: KindRoutes, Action: ActionUpdate, Error: "Gateway is disabled"})
+		return nil
+	}
+
+	current := a.routes.List()
+	rules := make([]routing.Rule, len(state.Routes))
+	copy(rules, state.Routes)
+	for i := range rules {
+		// правило без идентификатора сохраняет идентификатор правила на той же позиции
+		if rules[i].ID == "" && i < len(current) {
+			rules[i].ID = current[i].ID
+		}
+	}
+	if err := routing.Validate(rules); err != nil {
+		plan.add(&Change{Kind: KindRoutes, Name: KindRoutes, Action: ActionUpdate, Error: err.Error()})
+		return nil
+	}
+
+	diff := rulesDiff(normalizeRules(current), normalizeRules(rules))
+	if len(diff) == 0 {
+		plan.Unchanged++
+		return nil
+	}
+
+	plan.add(&Change{Kind: KindRoutes, Name: KindRoutes, Action: ActionUpdate, Diff: diff, apply: func() error {
+		_, err := a.routes.Replace(rules)
+		return err
+	}})
+
+	return nil
+}
+
+// Удаление туннелей и пулов, отсутствующих в описании
+func (a *Applier) planPrune(state *State, plan *Plan) error {
+	declared := make(map[string]bool)
+	for _, d := range state.Tunnels {
+		declared[fullName(d.Name)] = true
+	}
+
+	tunnels, err := a.manager.Registry().List()
+	if err != nil {
+		return err
+	}
+	for _, t := range tunnels {
+		if t.Pool != "" || declared[t.Name] {
+			continue
+		}
+		t := t
+		name := strings.TrimPrefix(t.Name, config.Get().Docker.ServicePrefix)
+		plan.add(&Change{Kind: KindTunnel, Name: name, Action: ActionDelete, apply: func() error {
+			return a.manager.Delete(t, false)
+		}})
+	}
+
+	pools := make(map[string]bool)
+	for _, p := range state.Pools {
+		pools[p.Name] = true
+	}
+
+	current, err := a.pools.List()
+	if err != nil {
+		return err
+	}
+	for _, p := range current {
+		if pools[p.Name] {
+			continue
+		}
+		name := p.Name
+		plan.add(&Change{Kind: KindPool, Name: name, Action: ActionDelete, apply: func() error {
+			return a.controller.Remove(name, false)
+		}})
+	}
+
+	return nil
+}
+
+// Туннели реестра по имени контейнера
+func (a *Applier) tunnelsByName() (map[string]*registry.Tunnel, error) {
+	tunnels, err := a.manager.Registry().List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]*registry.Tunnel, len(tunnels))
+	for _, t := range tunnels {
+		res[t.Name] = t
+	}
+
+	return res, nil
+}
+
+// Имя контейнера туннеля с префиксом docker.service_prefix
+func fullName(name string) string {
+	prefix := config.Get().Docker.ServicePrefix
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+
+	return prefix + name
+}
+
+// Желаемое состояние туннеля, по умолчанию running
+func (t *Tunnel) desiredState() string {
+	if t.State == "" {
+		return registry.StateRunning
+	}
+
+	return t.State
+}
+
+// Пустой тип означает OpenVPN
+func typeName(typ string) string {
+	if typ == "" {
+		return vpn.TypeOpenVPN
+	}
+
+	return typ
+}
+
+// Отличия параметров пула от описания
+func poolDiff(current *pool.Pool, p *pool.Pool) []string {
+	diff := make([]string, 0)
+	if !reflect.DeepEqual(current.Source, p.Source) {
+		diff = append(diff, "source changed")
+	}
+	if current.Size != p.Size || current.Min != p.Min || current.Max != p.Max {
+		diff = append(diff, fmt.Sprintf("size: %d (%d-%d) -> %d (%d-%d)",
+			current.Size, current.Min, current.Max, p.Size, p.Min, p.Max))
+	}
+	if !equalStrings(current.Tags, p.Tags) {
+		diff = append(diff, fmt.Sprintf("tags: %v -> %v", current.Tags, p.Tags))
+	}
+	if current.Credentials != p.Credentials {
+		diff = append(diff, fmt.Sprintf("credentials: %q -> %q", current.Credentials, p.Credentials))
+	}
+
+	return diff
+}
+
+// Правила с пустыми списками вместо nil для сравнения
+func normalizeRules(rules []routing.Rule) []routing.Rule {
+	res := make([]routing.Rule, len(rules))
+	for i, r := range rules {
+		for _, list := range []*[]string{&r.Domains, &r.CIDRs, &r.Ports, &r.Sources, &r.Users} {
+			if len(*list) == 0 {
+				*list = nil
+			}
+		}
+		res[i] = r
+	}
+
+	return res
+}
+
+// Отличия списков правил по позициям
+func rulesDiff(current []routing.Rule, rules []routing.Rule) []string {
+	diff := make([]string, 0)
+	for i := 0; i < len(current) || i < len(rules); i++ {
+		switch {
+		case i >= len(current):
+			diff = append(diff, fmt.Sprintf("rule %d added: %s %s", i, rules[i].Action, rules[i].Target))
+		case i >= len(rules):
+			diff = append(diff, fmt.Sprintf("rule %d removed: %s", i, current[i].ID))
+		case !reflect.DeepEqual(current[i], rules[i]):
+			diff = append(diff, fmt.Sprintf("rule %d changed: %s", i, current[i].ID))
+		}
+	}
+
+	return diff
+}
+
+// Сравнение списков без учёта порядка
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,427 @@
+package desired
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/storage"
+	"vpntoproxy/internal/vpn"
+)
+
+// Конфигурация читается из ./configs, поэтому тесты работают во временном каталоге
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "vpntoproxy-desired-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	code := func() int {
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		if err := os.Mkdir(filepath.Join(dir, "configs"), 0755); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if err := os.Chdir(dir); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		cnf := config.Get()
+		cnf.Docker.DryRun = true
+		cnf.Docker.ServicePrefix = "vpn_"
+		cnf.Docker.NameTemplate = "{config}"
+		cnf.Proxy.StartingPort, cnf.Proxy.EndingPort = 42200, 42299
+
+		return m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+// Конфигурация OpenVPN сервера name
+func testConfig(name string) string {
+	return fmt.Sprintf("client\ndev tun\nremote %s.example.com 1194\n<ca>\nCA\n</ca>\n", name)
+}
+
+// Сверка с хранимой в памяти средой выполнения и провайдером test,
+// отдающим серверы us-nyc-01, us-bos-01 и de-berlin-01
+func newTestApplier(t *testing.T) (*Applier, string) {
+	servers := []string{"us-nyc-01", "us-bos-01", "de-berlin-01"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range servers {
+			_, _ = fmt.Fprintf(w, "%s.ovpn\n", name)
+		}
+	})
+	for _, name := range servers {
+		name := name
+		mux.HandleFunc("/"+name+".ovpn", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, testConfig(name))
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	cnf := config.Get()
+	cnf.Providers.Path = filepath.Join(dir, "providers.json")
+	cnf.Routing.Path = filepath.Join(dir, "routes.json")
+	defs := fmt.Sprintf(`[{"name": "test", "type": "http", "url": "%s/", "format": "index"}]`, srv.URL)
+	if err := ioutil.WriteFile(cnf.Providers.Path, []byte(defs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := storage.Open(filepath.Join(dir, "vpn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	lib, err := library.New(store, filepath.Join(dir, "library"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers, err := provider.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := routing.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := vpn.NewManager(docker.NewFake(), registry.New(store))
+	resolver := rotation.New(lib, providers)
+	creds := credentials.New(store)
+	pools := pool.New(store)
+	controller := pool.NewController(pools, manager, resolver, creds, providers)
+
+	// файлы конфигураций туннелей, создаваемых по пути
+	for _, name := range []string{"local1", "local2"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".ovpn"), []byte(testConfig(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewApplier(manager, lib, providers, resolver, creds, pools, controller, routes), dir
+}
+
+// Действия плана в виде "kind name action", с отличиями через запятую
+func planActions(plan *Plan) []string {
+	res := make([]string, 0, len(plan.Changes))
+	for _, c := range plan.Changes {
+		item := fmt.Sprintf("%s %s %s", c.Kind, c.Name, c.Action)
+		if len(c.Diff) > 0 {
+			item += ": " + strings.Join(c.Diff, ", ")
+		}
+		if c.Error != "" {
+			item += " error: " + c.Error
+		}
+		res = append(res, item)
+	}
+
+	return res
+}
+
+func TestApply(t *testing.T) {
+	a, dir := newTestApplier(t)
+	local1, local2 := filepath.Join(dir, "local1.ovpn"), filepath.Join(dir, "local2.ovpn")
+
+	base := func() *State {
+		return &State{
+			Credentials: []Credentials{{Name: "main", Credentials: credentials.Credentials{User: "u", Password: "p"}}},
+			Tunnels: []Tunnel{
+				{Name: "t1", Path: local1, Tags: []string{"a"}},
+				{Name: "t2", Provider: "test", Country: "us", City: "nyc"},
+				{Name: "t3", Path: local2, State: registry.StateStopped},
+			},
+			Pools:  []pool.Pool{{Name: "edge", Source: rotation.Source{Dir: dir}, Size: 1, Max: 2}},
+			Routes: []routing.Rule{{Domains: []string{"example.com"}, Action: routing.ActionTunnel, Target: "t1"}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *State)
+		prune  bool
+		dryRun bool
+		want   []string
+		// количество объектов без изменений
+		unchanged int
+	}{
+		{
+			name: "create",
+			want: []string{
+				"credentials main create",
+				"tunnel t1 create",
+				"tunnel t2 create",
+				"tunnel t3 create",
+				"pool edge create",
+				"routes routes update: rule 0 added: tunnel t1",
+			},
+		},
+		{name: "unchanged", want: []string{}, unchanged: 6},
+		{
+			name:   "labels and state",
+			dryRun: true,
+			modify: func(s *State) {
+				s.Tunnels[0].Tags = []string{"b"}
+				s.Tunnels[0].Country = "NL"
+				s.Tunnels[2].State = registry.StateRunning
+			},
+			want: []string{
+				`tunnel t1 update: country: "" -> "nl", tags: [a] -> [b]`,
+				"tunnel t3 start: state: stopped -> running",
+			},
+			unchanged: 4,
+		},
+		{
+			name:   "recreate",
+			dryRun: true,
+			modify: func(s *State) {
+				s.Credentials[0].Password = "q"
+				s.Tunnels[0].Path = local2
+				s.Tunnels[0].Tags = []string{"b"}
+				s.Tunnels[1].City = "bos"
+				s.Tunnels[2].Credentials = "main"
+			},
+			want: []string{
+				"credentials main update: password changed",
+				fmt.Sprintf(`tunnel t1 recreate: path: %q -> %q, tags: [a] -> [b]`, local1, local2),
+				`tunnel t2 recreate: city: "nyc" -> "bos"`,
+				`tunnel t3 recreate: credentials: "" -> "main"`,
+			},
+			unchanged: 2,
+		},
+		{
+			name:   "provider country and server",
+			dryRun: true,
+			modify: func(s *State) {
+				s.Tunnels[1].Country = "de"
+				s.Tunnels[1].City = ""
+				s.Tunnels[1].Server = "de-berlin-01"
+				s.Tunnels[2].Path = ""
+				s.Tunnels[2].Provider = "test"
+			},
+			want: []string{
+				`tunnel t2 recreate: country: "us" -> "de", server: "test-us-nyc-01" -> "de-berlin-01"`,
+				`tunnel t3 recreate: provider: "" -> "test"`,
+			},
+			unchanged: 4,
+		},
+		{
+			name:   "pool and routes",
+			dryRun: true,
+			modify: func(s *State) {
+				s.Pools[0].Size = 2
+				s.Routes = append(s.Routes, routing.Rule{Action: routing.ActionDirect})
+			},
+			want: []string{
+				"pool edge update: size: 1 (0-2) -> 2 (0-2)",
+				"routes routes update: rule 1 added: direct ",
+			},
+			unchanged: 4,
+		},
+		{
+			name:   "prune",
+			prune:  true,
+			dryRun: true,
+			modify: func(s *State) {
+				s.Tunnels = s.Tunnels[:1]
+				s.Pools = nil
+			},
+			want: []string{
+				"tunnel t2 delete",
+				"tunnel t3 delete",
+				"pool edge delete",
+			},
+			unchanged: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := base()
+			if tt.modify != nil {
+				tt.modify(state)
+			}
+
+			plan, err := a.Apply(state, tt.prune, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// туннели реестра перечисляются в порядке идентификаторов
+			got := planActions(plan)
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("got changes\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if plan.Unchanged != tt.unchanged {
+				t.Errorf("got %d unchanged, want %d", plan.Unchanged, tt.unchanged)
+			}
+			if plan.Failed != 0 {
+				t.Errorf("got %d failed changes", plan.Failed)
+			}
+		})
+	}
+
+	// пробные прогоны ничего не изменили
+	plan, err := a.Apply(base(), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Fatalf("dry runs changed the state: %v", planActions(plan))
+	}
+
+	tunnels, err := a.tunnelsByName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t3 := tunnels["vpn_t3"]; t3 == nil || t3.DesiredState != registry.StateStopped {
+		t.Errorf("tunnel t3 is %v, want it created stopped", t3)
+	}
+}
+
+// Изменение на месте и пересоздание применяются к туннелям реестра
+func TestApplyChanges(t *testing.T) {
+	a, dir := newTestApplier(t)
+	local1 := filepath.Join(dir, "local1.ovpn")
+
+	state := &State{Tunnels: []Tunnel{
+		{Name: "t1", Path: local1},
+		{Name: "t2", Provider: "test", Country: "us", City: "nyc"},
+	}}
+	if plan, err := a.Apply(state, false, false); err != nil || plan.Failed != 0 {
+		t.Fatalf("create: %v %v", err, planActions(plan))
+	}
+
+	before, err := a.tunnelsByName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state.Tunnels[0].Tags = []string{"b"}
+	state.Tunnels[1].Country = "de"
+	state.Tunnels[1].City = ""
+	plan, err := a.Apply(state, false, false)
+	if err != nil || plan.Failed != 0 {
+		t.Fatalf("apply: %v %v", err, planActions(plan))
+	}
+
+	after, err := a.tunnelsByName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// метки меняются без пересоздания
+	if t1 := after["vpn_t1"]; t1.ID != before["vpn_t1"].ID || t1.ConfigPath != local1 || !equalStrings(t1.Tags, []string{"b"}) {
+		t.Errorf("got t1 %s %s %v, want the same tunnel with tags [b]", t1.ID, t1.ConfigPath, t1.Tags)
+	}
+	// туннель провайдера пересоздаётся на сервере другой страны
+	if t2 := after["vpn_t2"]; t2.Country != "de" || !strings.HasSuffix(t2.ConfigPath, "test-de-berlin-01.ovpn") {
+		t.Errorf("got t2 in %q from %s, want de-berlin-01", t2.Country, t2.ConfigPath)
+	}
+
+	plan, err = a.Apply(state, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 {
+		t.Fatalf("got changes after apply: %v", planActions(plan))
+	}
+}
+
+func TestPoolDiff(t *testing.T) {
+	current := &pool.Pool{Name: "edge", Source: rotation.Source{Dir: "/a"}, Size: 2, Min: 1, Max: 3, Tags: []string{"x", "y"}}
+
+	tests := []struct {
+		name   string
+		modify func(p *pool.Pool)
+		want   []string
+	}{
+		{name: "same", modify: func(p *pool.Pool) {}, want: []string{}},
+		{name: "tag order is ignored", modify: func(p *pool.Pool) { p.Tags = []string{"y", "x"} }, want: []string{}},
+		{name: "source", modify: func(p *pool.Pool) { p.Source.Dir = "/b" }, want: []string{"source changed"}},
+		{name: "size", modify: func(p *pool.Pool) { p.Max = 4 }, want: []string{"size: 2 (1-3) -> 2 (1-4)"}},
+		{name: "tags and credentials", modify: func(p *pool.Pool) {
+			p.Tags = []string{"x"}
+			p.Credentials = "main"
+		}, want: []string{"tags: [x y] -> [x]", `credentials: "" -> "main"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := *current
+			p.Tags = append([]string(nil), current.Tags...)
+			tt.modify(&p)
+
+			if got := poolDiff(current, &p); strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRulesDiff(t *testing.T) {
+	current := []routing.Rule{
+		{ID: "a", Domains: []string{}, Action: routing.ActionDirect},
+		{ID: "b", Action: routing.ActionTunnel, Target: "t1"},
+	}
+
+	tests := []struct {
+		name  string
+		rules []routing.Rule
+		want  []string
+	}{
+		{name: "empty and nil lists are equal", rules: []routing.Rule{
+			{ID: "a", Action: routing.ActionDirect},
+			{ID: "b", Ports: []string{}, Action: routing.ActionTunnel, Target: "t1"},
+		}, want: []string{}},
+		{name: "changed", rules: []routing.Rule{
+			{ID: "a", Action: routing.ActionDirect},
+			{ID: "b", Action: routing.ActionTunnel, Target: "t2"},
+		}, want: []string{"rule 1 changed: b"}},
+		{name: "added", rules: []routing.Rule{
+			{ID: "a", Action: routing.ActionDirect},
+			{ID: "b", Action: routing.ActionTunnel, Target: "t1"},
+			{ID: "c", Action: routing.ActionPool, Target: "edge"},
+		}, want: []string{"rule 2 added: pool edge"}},
+		{name: "removed", rules: []routing.Rule{
+			{ID: "a", Action: routing.ActionDirect},
+		}, want: []string{"rule 1 removed: b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rulesDiff(normalizeRules(current), normalizeRules(tt.rules))
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// пакет декларативного описания туннелей, пулов, маршрутов и учётных данных
+package desired
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/routing"
+)
+
+// Форматы файла состояния
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// Допустимое имя набора учётных данных, туннеля и пула
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Желаемое состояние. Отсутствующий раздел не изменяется,
+// пустой список routes удаляет все правила маршрутизации
+type State struct {
+	Credentials []Credentials  `json:"credentials"`
+	Tunnels     []Tunnel       `json:"tunnels"`
+	Pools       []pool.Pool    `json:"pools"`
+	Routes      []routing.Rule `json:"routes"`
+}
+
+// Набор учётных данных. Значения в файле состояния могут ссылаться на переменные окружения: ${VPN_PASSWORD}
+type Credentials struct {
+	Name string `json:"name"`
+	credentials.Credentials
+}
+
+// Туннель, создаётся из path, конфигурации библиотеки config или сервера провайдера.
+// Незаданные country и tags не сравниваются с туннелем
+type Tunnel struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Config   string   `json:"config,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Server   string   `json:"server,omitempty"`
+	City     string   `json:"city,omitempty"`
+	Country  string   `json:"country,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// имя набора учётных данных
+	Credentials string `json:"credentials,omitempty"`
+	// running или stopped, по умолчанию running
+	State string `json:"state,omitempty"`
+}
+
+// Ссылка на переменную окружения в значениях учётных данных файла состояния
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Чтение файла состояния, формат определяется по расширению: .json или yaml.
+// Ссылки ${NAME} в учётных данных заменяются значениями переменных окружения
+func Load(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := FormatYAML
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = FormatJSON
+	}
+
+	state, err := decode(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range state.Credentials {
+		c := &state.Credentials[i]
+		for _, value := range []*string{&c.User, &c.Password, &c.CertPassword} {
+			if *value, err = expandEnv(*value); err != nil {
+				return nil, fmt.Errorf("Credentials %s: %s", c.Name, err)
+			}
+		}
+	}
+
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Разбор и проверка описания состояния. Переменные окружения не подставляются:
+// описание может прийти в запросе к API
+func Parse(data []byte, format string) (*State, error) {
+	state, err := decode(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func decode(data []byte, format string) (*State, error) {
+	if format == FormatYAML {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Invalid yaml: %s", err)
+		}
+		// yaml приводится к json, чтобы описание использовало те же поля, что и API
+		converted, err := json.Marshal(jsonValue(doc))
+		if err != nil {
+			return nil, err
+		}
+		data = converted
+	}
+
+	state := &State{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(state); err != nil {
+		return nil, fmt.Errorf("Invalid state: %s", err)
+	}
+
+	return state, nil
+}
+
+// Подстановка переменных окружения вида ${NAME}, остальные символы $ сохраняются как есть
+func expandEnv(value string) (string, error) {
+	var missing string
+	value = envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+
+	return value, nil
+}
+
+// Проверка имён и обязательных полей
+func (s *State) validate() error {
+	names := make(map[string]bool)
+	for _, c := range s.Credentials {
+		if !validName.MatchString(c.Name) {
+			return fmt.Errorf("Credentials: invalid name %q", c.Name)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("Credentials %s: declared twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.User == "" && c.CertPassword == "" {
+			return fmt.Errorf("Credentials %s: user or cert_password is required", c.Name)
+		}
+		if (c.User == "") != (c.Password == "") {
+			return fmt.Errorf("Credentials %s: user and password are set together", c.Name)
+		}
+	}
+
+	names = make(map[string]bool)
+	for _, t := range s.Tunnels {
+		if !validName.MatchString(t.Name) {
+			return fmt.Errorf("Tunnel: invalid name %q", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("Tunnel %s: declared twice", t.Name)
+		}
+		names[t.Name] = true
+
+		sources := 0
+		for _, v := range []string{t.Path, t.Config, t.Provider} {
+			if v != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("Tunnel %s: exactly one of path, config and provider is required", t.Name)
+		}
+		if t.State != "" && t.State != registry.StateRunning && t.State != registry.StateStopped {
+			return fmt.Errorf("Tunnel %s: state must be %s or %s", t.Name, registry.StateRunning, registry.StateStopped)
+		}
+	}
+
+	names = make(map[string]bool)
+	for i := range s.Pools {
+		p := &s.Pools[i]
+		if !validName.MatchString(p.Name) {
+			return fmt.Errorf("Pool: invalid name %q", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("Pool %s: declared twice", p.Name)
+		}
+		names[p.Name] = true
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Приведение значений yaml к типам, которые кодирует encoding/json
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			res[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return res
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+		return v
+	}
+
+	return v
+}
@@ -0,0 +1,117 @@
+package desired
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadExpandsEnv(t *testing.T) {
+	if err := os.Setenv("DESIRED_TEST_PASSWORD", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv("DESIRED_TEST_PASSWORD")
+	}()
+
+	tests := []struct {
+		name      string
+		password  string
+		want      string
+		wantError string
+	}{
+		{name: "reference", password: "${DESIRED_TEST_PASSWORD}", want: "secret"},
+		{name: "reference inside value", password: "x-${DESIRED_TEST_PASSWORD}-y", want: "x-secret-y"},
+		{name: "literal dollars", password: "pa$$word", want: "pa$$word"},
+		{name: "bare variable is literal", password: "$DESIRED_TEST_PASSWORD", want: "$DESIRED_TEST_PASSWORD"},
+		{name: "invalid reference is literal", password: "${1ABC}", want: "${1ABC}"},
+		{name: "unset variable", password: "${DESIRED_TEST_MISSING}", wantError: "DESIRED_TEST_MISSING is not set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tunnels.yaml")
+			data := "credentials:\n  - name: main\n    user: user\n    password: '" + tt.password + "'\n"
+			if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := Load(path)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("got error %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := state.Credentials[0].Password; got != tt.want {
+				t.Fatalf("got password %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Описание из запроса к API не должно раскрывать окружение сервера
+func TestParseKeepsEnvReferences(t *testing.T) {
+	if err := os.Setenv("DESIRED_TEST_PASSWORD", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Unsetenv("DESIRED_TEST_PASSWORD")
+	}()
+
+	state, err := Parse([]byte(`{"credentials": [{"name": "main", "user": "user", "password": "${DESIRED_TEST_PASSWORD}"}]}`), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.Credentials[0].Password; got != "${DESIRED_TEST_PASSWORD}" {
+		t.Fatalf("got password %q, want the reference unchanged", got)
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		format    string
+		wantError string
+	}{
+		{name: "yaml", format: FormatYAML, data: "tunnels:\n  - name: t1\n    path: /etc/t1.ovpn\n"},
+		{name: "unknown field", format: FormatJSON, data: `{"tunnels": [{"name": "t1", "path": "/a", "port": 1}]}`,
+			wantError: "unknown field"},
+		{name: "invalid yaml", format: FormatYAML, data: "tunnels: [", wantError: "Invalid yaml"},
+		{name: "invalid name", format: FormatJSON, data: `{"tunnels": [{"name": "-t", "path": "/a"}]}`,
+			wantError: "invalid name"},
+		{name: "tunnel declared twice", format: FormatJSON,
+			data: `{"tunnels": [{"name": "t1", "path": "/a"}, {"name": "t1", "path": "/b"}]}`, wantError: "declared twice"},
+		{name: "no source", format: FormatJSON, data: `{"tunnels": [{"name": "t1"}]}`,
+			wantError: "exactly one of path, config and provider"},
+		{name: "two sources", format: FormatJSON, data: `{"tunnels": [{"name": "t1", "path": "/a", "config": "b"}]}`,
+			wantError: "exactly one of path, config and provider"},
+		{name: "unknown state", format: FormatJSON, data: `{"tunnels": [{"name": "t1", "path": "/a", "state": "paused"}]}`,
+			wantError: "state must be"},
+		{name: "credentials without user", format: FormatJSON, data: `{"credentials": [{"name": "c", "password": "p"}]}`,
+			wantError: "user or cert_password is required"},
+		{name: "user without password", format: FormatJSON, data: `{"credentials": [{"name": "c", "user": "u"}]}`,
+			wantError: "user and password are set together"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data), tt.format)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("got error %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package docker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Хранимая в памяти реализация ContainerRuntime.
+// Используется для тестов и режима «dry run» на машинах без Docker
+type Fake struct {
+	mu         sync.Mutex
+	cnf        *config.Docker
+	containers map[string]*types.Container
+	// порты хоста, назначенные контейнерам; Docker показывает их в Ports только у запущенных
+	bindings map[string]nat.PortMap
+	// история логов по всем запускам контейнера, как у Docker
+	logs    map[string][]logEntry
+	started map[string]time.Time
+	images  []types.ImageSummary
+}
+
+// Запись логов контейнера со временем
+type logEntry struct {
+	at   time.Time
+	data []byte
+}
+
+// Инициализация хранимой в памяти среды выполнения
+func NewFake() *Fake {
+	logrus.Debug(">>> Initialization fake container runtime")
+
+	return &Fake{
+		cnf:        config.Get().Docker,
+		containers: make(map[string]*types.Container),
+		bindings:   make(map[string]nat.PortMap),
+		logs:       make(map[string][]logEntry),
+		started:    make(map[string]time.Time),
+	}
+}
+
+// Метод получения списка контейнеров
+func (f *Fake) GetContainersList() ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	containers := make([]types.Container, 0, len(f.containers))
+	for _, _container := range f.containers {
+		containers = append(containers, *_container)
+	}
+
+	return containers, nil
+}
+
+// Метод получения списка контейнеров, созданных vpntoproxy
+func (f *Fake) ContainersVPNList() (res []types.Container, err error) {
+	containers, err := f.GetContainersList()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range containers {
+		if IsManaged(&containers[i]) {
+			res = append(res, containers[i])
+		}
+	}
+
+	return res, nil
+}
+
+// Метод получения списка контейнеров с образом vpn без меток vpntoproxy
+func (f *Fake) UnmanagedVPNList() (res []types.Container, err error) {
+	containers, err := f.GetContainersList()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range containers {
+		if IsVPNImage(containers[i].Image) && !IsManaged(&containers[i]) {
+			res = append(res, containers[i])
+		}
+	}
+
+	return res, nil
+}
+
+// Метод получения контейнера по идентификатору
+func (f *Fake) GetContainerByID(ID string) (*types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _container, ok := f.find(ID); ok {
+		res := *_container
+		return &res, nil
+	}
+
+	return nil, errdefs.NotFound(fmt.Errorf("Container not finded"))
+}
+
+// Метод получения портов хоста, назначенных контейнерам, в том числе остановленным
+func (f *Fake) PublishedPorts() ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ports := make([]int, 0, len(f.containers))
+	for id := range f.containers {
+		for _, port := range makePorts(f.bindings[id]) {
+			if port.PublicPort != 0 {
+				ports = append(ports, int(port.PublicPort))
+			}
+		}
+	}
+
+	return ports, nil
+}
+
+// Метод создания контейнера
+func (f *Fake) RunContainer(config *container.Config, hostConfig *container.HostConfig, name string) (
+	*container.ContainerCreateCreatedBody, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = "/" + name
+	for _, _container := range f.containers {
+		if _container.Names[0] == name {
+			return nil, errdefs.Conflict(fmt.Errorf("Conflict. The container name %q is already in use by container %q",
+				name, _container.ID))
+		}
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	f.bindings[id] = hostConfig.PortBindings
+	f.containers[id] = &types.Container{
+		ID:      id,
+		Names:   []string{name},
+		Image:   config.Image,
+		Created: time.Now().Unix(),
+		Labels:  config.Labels,
+		Mounts:  makeMounts(hostConfig.Binds),
+		State:   "running",
+		Status:  "Up Less than a second",
+	}
+	f.start(id, config.Image)
+
+	logrus.Debug("Fake container created: ", id)
+
+	return &container.ContainerCreateCreatedBody{ID: id}, nil
+}
+
+// Метод закрытия контейнера
+func (f *Fake) Kill(id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return false, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+	if _container.State != "running" {
+		return false, errdefs.Conflict(fmt.Errorf("Container %s is not running", id))
+	}
+
+	_container.State = "exited"
+	_container.Status = "Exited (137) Less than a second ago"
+	_container.Ports = nil
+
+	return true, nil
+}
+
+// Метод перезапуска контейнера
+func (f *Fake) Restart(id string, timeout time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return false, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+
+	_container.State = "running"
+	_container.Status = "Up Less than a second"
+	f.start(_container.ID, _container.Image)
+
+	return true, nil
+}
+
+// Метод запуска остановленного контейнера
+func (f *Fake) Start(id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return false, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+	if _container.State == "running" {
+		return true, nil
+	}
+
+	_container.State = "running"
+	_container.Status = "Up Less than a second"
+	f.start(_container.ID, _container.Image)
+
+	return true, nil
+}
+
+// Метод остановки контейнера
+func (f *Fake) Stop(id string, timeout time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return false, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+	if _container.State != "running" {
+		return true, nil
+	}
+
+	_container.State = "exited"
+	_container.Status = "Exited (0) Less than a second ago"
+	_container.Ports = nil
+	f.log(_container.ID, []byte("SIGTERM received, process exiting\n"))
+
+	return true, nil
+}
+
+// Отметка запуска контейнера, логи подключения vpn добавляются к логам прежних запусков
+func (f *Fake) start(id string, image string) {
+	f.containers[id].Ports = makePorts(f.bindings[id])
+
+	now := time.Now()
+	f.started[id] = now
+	f.logs[id] = append(f.logs[id], logEntry{at: now, data: f.readyLogs(image)})
+}
+
+// Добавление записи в логи контейнера
+func (f *Fake) log(id string, data []byte) {
+	f.logs[id] = append(f.logs[id], logEntry{at: time.Now(), data: data})
+}
+
+// Логи контейнера с подключённым vpn
+func (f *Fake) readyLogs(image string) []byte {
+	if image == WireGuardImage() {
+		return []byte("WireGuard handshake completed\n")
+	}
+
+	return []byte("Initialization Sequence Completed\n")
+}
+
+// Метод удаления контейнера
+func (f *Fake) Remove(id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return false, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+	if _container.State == "running" {
+		return false, errdefs.Conflict(fmt.Errorf("You cannot remove a running container %s", id))
+	}
+
+	delete(f.containers, _container.ID)
+	delete(f.bindings, _container.ID)
+	delete(f.logs, _container.ID)
+	delete(f.started, _container.ID)
+
+	return true, nil
+}
+
+// Метод получения логов контейнера, записанных не раньше since. Нулевое since - вся история
+func (f *Fake) Logs(id string, since time.Time) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+
+	var res []byte
+	for _, entry := range f.logs[_container.ID] {
+		if !entry.at.Before(since) {
+			res = append(res, entry.data...)
+		}
+	}
+
+	return res, nil
+}
+
+// Время последнего запуска контейнера
+func (f *Fake) StartedAt(id string) (time.Time, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return time.Time{}, errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+
+	return f.started[_container.ID], nil
+}
+
+// Метод записи логов текущего запуска контейнера, позволяет имитировать состояние vpn.
+// Логи прежних запусков сохраняются
+func (f *Fake) SetLogs(id string, logs []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_container, ok := f.find(id)
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", id))
+	}
+
+	started := f.started[_container.ID]
+	entries := make([]logEntry, 0, len(f.logs[_container.ID])+1)
+	for _, entry := range f.logs[_container.ID] {
+		if entry.at.Before(started) {
+			entries = append(entries, entry)
+		}
+	}
+	f.logs[_container.ID] = append(entries, logEntry{at: started, data: logs})
+
+	return nil
+}
+
+// Метод получения списка образов
+func (f *Fake) GetListImages() ([]types.ImageSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	images := make([]types.ImageSummary, len(f.images))
+	copy(images, f.images)
+
+	return images, nil
+}
+
+// Метод создания образа
+func (f *Fake) BuildImage(tag string, bctx string, args map[string]*string) (*types.ImageBuildResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	f.images = append(f.images, types.ImageSummary{
+		ID:       "sha256:" + id,
+		RepoTags: []string{tag + ":latest"},
+		Created:  time.Now().Unix(),
+	})
+
+	return &types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+// Поиск контейнера по полному или сокращённому идентификатору
+func (f *Fake) find(id string) (*types.Container, bool) {
+	if id == "" {
+		return nil, false
+	}
+
+	if _container, ok := f.containers[id]; ok {
+		return _container, true
+	}
+
+	for _, _container := range f.containers {
+		if strings.HasPrefix(_container.ID, id) {
+			return _container, true
+		}
+	}
+
+	return nil, false
+}
+
+// Формирование списка опубликованных портов по параметрам хоста
+func makePorts(bindings nat.PortMap) (ports []types.Port) {
+	for port, hostBindings := range bindings {
+		for _, binding := range hostBindings {
+			publicPort, _ := strconv.Atoi(binding.HostPort)
+			ip := binding.HostIP
+			if ip == "" {
+				ip = "0.0.0.0"
+			}
+			ports = append(ports, types.Port{
+				IP:          ip,
+				PrivatePort: uint16(port.Int()),
+				PublicPort:  uint16(publicPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+
+	return ports
+}
+
+// Формирование списка точек монтирования по параметрам хоста
+func makeMounts(binds []string) (mounts []types.MountPoint) {
+	for _, bind := range binds {
+		parts := strings.SplitN(bind, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		mounts = append(mounts, types.MountPoint{
+			Type:        "bind",
+			Source:      parts[0],
+			Destination: parts[1],
+			RW:          len(parts) < 3 || parts[2] != "ro",
+		})
+	}
+
+	return mounts
+}
+
+// Генерация идентификатора в формате Docker
+func randomID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
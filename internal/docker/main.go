@@ -8,13 +8,16 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 	"vpntoproxy/internal/config"
 )
 
+// Реализация ContainerRuntime поверх демона Docker
 type Client struct {
 	cli *client.Client
 	cnf *config.Docker
@@ -46,7 +49,8 @@ func New() (*Client, error) {
 func (cl *Client) GetContainersList() (containers []types.Container, err error) {
 	logrus.Debug(">>> Starting get containers list")
 
-	containers, err = cl.cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	// остановленные и завершившиеся контейнеры тоже входят в список
+	containers, err = cl.cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
 	if err != nil {
 		logrus.Debug("Error getting containers list")
 		return nil, err
@@ -58,29 +62,48 @@ func (cl *Client) GetContainersList() (containers []types.Container, err error)
 	return containers, nil
 }
 
-// Метод получения списка контейнеров с образом vpn
-func (cl *Client) ContainersVPNList() (res []types.Container, err error) {
-	logrus.Debug(">>> Starting get containers list with image '%s'", cl.cnf.ImageName)
+// Метод получения списка контейнеров, созданных vpntoproxy
+func (cl *Client) ContainersVPNList() ([]types.Container, error) {
+	logrus.Debug(">>> Starting get containers list with label ", LabelManager)
+
+	_filters := filters.NewArgs()
+	_filters.Add("label", LabelManager+"="+ManagerName)
+
+	containers, err := cl.cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: _filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Debug("<<< Ending get containers list with label ", LabelManager)
+
+	return containers, nil
+}
+
+// Метод получения списка контейнеров с образом vpn без меток vpntoproxy
+func (cl *Client) UnmanagedVPNList() (res []types.Container, err error) {
+	logrus.Debugf(">>> Starting get unlabeled containers with images '%s', '%s'", cl.cnf.ImageName, WireGuardImage())
 
 	containers, err := cl.GetContainersList()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, _container := range containers {
-		if _container.Image == cl.cnf.ImageName {
-			res = append(res, _container)
+	for i := range containers {
+		if IsVPNImage(containers[i].Image) && !IsManaged(&containers[i]) {
+			res = append(res, containers[i])
 		}
 	}
 
-	logrus.Debug("Container list received successfully")
-	logrus.Debug("<<< Ending get containers list with image '%s'", cl.cnf.ImageName)
+	logrus.Debug("<<< Ending get unlabeled containers with vpn images")
 
 	return res, nil
 }
 
 // Метод создания контейнера
-func (cl *Client) RunContainer(config *container.Config, hostConfig *container.HostConfig, basename string) (
+func (cl *Client) RunContainer(config *container.Config, hostConfig *container.HostConfig, name string) (
 	*container.ContainerCreateCreatedBody, error) {
 
 	logrus.Debug(">>> Starting create container")
@@ -89,8 +112,7 @@ func (cl *Client) RunContainer(config *container.Config, hostConfig *container.H
 
 	ctx := context.Background()
 
-	resp, err := cl.cli.ContainerCreate(ctx, config, hostConfig, nil, nil,
-		cl.cnf.ServicePrefix+strings.Split(basename, ".")[0])
+	resp, err := cl.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, name)
 
 	if err != nil {
 		logrus.Debug("Failed create container")
@@ -124,7 +146,7 @@ func (cl *Client) GetListImages() (images []types.ImageSummary, err error) {
 }
 
 // Метод создания образа
-func (cl *Client) BuildImage(tag string, bctx string) (*types.ImageBuildResponse, error) {
+func (cl *Client) BuildImage(tag string, bctx string, args map[string]*string) (*types.ImageBuildResponse, error) {
 	logrus.Debug(">>> Starting build image")
 	logrus.Debug("Image tag:", tag)
 	logrus.Debug("Build context:", bctx)
@@ -132,10 +154,16 @@ func (cl *Client) BuildImage(tag string, bctx string) (*types.ImageBuildResponse
 	ctx := context.Background()
 
 	options := types.ImageBuildOptions{
-		Tags: []string{tag},
+		Tags:      []string{tag},
+		BuildArgs: args,
+	}
+
+	// по умолчанию собирается образ OpenVPN
+	if bctx == "" {
+		bctx = imagePath
 	}
 
-	f, err := os.Open(imagePath)
+	f, err := os.Open(bctx)
 	if err != nil {
 		logrus.Debug("Error open dockerfile")
 		logrus.Error(err)
@@ -167,6 +195,7 @@ func (cl *Client) GetContainerByID(ID string) (*types.Container, error) {
 	_filters.Add("id", ID)
 
 	_container, err := cl.cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
 		Filters: _filters,
 	})
 	if err != nil {
@@ -182,7 +211,54 @@ func (cl *Client) GetContainerByID(ID string) (*types.Container, error) {
 		return &_container[0], nil
 	}
 
-	return nil, fmt.Errorf("Container not finded")
+	return nil, errdefs.NotFound(fmt.Errorf("Container not finded"))
+}
+
+// Метод получения портов хоста, назначенных контейнерам.
+// У остановленных контейнеров порты берутся из параметров хоста, в списке контейнеров их нет
+func (cl *Client) PublishedPorts() ([]int, error) {
+	logrus.Debug(">>> Starting get published ports")
+
+	ctx := context.Background()
+
+	containers, err := cl.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make([]int, 0, len(containers))
+	for _, _container := range containers {
+		if _container.State == "running" {
+			for _, port := range _container.Ports {
+				if port.PublicPort != 0 {
+					ports = append(ports, int(port.PublicPort))
+				}
+			}
+			continue
+		}
+
+		inspect, err := cl.cli.ContainerInspect(ctx, _container.ID)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if inspect.HostConfig == nil {
+			continue
+		}
+		for _, bindings := range inspect.HostConfig.PortBindings {
+			for _, binding := range bindings {
+				if port, err := strconv.Atoi(binding.HostPort); err == nil && port != 0 {
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+
+	logrus.Debug("<<< Ending get published ports")
+
+	return ports, nil
 }
 
 // Метод закрытия контейнера
@@ -202,6 +278,57 @@ func (cl *Client) Kill(id string) (bool, error) {
 	return true, nil
 }
 
+// Метод запуска остановленного контейнера
+func (cl *Client) Start(id string) (bool, error) {
+	logrus.Debug(">>> Starting start container")
+	logrus.Debug("Container ID:", id)
+
+	err := cl.cli.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
+	if err != nil {
+		logrus.Debug("Error, start container failed")
+		return false, err
+	}
+
+	logrus.Debug("Container started succesfully")
+	logrus.Debug("<<< Ending start container")
+
+	return true, nil
+}
+
+// Метод остановки контейнера
+func (cl *Client) Stop(id string, timeout time.Duration) (bool, error) {
+	logrus.Debug(">>> Starting stop container")
+	logrus.Debug("Container ID:", id)
+
+	err := cl.cli.ContainerStop(context.Background(), id, &timeout)
+	if err != nil {
+		logrus.Debug("Error, stop container failed")
+		return false, err
+	}
+
+	logrus.Debug("Container stopped succesfully")
+	logrus.Debug("<<< Ending stop container")
+
+	return true, nil
+}
+
+// Метод перезапуска контейнера
+func (cl *Client) Restart(id string, timeout time.Duration) (bool, error) {
+	logrus.Debug(">>> Starting restart container")
+	logrus.Debug("Container ID:", id)
+
+	err := cl.cli.ContainerRestart(context.Background(), id, &timeout)
+	if err != nil {
+		logrus.Debug("Error, restart container failed")
+		return false, err
+	}
+
+	logrus.Debug("Container restarted succesfully")
+	logrus.Debug("<<< Ending restart container")
+
+	return true, nil
+}
+
 // Метод удаления контейнера
 func (cl *Client) Remove(id string) (bool, error) {
 	logrus.Debug(">>> Starting remove container")
@@ -219,20 +346,53 @@ func (cl *Client) Remove(id string) (bool, error) {
 	return true, nil
 }
 
-func (cl *Client) CheckVPN(id string) (bool, error) {
-	logrus.Debug(">>> Starting check vpn")
+// Метод получения логов контейнера, записанных не раньше since
+func (cl *Client) Logs(id string, since time.Time) ([]byte, error) {
+	logrus.Debug(">>> Starting get container logs")
 	logrus.Debug("Container ID:", id)
 
-	logs, err := cl.cli.ContainerLogs(context.Background(), id, types.ContainerLogsOptions{ShowStdout: true})
+	options := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
+	if !since.IsZero() {
+		options.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+
+	logs, err := cl.cli.ContainerLogs(context.Background(), id, options)
 	if err != nil {
 		logrus.Debug("Error, get logs container failed")
-		return false, err
+		return nil, err
+	}
+	defer func() {
+		if err := logs.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	// потоки stdout и stderr контейнера без tty приходят с заголовками кадров
+	var logsBytes bytes.Buffer
+	if _, err := stdcopy.StdCopy(&logsBytes, &logsBytes, logs); err != nil {
+		return nil, err
 	}
 
-	logsBytes, err := ioutil.ReadAll(logs)
+	logrus.Debug("<<< Ending get container logs")
+
+	return logsBytes.Bytes(), nil
+}
+
+// Метод получения времени последнего запуска контейнера
+func (cl *Client) StartedAt(id string) (time.Time, error) {
+	logrus.Debug(">>> Starting inspect container")
+	logrus.Debug("Container ID:", id)
+
+	info, err := cl.cli.ContainerInspect(context.Background(), id)
+	if err != nil {
+		logrus.Debug("Error, inspect container failed")
+		return time.Time{}, err
+	}
+	if info.State == nil {
+		return time.Time{}, nil
+	}
 
-	logrus.Debug("Vpn checked succesfully")
-	logrus.Debug("<<< Ending check vpn")
+	logrus.Debug("<<< Ending inspect container")
 
-	return bytes.Contains(logsBytes, []byte("Initialization Sequence Completed")), nil
+	return time.Parse(time.RFC3339Nano, info.State.StartedAt)
 }
@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"bytes"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Метки контейнеров, созданных vpntoproxy
+const (
+	LabelManager    = "vpntoproxy.manager"
+	LabelTunnel     = "vpntoproxy.tunnel"
+	LabelType       = "vpntoproxy.type"
+	LabelConfigHash = "vpntoproxy.config_hash"
+	LabelPort       = "vpntoproxy.port"
+	LabelCreatedAt  = "vpntoproxy.created_at"
+)
+
+// Значение метки LabelManager
+const ManagerName = "vpntoproxy"
+
+// Интерфейс среды выполнения контейнеров.
+// Реализуется клиентом Docker (Client) и хранимой в памяти заглушкой (Fake),
+// что позволяет управлять туннелями без запущенного демона
+type ContainerRuntime interface {
+	// Получение списка контейнеров
+	GetContainersList() ([]types.Container, error)
+	// Получение списка контейнеров, созданных vpntoproxy (по метке LabelManager)
+	ContainersVPNList() ([]types.Container, error)
+	// Получение списка контейнеров с образом vpn без меток vpntoproxy
+	UnmanagedVPNList() ([]types.Container, error)
+	// Получение контейнера по идентификатору
+	GetContainerByID(ID string) (*types.Container, error)
+	// Получение портов хоста, назначенных контейнерам, в том числе остановленным
+	PublishedPorts() ([]int, error)
+	// Создание и запуск контейнера с именем name
+	RunContainer(config *container.Config, hostConfig *container.HostConfig, name string) (
+		*container.ContainerCreateCreatedBody, error)
+	// Запуск остановленного контейнера
+	Start(id string) (bool, error)
+	// Остановка контейнера: SIGTERM, через timeout SIGKILL
+	Stop(id string, timeout time.Duration) (bool, error)
+	// Закрытие контейнера
+	Kill(id string) (bool, error)
+	// Перезапуск контейнера
+	Restart(id string, timeout time.Duration) (bool, error)
+	// Удаление контейнера
+	Remove(id string) (bool, error)
+	// Получение логов контейнера, записанных не раньше since, нулевое since - вся история
+	Logs(id string, since time.Time) ([]byte, error)
+	// Получение времени последнего запуска контейнера
+	StartedAt(id string) (time.Time, error)
+	// Получение списка образов
+	GetListImages() ([]types.ImageSummary, error)
+	// Создание образа
+	BuildImage(tag string, bctx string, args map[string]*string) (*types.ImageBuildResponse, error)
+}
+
+var (
+	_ ContainerRuntime = (*Client)(nil)
+	_ ContainerRuntime = (*Fake)(nil)
+)
+
+// Проверка подключения vpn по строке marker в логах последнего запуска контейнера.
+// Логи прежних запусков не учитываются: перезапущенный контейнер ещё не подключён
+func CheckVPN(rt ContainerRuntime, id string, marker string) (bool, error) {
+	logrus.Debug(">>> Starting check vpn")
+	logrus.Debug("Container ID:", id)
+
+	started, err := rt.StartedAt(id)
+	if err != nil {
+		logrus.Debug("Error, get container start time failed")
+		return false, err
+	}
+
+	logs, err := rt.Logs(id, started)
+	if err != nil {
+		logrus.Debug("Error, get logs container failed")
+		return false, err
+	}
+
+	logrus.Debug("Vpn checked succesfully")
+	logrus.Debug("<<< Ending check vpn")
+
+	return bytes.Contains(logs, []byte(marker)), nil
+}
+
+// Образ туннелей WireGuard, если docker.wireguard_image не задан
+const DefaultWireGuardImage = "wgwithproxy"
+
+// Образ туннелей WireGuard из docker.wireguard_image
+func WireGuardImage() string {
+	if image := config.Get().Docker.WireGuardImage; image != "" {
+		return image
+	}
+
+	return DefaultWireGuardImage
+}
+
+// Проверка, что образ контейнера является образом туннеля
+func IsVPNImage(image string) bool {
+	return image == config.Get().Docker.ImageName || image == WireGuardImage()
+}
+
+// Проверка, что контейнер создан vpntoproxy
+func IsManaged(_container *types.Container) bool {
+	return _container.Labels[LabelManager] == ManagerName
+}
+
+// Проверка, что ошибка означает отсутствие контейнера или образа
+func IsNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}
@@ -0,0 +1,121 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Конфигурация proxychains. Для каждого соединения выбирается один случайный туннель
+func Proxychains(proxies []Proxy) []byte {
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("# Generated by vpntoproxy\n")
+	buf.WriteString("random_chain\n")
+	buf.WriteString("chain_len = 1\n")
+	buf.WriteString("proxy_dns\n")
+	buf.WriteString("tcp_read_time_out 15000\n")
+	buf.WriteString("tcp_connect_time_out 8000\n")
+	buf.WriteString("\n[ProxyList]\n")
+
+	for _, p := range proxies {
+		if p.User != "" {
+			fmt.Fprintf(buf, "socks5 %s %d %s %s\n", p.Host, p.Port, p.User, p.Password)
+		} else {
+			fmt.Fprintf(buf, "socks5 %s %d\n", p.Host, p.Port)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Список адресов прокси, по одному в строке
+func List(proxies []Proxy) []byte {
+	buf := &bytes.Buffer{}
+
+	for i := range proxies {
+		buf.WriteString(proxyURL(&proxies[i]))
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+// Прокси и группа с балансировкой для Clash в формате YAML.
+// Строки записываются в двойных кавычках, что допустимо в YAML
+func Clash(proxies []Proxy) []byte {
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("# Generated by vpntoproxy\n")
+	buf.WriteString("proxies:\n")
+	if len(proxies) == 0 {
+		buf.WriteString("  []\n")
+	}
+	for _, p := range proxies {
+		fmt.Fprintf(buf, "  - name: %s\n", strconv.Quote(p.Name))
+		buf.WriteString("    type: socks5\n")
+		fmt.Fprintf(buf, "    server: %s\n", strconv.Quote(p.Host))
+		fmt.Fprintf(buf, "    port: %d\n", p.Port)
+		if p.User != "" {
+			fmt.Fprintf(buf, "    username: %s\n", strconv.Quote(p.User))
+			fmt.Fprintf(buf, "    password: %s\n", strconv.Quote(p.Password))
+		}
+		buf.WriteString("    udp: false\n")
+	}
+
+	if len(proxies) > 0 {
+		buf.WriteString("proxy-groups:\n")
+		fmt.Fprintf(buf, "  - name: %s\n", strconv.Quote(groupName))
+		buf.WriteString("    type: load-balance\n")
+		buf.WriteString("    strategy: round-robin\n")
+		buf.WriteString("    url: \"http://www.gstatic.com/generate_204\"\n")
+		buf.WriteString("    interval: 300\n")
+		buf.WriteString("    proxies:\n")
+		for _, p := range proxies {
+			fmt.Fprintf(buf, "      - %s\n", strconv.Quote(p.Name))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+type singBoxOutbound struct {
+	Type       string   `json:"type"`
+	Tag        string   `json:"tag"`
+	Server     string   `json:"server,omitempty"`
+	ServerPort int      `json:"server_port,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	Outbounds  []string `json:"outbounds,omitempty"`
+}
+
+// Исходящие соединения sing-box и группа с выбором туннеля
+func SingBox(proxies []Proxy) ([]byte, error) {
+	outbounds := make([]singBoxOutbound, 0, len(proxies)+1)
+	tags := make([]string, 0, len(proxies))
+
+	for _, p := range proxies {
+		outbounds = append(outbounds, singBoxOutbound{
+			Type:       "socks",
+			Tag:        p.Name,
+			Server:     p.Host,
+			ServerPort: p.Port,
+			Version:    "5",
+			Username:   p.User,
+			Password:   p.Password,
+		})
+		tags = append(tags, p.Name)
+	}
+
+	if len(tags) > 0 {
+		outbounds = append(outbounds, singBoxOutbound{
+			Type:      "urltest",
+			Tag:       groupName,
+			Outbounds: tags,
+		})
+	}
+
+	return json.MarshalIndent(map[string]interface{}{"outbounds": outbounds}, "", "  ")
+}
@@ -0,0 +1,106 @@
+// пакет выгрузки списка туннелей в форматах клиентских программ
+package export
+
+import (
+	"fmt"
+	"strings"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/routing"
+)
+
+// Форматы выгрузки
+const (
+	FormatPAC         = "pac"
+	FormatProxychains = "proxychains"
+	FormatList        = "list"
+	FormatClash       = "clash"
+	FormatSingBox     = "singbox"
+)
+
+// Имя группы туннелей в конфигурациях Clash и sing-box
+const groupName = "vpntoproxy"
+
+// Socks5 прокси туннеля
+type Proxy struct {
+	Name     string
+	Host     string
+	Port     int
+	User     string
+	Password string
+}
+
+// Условия отбора туннелей
+type Filter struct {
+	Tag     string
+	Country string
+}
+
+// Отбор исправных туннелей, удовлетворяющих условиям
+func Healthy(tunnels []*registry.Tunnel, filter *Filter) []*registry.Tunnel {
+	res := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		if !t.Healthy() || t.HostPort == 0 {
+			continue
+		}
+		if filter != nil && filter.Tag != "" && !t.HasTag(filter.Tag) {
+			continue
+		}
+		if filter != nil && filter.Country != "" && !strings.EqualFold(t.Country, filter.Country) {
+			continue
+		}
+		res = append(res, t)
+	}
+
+	return res
+}
+
+// Прокси туннелей с учётными данными из конфигурации
+func Proxies(tunnels []*registry.Tunnel) []Proxy {
+	conf := config.Get()
+
+	res := make([]Proxy, 0, len(tunnels))
+	for _, t := range tunnels {
+		res = append(res, Proxy{
+			Name:     t.Name,
+			Host:     conf.Proxy.Host,
+			Port:     t.HostPort,
+			User:     conf.Docker.ProxyUser,
+			Password: conf.Docker.ProxyPassword,
+		})
+	}
+
+	return res
+}
+
+// Выгрузка туннелей в указанном формате
+func Render(format string, tunnels []*registry.Tunnel, rules []routing.Rule) ([]byte, error) {
+	switch format {
+	case FormatPAC:
+		return PAC(tunnels, rules), nil
+	case FormatProxychains:
+		return Proxychains(Proxies(tunnels)), nil
+	case FormatList:
+		return List(Proxies(tunnels)), nil
+	case FormatClash:
+		return Clash(Proxies(tunnels)), nil
+	case FormatSingBox:
+		return SingBox(Proxies(tunnels))
+	}
+
+	return nil, fmt.Errorf("Unknown export format %q", format)
+}
+
+// Тип содержимого для формата выгрузки
+func ContentType(format string) string {
+	switch format {
+	case FormatPAC:
+		return "application/x-ns-proxy-autoconfig"
+	case FormatClash:
+		return "text/yaml; charset=utf-8"
+	case FormatSingBox:
+		return "application/json; charset=utf-8"
+	}
+
+	return "text/plain; charset=utf-8"
+}
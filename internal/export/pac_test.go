@@ -0,0 +1,133 @@
+package export
+
+import (
+	"encoding/json"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"vpntoproxy/internal/routing"
+)
+
+func TestJSRegex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		flags   string
+		ok      bool
+	}{
+		{pattern: `^(www\.)?example\.com$`, want: `^(www\.)?example\.com$`, ok: true},
+		{pattern: `(?i)^Example\.com$`, want: `^Example\.com$`, flags: "i", ok: true},
+		{pattern: `(?im)^a$`, want: `^a$`, flags: "im", ok: true},
+		{pattern: `\Aexample\.com\z`, want: `^example\.com$`, ok: true},
+		{pattern: `^(?:a|b)\.example\.com$`, want: `^(?:a|b)\.example\.com$`, ok: true},
+		{pattern: `[]a]\.com`, want: `[\]a]\.com`, ok: true},
+		{pattern: `[^]a]\.com`, want: `[^\]a]\.com`, ok: true},
+		{pattern: `\x41\.com`, want: `\x41\.com`, ok: true},
+		{pattern: `\\A`, want: `\\A`, ok: true},
+		{pattern: `(?s)a.b`},
+		{pattern: `a(?i)b`},
+		{pattern: `(?P<sub>[a-z]+)\.example\.com`},
+		{pattern: `[[:alpha:]]+\.com`},
+		{pattern: `\pL+\.com`},
+		{pattern: `\Qa.b\E`},
+		{pattern: `\x{41}\.com`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, flags, ok := jsRegex(tt.pattern)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got != tt.want || flags != tt.flags {
+				t.Fatalf("got /%s/%s, want /%s/%s", got, flags, tt.want, tt.flags)
+			}
+		})
+	}
+}
+
+// Переведённые выражения должны давать в javascript те же совпадения, что и в Go
+func TestJSRegexMatchesGo(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	patterns := []string{
+		`(?i)^(www\.)?example\.com$`,
+		`\Aapi\d+\.example\.com\z`,
+		`[]x]\.example\.com$`,
+		`^[^.]+\.example\.(com|org)$`,
+	}
+	hosts := []string{"example.com", "WWW.Example.com", "api12.example.com", "api.example.com",
+		"x.example.com", "].example.com", "a.example.org", "a.b.example.org", "example.com.evil.net"}
+
+	type check struct {
+		Pattern string   `json:"pattern"`
+		Flags   string   `json:"flags"`
+		Hosts   []string `json:"hosts"`
+	}
+	checks := make([]check, 0, len(patterns))
+	for _, pattern := range patterns {
+		js, flags, ok := jsRegex(pattern)
+		if !ok {
+			t.Fatalf("%s is not translated", pattern)
+		}
+		checks = append(checks, check{Pattern: js, Flags: flags, Hosts: hosts})
+	}
+
+	input, err := json.Marshal(checks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := `const checks = JSON.parse(require("fs").readFileSync(0, "utf8"));
+console.log(JSON.stringify(checks.map(c => c.hosts.map(h => new RegExp(c.pattern, c.flags).test(h)))));`
+	cmd := exec.Command(node, "-e", script)
+	cmd.Stdin = strings.NewReader(string(input))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results [][]bool
+	if err := json.Unmarshal(out, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, pattern := range patterns {
+		re := regexp.MustCompile(pattern)
+		for j, host := range hosts {
+			if want := re.MatchString(host); results[i][j] != want {
+				t.Errorf("%s on %s: javascript %v, go %v", pattern, host, results[i][j], want)
+			}
+		}
+	}
+}
+
+func TestPACSkipsUntranslatableRegex(t *testing.T) {
+	rules := []routing.Rule{
+		{ID: "r1", DomainRegex: `(?i)^example\.com$`, Action: routing.ActionDirect},
+		{ID: "r2", DomainRegex: `(?P<sub>\w+)\.example\.com`, Action: routing.ActionDirect},
+		{ID: "r3", Sources: []string{"10.0.0.0/8"}, Action: routing.ActionDirect},
+	}
+
+	pac := string(PAC(nil, rules))
+
+	for _, want := range []string{
+		`new RegExp("^example\\.com$", "i").test(host)`,
+		"// rule r2 skipped: domain regex uses syntax not supported in javascript",
+		"// rule r3 skipped: depends on client address or user name",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC does not contain %q:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "?P<sub>") {
+		t.Errorf("PAC contains untranslatable regex:\n%s", pac)
+	}
+}
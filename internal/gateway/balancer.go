@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"vpntoproxy/internal/registry"
+)
+
+// Стратегии выбора туннеля
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyLeastConnections = "least_connections"
+	StrategyRandom           = "random"
+)
+
+// Балансировщик нагрузки между туннелями
+type balancer struct {
+	mu       sync.Mutex
+	strategy string
+	next     int
+}
+
+func newBalancer(strategy string) (*balancer, error) {
+	switch strategy {
+	case StrategyRoundRobin, StrategyLeastConnections, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("Unknown balancing strategy %q", strategy)
+	}
+
+	return &balancer{strategy: strategy}, nil
+}
+
+// Выбор туннеля из списка кандидатов, active содержит число активных соединений по туннелям
+func (b *balancer) pick(tunnels []*registry.Tunnel, active map[string]int) *registry.Tunnel {
+	if len(tunnels) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.strategy {
+	case StrategyLeastConnections:
+		// среди туннелей с наименьшим числом соединений выбираем по кругу
+		least := make([]*registry.Tunnel, 0, len(tunnels))
+		for _, t := range tunnels {
+			if len(least) > 0 && active[t.ID] > active[least[0].ID] {
+				continue
+			}
+			if len(least) > 0 && active[t.ID] < active[least[0].ID] {
+				least = least[:0]
+			}
+			least = append(least, t)
+		}
+		t := least[b.next%len(least)]
+		b.next++
+		return t
+	case StrategyRandom:
+		return tunnels[rand.Intn(len(tunnels))]
+	default:
+		t := tunnels[b.next%len(tunnels)]
+		b.next++
+		return t
+	}
+}
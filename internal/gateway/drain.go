@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpntoproxy/internal/registry"
+)
+
+// Интервал проверки закрытия соединений выводимого туннеля
+const drainPollInterval = 500 * time.Millisecond
+
+// Вывод туннеля из балансировки: новые соединения через него не устанавливаются,
+// активные закрываются клиентами. Ожидание не дольше timeout, возвращается количество оставшихся соединений.
+// Каждому выводу соответствует свой Undrain, туннель возвращается после последнего
+func (g *Gateway) Drain(id string, timeout time.Duration) int {
+	g.mu.Lock()
+	g.draining[id]++
+	g.mu.Unlock()
+
+	logrus.Infof("Gateway: draining tunnel %s", id)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		left := g.active()[id]
+		if left == 0 || time.Now().After(deadline) {
+			return left
+		}
+
+		select {
+		case <-time.After(drainPollInterval):
+		case <-g.stop:
+			return left
+		}
+	}
+}
+
+// Возврат туннеля в балансировку
+func (g *Gateway) Undrain(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.draining[id] > 1 {
+		g.draining[id]--
+		return
+	}
+	delete(g.draining, id)
+}
+
+// Туннели без выводимых из балансировки
+func (g *Gateway) undrained(tunnels []*registry.Tunnel) []*registry.Tunnel {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.draining) == 0 {
+		return tunnels
+	}
+
+	res := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		if g.draining[t.ID] == 0 {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+// Идентификаторы выводимых из балансировки туннелей
+func (g *Gateway) drainingList() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := make([]string, 0, len(g.draining))
+	for id := range g.draining {
+		res = append(res, id)
+	}
+
+	return res
+}
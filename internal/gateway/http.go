@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Заголовки, которые не передаются дальше прокси (RFC 7230, раздел 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type dialKey struct{}
+
+// Http прокси, поддерживает CONNECT и обычные запросы с абсолютным URL.
+// Если указан tunnelID, все соединения идут через этот туннель
+type httpProxy struct {
+	gateway   *Gateway
+	tunnelID  string
+	transport *http.Transport
+}
+
+// Функция соединения с адресом, возвращает соединение и туннель, через который оно установлено
+type dialFunc func(addr string) (net.Conn, string, error)
+
+func newHTTPProxy(g *Gateway, tunnelID string) *httpProxy {
+	p := &httpProxy{
+		gateway:  g,
+		tunnelID: tunnelID,
+	}
+
+	// соединения не переиспользуются, так как разные клиенты могут выбрать разные туннели
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dial, ok := ctx.Value(dialKey{}).(dialFunc)
+			if !ok {
+				return nil, fmt.Errorf("No tunnel dialer in request context")
+			}
+			conn, _, err := dial(addr)
+			return conn, err
+		},
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: time.Minute,
+	}
+
+	return p
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	creds, ok := proxyCredentials(r)
+	if (!ok && p.gateway.cnf.User != "") || (ok && !p.gateway.authorize(creds)) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="vpntoproxy"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	dial := p.dialer(creds, r.RemoteAddr)
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r, dial)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, absolute URL expected", http.StatusBadRequest)
+		return
+	}
+
+	p.forward(w, r, dial)
+}
+
+// Выбор функции соединения: через закреплённый туннель или через шлюз с правилами маршрутизации
+func (p *httpProxy) dialer(creds *credentials, remoteAddr string) dialFunc {
+	if p.tunnelID != "" {
+		return func(addr string) (net.Conn, string, error) {
+			conn, t, err := p.gateway.dialTunnel(p.tunnelID, addr)
+			if err != nil {
+				return nil, "", err
+			}
+			return conn, t.ID, nil
+		}
+	}
+
+	user := ""
+	if creds != nil {
+		user = creds.User
+	}
+
+	source, _ := net.ResolveTCPAddr("tcp", remoteAddr)
+
+	return func(addr string) (net.Conn, string, error) {
+		return p.gateway.route(addr, user, source)
+	}
+}
+
+// Туннелирование соединения методом CONNECT
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	upstream, route, err := dial(r.Host)
+	if err != nil {
+		logrus.Debugf("Http proxy cannot connect to %s: %s", r.Host, err)
+		http.Error(w, err.Error(), dialStatus(err))
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		logrus.Debug("Http proxy hijack failed: ", err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	// данные, которые клиент успел отправить вместе с запросом
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		if _, err := upstream.Write(data); err != nil {
+			return
+		}
+	}
+
+	logrus.Debugf("Http proxy connection to %s through %s", r.Host, route)
+
+	p.gateway.track(conn, route)
+	defer p.gateway.untrack(conn)
+
+	pipe(conn, upstream)
+}
+
+// Передача обычного http запроса
+func (p *httpProxy) forward(w http.ResponseWriter, r *http.Request, dial dialFunc) {
+	out := r.Clone(context.WithValue(r.Context(), dialKey{}, dial))
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		logrus.Debugf("Http proxy request to %s failed: %s", r.URL, err)
+		http.Error(w, err.Error(), dialStatus(err))
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logrus.Debug("Http proxy response copy failed: ", err)
+	}
+}
+
+// Код ответа при ошибке соединения
+func dialStatus(err error) int {
+	if errors.Is(err, errRejected) {
+		return http.StatusForbidden
+	}
+
+	return http.StatusBadGateway
+}
+
+// Учётные данные из заголовка Proxy-Authorization
+func proxyCredentials(r *http.Request) (*credentials, bool) {
+	header := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(header, "Basic ") {
+		return nil, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+	if err != nil {
+		return nil, false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	return &credentials{User: parts[0], Password: parts[1], Auth: true}, true
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, name := range header.Values("Connection") {
+		for _, field := range strings.Split(name, ",") {
+			header.Del(strings.TrimSpace(field))
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,602 @@
+// пакет шлюза на стороне хоста, распределяющего соединения между исправными туннелями
+package gateway
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/vpn"
+)
+
+const (
+	// Время на согласование с клиентом
+	handshakeTimeout = 10 * time.Second
+	// Время жизни кэша исправных туннелей
+	cacheTTL = time.Second
+	// Количество туннелей, через которые пытаемся соединиться
+	maxDialAttempts = 3
+	// Метка соединений, установленных напрямую по правилу маршрутизации
+	directRoute = "direct"
+)
+
+// Ошибка отказа в соединении правилом маршрутизации
+var errRejected = fmt.Errorf("Connection rejected by routing rule")
+
+type Gateway struct {
+	manager  *vpn.Manager
+	routes   *routing.Engine
+	cnf      *config.Gateway
+	balancer *balancer
+	sessions *sessions
+	listener net.Listener
+	http     *http.Server
+	tunnels  *tunnelServers
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]string
+	// туннели, выводимые из балансировки перед сменой сервера, с количеством выводов
+	draining map[string]int
+
+	cacheMu sync.Mutex
+	cache   []*registry.Tunnel
+	cacheAt time.Time
+	// закрывается по окончании обновления кэша, nil если кэш не обновляется
+	refreshing chan struct{}
+	refreshErr error
+}
+
+// Состояние шлюза
+type Status struct {
+	Address     string         `json:"address"`
+	HTTPAddress string         `json:"http_address,omitempty"`
+	Strategy    string         `json:"strategy"`
+	Healthy     int            `json:"healthy"`
+	Connections map[string]int `json:"connections"`
+	Sessions    int            `json:"sessions"`
+	Draining    []string       `json:"draining,omitempty"`
+}
+
+// Инициализация шлюза
+func New(manager *vpn.Manager, routes *routing.Engine) (*Gateway, error) {
+	cnf := config.Get().Gateway
+
+	b, err := newBalancer(cnf.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Gateway{
+		manager:  manager,
+		routes:   routes,
+		cnf:      cnf,
+		balancer: b,
+		sessions: newSessions(time.Duration(cnf.SessionTTL) * time.Second),
+		tunnels:  newTunnelServers(),
+		stop:     make(chan struct{}),
+		conns:    make(map[net.Conn]string),
+		draining: make(map[string]int),
+	}, nil
+}
+
+// Запуск прослушивания порта шлюза
+func (g *Gateway) Start() error {
+	listener, err := net.Listen("tcp", g.Address())
+	if err != nil {
+		return err
+	}
+	g.listener = listener
+
+	logrus.Infof("Gateway listening on %s, strategy: %s", g.Address(), g.cnf.Strategy)
+
+	g.wg.Add(1)
+	go g.serve()
+
+	if g.cnf.HttpPort > 0 {
+		if err := g.startHTTP(); err != nil {
+			_ = g.listener.Close()
+			return err
+		}
+	}
+
+	if g.cnf.TunnelHttpPorts {
+		g.wg.Add(1)
+		go g.syncTunnelServers()
+	}
+
+	return nil
+}
+
+// Запуск http прокси шлюза
+func (g *Gateway) startHTTP() error {
+	listener, err := net.Listen("tcp", g.HTTPAddress())
+	if err != nil {
+		return err
+	}
+
+	g.http = &http.Server{
+		Handler:           newHTTPProxy(g, ""),
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+
+	logrus.Infof("Gateway http proxy listening on %s", g.HTTPAddress())
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := g.http.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Error("Gateway http proxy: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// Остановка шлюза с закрытием активных соединений
+func (g *Gateway) Stop() {
+	close(g.stop)
+
+	if g.listener != nil {
+		if err := g.listener.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	if g.http != nil {
+		if err := g.http.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	g.tunnels.closeAll()
+
+	g.mu.Lock()
+	for conn := range g.conns {
+		_ = conn.Close()
+	}
+	g.mu.Unlock()
+
+	g.wg.Wait()
+
+	logrus.Info("Gateway stopped")
+}
+
+// Адрес прослушивания шлюза
+func (g *Gateway) Address() string {
+	return net.JoinHostPort(g.cnf.Host, strconv.Itoa(g.cnf.Port))
+}
+
+// Адрес http прокси шлюза, пустой если http прокси выключен
+func (g *Gateway) HTTPAddress() string {
+	if g.cnf.HttpPort <= 0 {
+		return ""
+	}
+
+	return net.JoinHostPort(g.cnf.Host, strconv.Itoa(g.cnf.HttpPort))
+}
+
+// Получение состояния шлюза
+func (g *Gateway) Status() (*Status, error) {
+	healthy, err := g.healthy()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Status{
+		Address:     g.Address(),
+		HTTPAddress: g.HTTPAddress(),
+		Strategy:    g.cnf.Strategy,
+		Healthy:     len(healthy),
+		Connections: g.active(),
+		Sessions:    len(g.sessions.list()),
+		Draining:    g.drainingList(),
+	}, nil
+}
+
+// Получение таблицы закреплённых сессий
+func (g *Gateway) Sessions() ([]Session, error) {
+	tunnels, err := g.manager.Registry().List()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, t := range tunnels {
+		names[t.ID] = t.Name
+	}
+
+	res := g.sessions.list()
+	for i := range res {
+		res[i].TunnelName = names[res[i].TunnelID]
+	}
+
+	return res, nil
+}
+
+// Удаление закреплённой сессии
+func (g *Gateway) RemoveSession(token string) bool {
+	return g.sessions.remove(token)
+}
+
+func (g *Gateway) serve() {
+	defer g.wg.Done()
+
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logrus.Debug("Gateway accept error: ", err)
+				continue
+			}
+			return
+		}
+
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			g.handle(conn)
+		}()
+	}
+}
+
+// Обработка соединения клиента
+func (g *Gateway) handle(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	creds, err := socks5Handshake(conn, g.cnf.User != "")
+	if err != nil {
+		logrus.Debug("Gateway handshake failed: ", err)
+		return
+	}
+
+	if creds.Auth {
+		ok := g.authorize(creds)
+		if err := writeAuthStatus(conn, ok); err != nil || !ok {
+			logrus.Debug("Gateway authentication failed for user ", creds.User)
+			return
+		}
+	}
+
+	addr, err := readRequest(conn)
+	if err != nil {
+		logrus.Debug("Gateway request failed: ", err)
+		return
+	}
+
+	upstream, route, err := g.route(addr, creds.User, conn.RemoteAddr())
+	if err != nil {
+		logrus.Debugf("Gateway cannot connect to %s: %s", addr, err)
+		if err == errRejected {
+			_ = writeReply(conn, replyNotAllowed)
+		} else {
+			_ = writeReply(conn, replyHostUnreachable)
+		}
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	if err := writeReply(conn, replySucceeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	logrus.Debugf("Gateway connection to %s through %s", addr, route)
+
+	g.track(conn, route)
+	defer g.untrack(conn)
+
+	pipe(conn, upstream)
+}
+
+// Проверка учётных данных клиента.
+// Если аутентификация включена, вместо имени пользователя шлюза можно передать условия выбора туннеля
+func (g *Gateway) authorize(creds *credentials) bool {
+	if g.cnf.User == "" {
+		return true
+	}
+
+	if creds.User != g.cnf.User && parseSelector(creds.User) == nil {
+		return false
+	}
+
+	return creds.Password == g.cnf.Password
+}
+
+// Соединение с адресом по первому подходящему правилу маршрутизации.
+// Если правило не найдено, туннель выбирается по условиям из имени пользователя.
+// Возвращает соединение и идентификатор туннеля, через который оно установлено, либо directRoute
+func (g *Gateway) route(addr string, user string, source net.Addr) (net.Conn, string, error) {
+	sel := parseSelector(user)
+
+	if rule := g.routes.Match(routeRequest(addr, user, source)); rule != nil {
+		logrus.Debugf("Gateway connection to %s matches rule %s (%s)", addr, rule.ID, rule.Action)
+
+		// закреплённая сессия клиента сохраняется в пределах туннелей правила
+		session := ""
+		if sel != nil {
+			session = sel.Session
+		}
+
+		switch rule.Action {
+		case routing.ActionReject:
+			return nil, "", errRejected
+		case routing.ActionDirect:
+			dialer := &net.Dialer{Timeout: time.Duration(g.cnf.DialTimeout) * time.Second}
+			conn, err := dialer.Dial("tcp", addr)
+			return conn, directRoute, err
+		case routing.ActionTunnel:
+			sel = &selector{Tunnel: rule.Target, Session: session}
+		case routing.ActionTag:
+			sel = &selector{Tag: rule.Target, Session: session}
+		case routing.ActionPool:
+			sel = &selector{Pool: rule.Target, Session: session}
+		}
+	}
+
+	conn, t, err := g.dial(addr, sel)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return conn, t.ID, nil
+}
+
+// Соединение с адресом через один из исправных туннелей, удовлетворяющих условиям выбора.
+// Для закреплённой сессии сначала используется её туннель. При ошибке пробуем следующий туннель
+func (g *Gateway) dial(addr string, sel *selector) (net.Conn, *registry.Tunnel, error) {
+	healthy, err := g.healthy()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	candidates := sel.filter(healthy)
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("No healthy tunnels")
+	}
+
+	var sticky string
+	if sel != nil && sel.Session != "" {
+		sticky, _ = g.sessions.get(sel.Session)
+	}
+
+	forward := &net.Dialer{Timeout: time.Duration(g.cnf.DialTimeout) * time.Second}
+
+	for attempt := 0; attempt < maxDialAttempts && len(candidates) > 0; attempt++ {
+		t := find(candidates, sticky)
+		if t == nil {
+			t = g.balancer.pick(candidates, g.active())
+		}
+		sticky = ""
+
+		dialer, err := vpn.ProxyDialer(t, forward)
+		if err == nil {
+			var conn net.Conn
+			if conn, err = dialer.Dial("tcp", addr); err == nil {
+				if sel != nil && sel.Session != "" {
+					g.sessions.assign(sel.Session, t.ID)
+				}
+				return conn, t, nil
+			}
+		}
+
+		logrus.Debugf("Gateway dial through tunnel %s failed: %s", t.ID, err)
+		candidates = without(candidates, t)
+	}
+
+	return nil, nil, fmt.Errorf("All tunnels failed to connect")
+}
+
+// Соединение с адресом через указанный туннель, независимо от его состояния
+func (g *Gateway) dialTunnel(id string, addr string) (net.Conn, *registry.Tunnel, error) {
+	t, err := g.manager.Registry().Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	forward := &net.Dialer{Timeout: time.Duration(g.cnf.DialTimeout) * time.Second}
+
+	dialer, err := vpn.ProxyDialer(t, forward)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, t, nil
+}
+
+// Список исправных туннелей, кроме выводимых из балансировки. Исправные туннели кэшируются на cacheTTL.
+// Кэш обновляет одно соединение без блокировки, остальные до окончания обновления получают прежний список
+func (g *Gateway) healthy() ([]*registry.Tunnel, error) {
+	g.cacheMu.Lock()
+
+	if time.Since(g.cacheAt) < cacheTTL {
+		cache := g.cache
+		g.cacheMu.Unlock()
+		return g.undrained(cache), nil
+	}
+
+	if done := g.refreshing; done != nil {
+		if !g.cacheAt.IsZero() {
+			cache := g.cache
+			g.cacheMu.Unlock()
+			return g.undrained(cache), nil
+		}
+
+		// прежнего списка нет, ожидается первое обновление
+		g.cacheMu.Unlock()
+		<-done
+
+		g.cacheMu.Lock()
+		cache, cacheAt, err := g.cache, g.cacheAt, g.refreshErr
+		g.cacheMu.Unlock()
+
+		if cacheAt.IsZero() {
+			return nil, err
+		}
+		return g.undrained(cache), nil
+	}
+
+	done := make(chan struct{})
+	g.refreshing = done
+	g.cacheMu.Unlock()
+
+	healthy, err := g.refresh()
+
+	g.cacheMu.Lock()
+	if err == nil {
+		g.cache = healthy
+		g.cacheAt = time.Now()
+	}
+	g.refreshErr = err
+	g.refreshing = nil
+	close(done)
+	g.cacheMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return g.undrained(healthy), nil
+}
+
+// Исправные туннели и запущенные туннели без истории проверок
+func (g *Gateway) refresh() ([]*registry.Tunnel, error) {
+	tunnels, err := g.manager.Registry().List()
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		if t.Healthy() || g.upUnchecked(t) {
+			healthy = append(healthy, t)
+		}
+	}
+
+	return healthy, nil
+}
+
+// Туннель без истории проверок, например при выключенном scheduler, выбирается,
+// если его контейнер запущен и vpn подключён
+func (g *Gateway) upUnchecked(t *registry.Tunnel) bool {
+	if len(t.Health) > 0 || t.DesiredState != registry.StateRunning {
+		return false
+	}
+
+	info, err := g.manager.Info(t)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+
+	return info.State == vpn.StateUp
+}
+
+// Количество активных соединений по туннелям
+func (g *Gateway) active() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := make(map[string]int)
+	for _, id := range g.conns {
+		res[id]++
+	}
+
+	return res
+}
+
+func (g *Gateway) track(conn net.Conn, tunnelID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.conns[conn] = tunnelID
+}
+
+func (g *Gateway) untrack(conn net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.conns, conn)
+}
+
+// Параметры соединения для поиска правила маршрутизации
+func routeRequest(addr string, user string, source net.Addr) *routing.Request {
+	req := &routing.Request{User: user}
+
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		req.Host = host
+		req.Port, _ = strconv.Atoi(port)
+	}
+
+	if tcp, ok := source.(*net.TCPAddr); ok {
+		req.Source = tcp.IP
+	}
+
+	return req
+}
+
+// Копирование данных между соединениями в обе стороны
+func pipe(client net.Conn, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+
+	cp := func(dst net.Conn, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+			_ = src.Close()
+		}
+		done <- struct{}{}
+	}
+
+	go cp(upstream, client)
+	go cp(client, upstream)
+
+	<-done
+	<-done
+}
+
+func find(tunnels []*registry.Tunnel, id string) *registry.Tunnel {
+	if id == "" {
+		return nil
+	}
+
+	for _, t := range tunnels {
+		if t.ID == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func without(tunnels []*registry.Tunnel, t *registry.Tunnel) []*registry.Tunnel {
+	res := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, item := range tunnels {
+		if item.ID != t.ID {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
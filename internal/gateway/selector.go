@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"strings"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+)
+
+// Ключи имени пользователя, по которым выбирается туннель
+const (
+	selectorTunnel  = "tunnel"
+	selectorCountry = "country"
+	selectorTag     = "tag"
+	selectorPool    = "pool"
+	selectorSession = "session"
+)
+
+// Условия выбора туннеля, полученные из имени пользователя socks5.
+// Имя пользователя состоит из пар «ключ-значение», например:
+// tunnel-<имя>, country-jp, tag-<метка>, pool-<пул>, session-<токен>, country-jp-session-<токен>
+type selector struct {
+	Tunnel  string
+	Country string
+	Tag     string
+	Pool    string
+	Session string
+}
+
+// Разбор имени пользователя. Если имя не содержит известных ключей, возвращается nil
+func parseSelector(user string) *selector {
+	parts := strings.Split(user, "-")
+	if len(parts) < 2 || !isSelectorKey(parts[0]) {
+		return nil
+	}
+
+	values := make(map[string][]string)
+	key := ""
+	for _, part := range parts {
+		if isSelectorKey(part) && (key == "" || len(values[key]) > 0) {
+			key = part
+			values[key] = []string{}
+			continue
+		}
+		values[key] = append(values[key], part)
+	}
+
+	sel := &selector{}
+	for key, value := range values {
+		if len(value) == 0 {
+			return nil
+		}
+		joined := strings.Join(value, "-")
+
+		switch key {
+		case selectorTunnel:
+			sel.Tunnel = joined
+		case selectorCountry:
+			sel.Country = strings.ToLower(joined)
+		case selectorTag:
+			sel.Tag = joined
+		case selectorPool:
+			sel.Pool = joined
+		case selectorSession:
+			sel.Session = joined
+		}
+	}
+
+	return sel
+}
+
+func isSelectorKey(s string) bool {
+	switch s {
+	case selectorTunnel, selectorCountry, selectorTag, selectorPool, selectorSession:
+		return true
+	}
+
+	return false
+}
+
+// Проверка, что туннель удовлетворяет условиям выбора
+func (s *selector) match(t *registry.Tunnel) bool {
+	if s == nil {
+		return true
+	}
+
+	if s.Tunnel != "" && t.ID != s.Tunnel && t.Name != s.Tunnel &&
+		t.Name != config.Get().Docker.ServicePrefix+s.Tunnel {
+		return false
+	}
+	if s.Country != "" && t.Country != s.Country {
+		return false
+	}
+	if s.Tag != "" && !t.HasTag(s.Tag) {
+		return false
+	}
+	if s.Pool != "" && t.Pool != s.Pool {
+		return false
+	}
+
+	return true
+}
+
+// Отбор туннелей, удовлетворяющих условиям выбора
+func (s *selector) filter(tunnels []*registry.Tunnel) []*registry.Tunnel {
+	if s == nil {
+		return tunnels
+	}
+
+	res := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		if s.match(t) {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
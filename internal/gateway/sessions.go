@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Закрепление сессии клиента за туннелем
+type Session struct {
+	Token      string    `json:"token"`
+	TunnelID   string    `json:"tunnel_id"`
+	TunnelName string    `json:"tunnel_name,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Таблица закреплённых сессий.
+// Срок действия сессии продлевается при каждом использовании
+type sessions struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	items map[string]*Session
+}
+
+func newSessions(ttl time.Duration) *sessions {
+	return &sessions{
+		ttl:   ttl,
+		items: make(map[string]*Session),
+	}
+}
+
+// Получение туннеля, за которым закреплена сессия
+func (s *sessions) get(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.items[token]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		delete(s.items, token)
+		return "", false
+	}
+
+	session.ExpiresAt = time.Now().Add(s.ttl)
+
+	return session.TunnelID, true
+}
+
+// Закрепление сессии за туннелем
+func (s *sessions) assign(token string, tunnelID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	session, ok := s.items[token]
+	if !ok || now.After(session.ExpiresAt) {
+		session = &Session{Token: token, CreatedAt: now}
+		s.items[token] = session
+	}
+
+	session.TunnelID = tunnelID
+	session.ExpiresAt = now.Add(s.ttl)
+}
+
+// Удаление сессии
+func (s *sessions) remove(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.items[token]
+	delete(s.items, token)
+
+	return ok
+}
+
+// Список действующих сессий, истёкшие удаляются
+func (s *sessions) list() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	res := make([]Session, 0, len(s.items))
+	for token, session := range s.items {
+		if now.After(session.ExpiresAt) {
+			delete(s.items, token)
+			continue
+		}
+		res = append(res, *session)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+
+	return res
+}
@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Константы протокола SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socks5Version = 0x05
+	authVersion   = 0x01
+
+	methodNoAuth       = 0x00
+	methodUserPassword = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	replySucceeded          = 0x00
+	replyGeneralFailure     = 0x01
+	replyNotAllowed         = 0x02
+	replyHostUnreachable    = 0x04
+	replyCommandUnsupported = 0x07
+	replyAddressUnsupported = 0x08
+)
+
+// Учётные данные клиента, переданные при подключении
+type credentials struct {
+	User     string
+	Password string
+	// клиент прошёл согласование по логину и паролю и ожидает ответ на аутентификацию
+	Auth bool
+}
+
+// Согласование метода аутентификации.
+// Если клиент предлагает аутентификацию по логину и паролю, она выбирается всегда,
+// так как имя пользователя может использоваться для выбора туннеля
+func socks5Handshake(conn net.Conn, authRequired bool) (*credentials, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("Unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodUserPassword {
+			method = methodUserPassword
+			break
+		}
+		if m == methodNoAuth && !authRequired {
+			method = methodNoAuth
+		}
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case methodNoAuth:
+		return &credentials{}, nil
+	case methodUserPassword:
+		return readUserPassword(conn)
+	default:
+		return nil, fmt.Errorf("No acceptable authentication method")
+	}
+}
+
+// Чтение логина и пароля (RFC 1929)
+func readUserPassword(conn net.Conn) (*credentials, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != authVersion {
+		return nil, fmt.Errorf("Unsupported auth version %d", header[0])
+	}
+
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return nil, err
+	}
+
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return nil, err
+	}
+
+	password := make([]byte, passLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+
+	return &credentials{User: string(user), Password: string(password), Auth: true}, nil
+}
+
+// Ответ на аутентификацию по логину и паролю
+func writeAuthStatus(conn net.Conn, ok bool) error {
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+
+	_, err := conn.Write([]byte{authVersion, status})
+
+	return err
+}
+
+// Чтение запроса клиента, возвращает адрес назначения в формате host:port
+func readRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("Unsupported socks version %d", header[0])
+	}
+
+	var host string
+
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if header[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = writeReply(conn, replyAddressUnsupported)
+		return "", fmt.Errorf("Unsupported address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	if header[1] != cmdConnect {
+		_ = writeReply(conn, replyCommandUnsupported)
+		return "", fmt.Errorf("Unsupported command %d", header[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Ответ на запрос клиента, в качестве адреса привязки передаётся 0.0.0.0:0
+func writeReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+
+	return err
+}
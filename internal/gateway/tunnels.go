@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"vpntoproxy/internal/registry"
+)
+
+// Период синхронизации http портов туннелей с реестром
+const tunnelSyncInterval = 5 * time.Second
+
+// Http прокси отдельных туннелей, ключ - идентификатор туннеля
+type tunnelServers struct {
+	mu    sync.Mutex
+	items map[string]*http.Server
+}
+
+func newTunnelServers() *tunnelServers {
+	return &tunnelServers{
+		items: make(map[string]*http.Server),
+	}
+}
+
+func (s *tunnelServers) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, srv := range s.items {
+		_ = srv.Close()
+		delete(s.items, id)
+	}
+}
+
+// Периодическое открытие и закрытие http портов туннелей
+func (g *Gateway) syncTunnelServers() {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(tunnelSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.syncTunnels(); err != nil {
+			logrus.Error("Gateway tunnel ports: ", err)
+		}
+
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Открытие http порта для каждого туннеля из реестра, порты удалённых туннелей закрываются
+func (g *Gateway) syncTunnels() error {
+	tunnels, err := g.manager.Registry().List()
+	if err != nil {
+		return err
+	}
+
+	g.tunnels.mu.Lock()
+	defer g.tunnels.mu.Unlock()
+
+	known := make(map[string]bool)
+	used := make(map[int]bool)
+	for _, t := range tunnels {
+		known[t.ID] = true
+		if t.HTTPPort > 0 {
+			used[t.HTTPPort] = true
+		}
+	}
+
+	for id, srv := range g.tunnels.items {
+		if !known[id] {
+			_ = srv.Close()
+			delete(g.tunnels.items, id)
+		}
+	}
+
+	for _, t := range tunnels {
+		if _, ok := g.tunnels.items[t.ID]; ok {
+			continue
+		}
+
+		listener, port, err := g.listenTunnel(t, used)
+		if err != nil {
+			logrus.Errorf("Cannot open http port for tunnel %s: %s", t.ID, err)
+			continue
+		}
+
+		if port != t.HTTPPort {
+			if _, err := g.manager.Registry().Update(t.ID, func(t *registry.Tunnel) error {
+				t.HTTPPort = port
+				return nil
+			}); err != nil {
+				_ = listener.Close()
+				logrus.Error(err)
+				continue
+			}
+			used[port] = true
+		}
+
+		srv := &http.Server{
+			Handler:           newHTTPProxy(g, t.ID),
+			ReadHeaderTimeout: handshakeTimeout,
+		}
+		g.tunnels.items[t.ID] = srv
+
+		logrus.Infof("Tunnel %s http proxy listening on %s", t.ID, listener.Addr())
+
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logrus.Error("Tunnel http proxy: ", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Открытие порта туннеля. Сначала пробуем сохранённый порт, затем первый свободный начиная с tunnel_http_starting_port
+func (g *Gateway) listenTunnel(t *registry.Tunnel, used map[int]bool) (net.Listener, int, error) {
+	if t.HTTPPort > 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(g.cnf.Host, strconv.Itoa(t.HTTPPort)))
+		if err == nil {
+			return listener, t.HTTPPort, nil
+		}
+		logrus.Warnf("Http port %d of tunnel %s is not available: %s", t.HTTPPort, t.ID, err)
+	}
+
+	for port := g.cnf.TunnelHttpStartingPort; port <= 65535; port++ {
+		if used[port] || port == g.cnf.Port || port == g.cnf.HttpPort {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", net.JoinHostPort(g.cnf.Host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+
+		return listener, port, nil
+	}
+
+	return nil, 0, fmt.Errorf("No free http ports")
+}
@@ -0,0 +1,157 @@
+// пакет автоматического восстановления туннелей, не прошедших проверку
+package healing
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/vpn"
+)
+
+// Политика восстановления.
+// После FailureThreshold неудачных проверок подряд туннель сначала перезапускается,
+// затем пересоздаётся из исходной конфигурации с экспоненциально растущей задержкой.
+// После MaxRetries попыток туннель помечается как failed
+type Healer struct {
+	manager *vpn.Manager
+	cnf     *config.Healing
+	history int
+}
+
+// Инициализация политики восстановления
+func New(manager *vpn.Manager) *Healer {
+	conf := config.Get()
+
+	return &Healer{
+		manager: manager,
+		cnf:     conf.Healing,
+		history: conf.Scheduler.HistorySize,
+	}
+}
+
+// Обработка результата проверки туннеля
+func (h *Healer) Observe(t *registry.Tunnel) {
+	health := t.LastHealth()
+	if health == nil || h.manager.Rotating(t.ID) {
+		return
+	}
+
+	if health.State == registry.HealthUp {
+		if t.Healing != nil {
+			h.recovered(t)
+		}
+		return
+	}
+
+	if t.Failures < h.cnf.FailureThreshold {
+		return
+	}
+
+	if t.Healing != nil {
+		if t.Healing.Failed || time.Now().Before(t.Healing.NextAttemptAt) {
+			return
+		}
+	}
+
+	attempt := 0
+	if t.Healing != nil {
+		attempt = t.Healing.Attempts
+	}
+
+	if attempt >= h.cnf.MaxRetries {
+		h.fail(t, attempt)
+		return
+	}
+
+	h.heal(t, attempt)
+}
+
+// Попытка восстановления: первая попытка перезапускает контейнер, последующие пересоздают его
+func (h *Healer) heal(t *registry.Tunnel, attempt int) {
+	action := registry.Action{Type: registry.ActionRestart, Attempt: attempt + 1}
+
+	var err error
+	if attempt == 0 {
+		err = h.manager.Restart(t, 0)
+	} else {
+		action.Type = registry.ActionRecreate
+		_, err = h.manager.Recreate(t)
+	}
+
+	action.Success = err == nil
+	action.At = time.Now()
+	if err != nil {
+		action.Error = err.Error()
+		logrus.Errorf("Tunnel %s (%s): %s attempt %d failed: %s", t.ID, t.Name, action.Type, action.Attempt, err)
+	} else {
+		logrus.Warnf("Tunnel %s (%s): %s attempt %d", t.ID, t.Name, action.Type, action.Attempt)
+	}
+
+	h.update(t, func(t *registry.Tunnel) {
+		t.Healing = &registry.Healing{
+			Attempts:      attempt + 1,
+			NextAttemptAt: time.Now().Add(h.backoff(attempt)),
+		}
+		t.Failures = 0
+		t.AddAction(action, h.history)
+	})
+}
+
+// Туннель не восстановлен после всех попыток
+func (h *Healer) fail(t *registry.Tunnel, attempts int) {
+	logrus.Errorf("Tunnel %s (%s) marked failed after %d recovery attempts", t.ID, t.Name, attempts)
+
+	h.update(t, func(t *registry.Tunnel) {
+		if t.Healing == nil {
+			t.Healing = &registry.Healing{}
+		}
+		t.Healing.Failed = true
+		t.ObservedState = registry.StateFailed
+		t.AddAction(registry.Action{Type: registry.ActionFailed, Attempt: attempts, At: time.Now()}, h.history)
+	})
+}
+
+// Туннель снова прошёл проверку
+func (h *Healer) recovered(t *registry.Tunnel) {
+	logrus.Warnf("Tunnel %s (%s) recovered", t.ID, t.Name)
+
+	h.update(t, func(t *registry.Tunnel) {
+		attempts := 0
+		if t.Healing != nil {
+			attempts = t.Healing.Attempts
+		}
+		t.Healing = nil
+		t.AddAction(registry.Action{
+			Type:    registry.ActionRecovered,
+			Attempt: attempts,
+			Success: true,
+			At:      time.Now(),
+		}, h.history)
+	})
+}
+
+func (h *Healer) update(t *registry.Tunnel, fn func(t *registry.Tunnel)) {
+	_, err := h.manager.Registry().Update(t.ID, func(t *registry.Tunnel) error {
+		fn(t)
+		return nil
+	})
+	if err != nil && err != registry.ErrNotFound {
+		logrus.Error(err)
+	}
+}
+
+// Задержка перед следующей попыткой: BackoffBase * 2^attempt, но не более BackoffMax
+func (h *Healer) backoff(attempt int) time.Duration {
+	delay := time.Duration(h.cnf.BackoffBase) * time.Second
+	limit := time.Duration(h.cnf.BackoffMax) * time.Second
+
+	for i := 0; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if limit > 0 && delay > limit {
+		delay = limit
+	}
+
+	return delay
+}
@@ -0,0 +1,331 @@
+// пакет библиотеки конфигураций vpn, загружаемых через API
+package library
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/ovpn"
+	"vpntoproxy/internal/storage"
+	"vpntoproxy/internal/wireguard"
+)
+
+const (
+	bucket = "configs"
+	// максимальный размер файла конфигурации
+	MaxSize = 1 << 20
+)
+
+// Типы конфигураций, совпадают с типами туннелей
+const (
+	TypeOpenVPN   = "openvpn"
+	TypeWireGuard = "wireguard"
+)
+
+// Расширения файлов конфигураций в каталоге библиотеки
+var extensions = map[string]string{
+	TypeOpenVPN:   ".ovpn",
+	TypeWireGuard: ".conf",
+}
+
+// Ошибка отсутствия конфигурации в библиотеке
+var ErrNotFound = fmt.Errorf("Config not found")
+
+// Допустимое имя конфигурации, используется как имя файла
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Символы, недопустимые в имени конфигурации, и повторяющиеся дефисы
+var (
+	nameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	nameDashes       = regexp.MustCompile(`-{2,}`)
+)
+
+// Сведения о конфигурации vpn
+type Config struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	FileName  string    `json:"file_name,omitempty"`
+	Hash      string    `json:"sha256"`
+	Size      int       `json:"size"`
+	Remote    string    `json:"remote,omitempty"`
+	Protocol  string    `json:"protocol,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Параметры добавления конфигурации
+type Options struct {
+	Name string
+	// тип конфигурации, по умолчанию определяется по содержимому
+	Type     string
+	FileName string
+	Country  string
+	Tags     []string
+	// замена существующей конфигурации с другим содержимым
+	Overwrite bool
+}
+
+type Library struct {
+	mu    sync.Mutex
+	dir   string
+	store *storage.Storage
+}
+
+// Инициализация библиотеки в каталоге dir, каталог создаётся при необходимости
+func New(store *storage.Storage, dir string) (*Library, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &Library{dir: dir, store: store}, nil
+}
+
+// Проверка имени конфигурации
+func ValidName(name string) bool {
+	return namePattern.MatchString(name) && !strings.HasSuffix(name, ".")
+}
+
+// Имя конфигурации из имени загруженного файла
+func NameFromFile(fileName string) string {
+	name := filepath.Base(fileName)
+	for _, ext := range extensions {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return name
+}
+
+// Имя конфигурации из пути файла в архиве: каталоги соединяются дефисом,
+// недопустимые символы заменяются дефисом, jp/Tokyo 01.ovpn становится jp-Tokyo-01.
+// Пустая строка, если допустимое имя получить нельзя
+func NameFromPath(filePath string) string {
+	name := strings.Trim(strings.ReplaceAll(filePath, "\\", "/"), "/")
+	for _, ext := range extensions {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+
+	name = nameInvalidChars.ReplaceAllString(strings.ReplaceAll(name, "/", "-"), "-")
+	name = nameDashes.ReplaceAllString(name, "-")
+	name = strings.TrimLeft(name, "._-")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	name = strings.TrimRight(name, ".-")
+
+	if !ValidName(name) {
+		return ""
+	}
+
+	return name
+}
+
+// Определение типа конфигурации по содержимому
+func DetectType(data []byte) string {
+	if wireguard.Detect(data) {
+		return TypeWireGuard
+	}
+
+	return TypeOpenVPN
+}
+
+// Добавление конфигурации.
+// Повторная загрузка того же содержимого под тем же именем не считается ошибкой
+func (l *Library) Add(opts *Options, data []byte) (*Config, error) {
+	if !ValidName(opts.Name) {
+		return nil, fmt.Errorf("Invalid config name %q", opts.Name)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Config is empty")
+	}
+	if len(data) > MaxSize {
+		return nil, fmt.Errorf("Config is larger than %d bytes", MaxSize)
+	}
+
+	typ := opts.Type
+	if typ == "" {
+		typ = DetectType(data)
+	}
+
+	remote, err := parse(typ, data)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	cfg := &Config{}
+	err = l.store.Get(bucket, opts.Name, cfg)
+	switch {
+	case err == storage.ErrNotFound:
+		cfg = &Config{Name: opts.Name, CreatedAt: now}
+	case err != nil:
+		return nil, err
+	case cfg.Hash == hash && cfg.typ() == typ:
+		return cfg, nil
+	case !opts.Overwrite:
+		return nil, fmt.Errorf("Config %s already exists with different content", opts.Name)
+	}
+
+	// при смене типа меняется расширение файла, старый файл удаляется
+	old := ""
+	if cfg.Hash != "" && cfg.typ() != typ {
+		old = l.Path(cfg)
+	}
+
+	cfg.Type = typ
+	if err := writeFile(l.Path(cfg), data); err != nil {
+		return nil, err
+	}
+	if old != "" {
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			logrus.Error(err)
+		}
+	}
+
+	cfg.FileName = opts.FileName
+	cfg.Hash = hash
+	cfg.Size = len(data)
+	cfg.Remote, cfg.Protocol = "", ""
+	if remote != nil {
+		cfg.Remote = net.JoinHostPort(remote.Host, strconv.Itoa(remote.Port))
+		cfg.Protocol = remote.Proto
+	}
+	cfg.Country = strings.ToLower(opts.Country)
+	cfg.Tags = opts.Tags
+	cfg.UpdatedAt = now
+
+	if err := l.store.Put(bucket, cfg.Name, cfg); err != nil {
+		return nil, err
+	}
+
+	logrus.Debugf("Config %s stored, sha256 %s", cfg.Name, cfg.Hash)
+
+	return cfg, nil
+}
+
+// Получение сведений о конфигурации
+func (l *Library) Get(name string) (*Config, error) {
+	cfg := &Config{}
+	if err := l.store.Get(bucket, name, cfg); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	cfg.Type = cfg.typ()
+
+	return cfg, nil
+}
+
+// Получение списка конфигураций, упорядоченного по имени
+func (l *Library) List() ([]*Config, error) {
+	res := make([]*Config, 0)
+
+	err := l.store.List(bucket, func(key string, data []byte) error {
+		cfg := &Config{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return err
+		}
+		cfg.Type = cfg.typ()
+		res = append(res, cfg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// Удаление конфигурации вместе с файлом
+func (l *Library) Delete(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cfg, err := l.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(l.Path(cfg)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return l.store.Delete(bucket, name)
+}
+
+// Абсолютный путь к файлу конфигурации на хосте, монтируется в контейнер
+func (l *Library) Path(cfg *Config) string {
+	return filepath.Join(l.dir, cfg.Name+extensions[cfg.typ()])
+}
+
+// Тип конфигурации, записи без типа добавлены до поддержки WireGuard
+func (c *Config) typ() string {
+	if c.Type == "" {
+		return TypeOpenVPN
+	}
+
+	return c.Type
+}
+
+// Разбор и проверка конфигурации, возвращает сервер vpn
+func parse(typ string, data []byte) (*ovpn.Remote, error) {
+	switch typ {
+	case TypeOpenVPN:
+		parsed, err := ovpn.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return parsed.Remote(), parsed.Validate()
+	case TypeWireGuard:
+		parsed, err := wireguard.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return parsed.Remote(), parsed.Validate()
+	}
+
+	return nil, fmt.Errorf("Unknown config type %q", typ)
+}
+
+// Запись файла через временный файл, чтобы запущенные туннели не увидели его недописанным
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,35 @@
+package library
+
+import "testing"
+
+func TestNameFromPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "us-nyc-01.ovpn", want: "us-nyc-01"},
+		{path: "jp/01.ovpn", want: "jp-01"},
+		{path: "us/01.ovpn", want: "us-01"},
+		{path: "de/Berlin 02.conf", want: "de-Berlin-02"},
+		{path: "Japan/Tokyo (TCP).OVPN", want: "Japan-Tokyo-TCP"},
+		{path: "a - b.ovpn", want: "a-b"},
+		{path: `win\dir\fr.ovpn`, want: "win-dir-fr"},
+		{path: "/_hidden/.nl.ovpn", want: "hidden-.nl"},
+		{path: "сервер.ovpn", want: ""},
+		{path: "...ovpn", want: ""},
+		{path: "x/0123456789012345678901234567890123456789012345678901234567890123456789.ovpn",
+			want: "x-01234567890123456789012345678901234567890123456789012345678901"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := NameFromPath(tt.path)
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if got != "" && !ValidName(got) {
+				t.Fatalf("%q is not a valid name", got)
+			}
+		})
+	}
+}
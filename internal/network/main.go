@@ -1,53 +1,34 @@
 package network
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/docker/go-connections/nat"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/proxy"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Проверка свободен ли порт
-func CheckFreePort(port int) bool {
-	logrus.Debug(fmt.Sprintf(">>> Starting check port :%d", port))
-
-	portStr := strconv.Itoa(port)
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort("", portStr), time.Second)
+// Проверка свободен ли порт: порт свободен, если его удаётся занять на всех интерфейсах,
+// как это делает Docker при публикации порта контейнера
+func PortAvailable(port int) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
 	if err != nil {
-		logrus.Debug("Connecting error:", err)
-		return true
-	}
-	if conn != nil {
-		defer func() {
-			if err := conn.Close(); err != nil {
-				logrus.Error(err)
-			}
-		}()
-		logrus.Debug("Opened :%d", port)
+		logrus.Debugf("Port :%d is busy: %s", port, err)
 		return false
 	}
-	return false
-}
 
-// Перебирает порты, пока порт не свободен
-func GetFreePort(maxAttempts int, startingPort int) int {
-	logrus.Debug(">>> Starting get free port")
-
-	port := startingPort
-
-	for !CheckFreePort(port) && maxAttempts > 0 {
-		port++
-		maxAttempts--
+	if err := listener.Close(); err != nil {
+		logrus.Error(err)
 	}
 
-	logrus.Debug("Selected free port: ", port)
-	logrus.Debug("<<< Ending get free port")
-
-	return port
+	return true
 }
 
 // Создание объекта «PortSet», для конфигурирования контейнера при создании vpn (vpn.Create)
@@ -68,24 +49,139 @@ func MakePortSet(port int) nat.PortSet {
 	return portSet
 }
 
-func TestSuccessOfRequest(proxyString string, proxyAuth *proxy.Auth, testUrl string) (bool, error) {
-	logrus.Debug(">>> Starting test success of request")
+// Форматы ответа сервиса, возвращающего внешний IP
+const (
+	// json объект, IP в поле Field (например httpbin.org/ip, поле origin)
+	IPFormatJSON = "json"
+	// IP обычным текстом (например api.ipify.org)
+	IPFormatPlain = "plain"
+)
+
+// Поле IP и время ожидания ответа по умолчанию
+const (
+	DefaultIPField   = "origin"
+	DefaultIPTimeout = 15 * time.Second
+)
+
+// Сервис, возвращающий внешний IP клиента.
+// Пустое поле и нулевое время ожидания заменяются значениями по умолчанию
+type IPEcho struct {
+	URL     string
+	Format  string
+	Field   string
+	Timeout time.Duration
+}
+
+// Результат запроса к сервису внешнего IP
+type RequestResult struct {
+	Success    bool
+	StatusCode int
+	IP         string
+	Latency    time.Duration
+}
+
+// Выполнение запроса через socks5 прокси с замером задержки и определением внешнего IP
+func RequestThroughProxy(proxyString string, proxyAuth *proxy.Auth, echo *IPEcho) (*RequestResult, error) {
+	logrus.Debug(">>> Starting request through proxy")
 
-	dialer, err := proxy.SOCKS5("tcp", proxyString, proxyAuth, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", proxyString, proxyAuth, &net.Dialer{Timeout: echo.timeout()})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	httpTransport := &http.Transport{}
-	httpClient := &http.Client{Transport: httpTransport}
-	httpTransport.Dial = dialer.Dial
+	res, err := echo.request(&http.Transport{Dial: dialer.Dial})
+
+	logrus.Debug("<<< Ending request through proxy")
 
-	resp, err := httpClient.Get(testUrl)
+	return res, err
+}
+
+// Определение внешнего IP хоста без прокси
+func DirectIP(echo *IPEcho) (string, error) {
+	res, err := echo.request(&http.Transport{})
 	if err != nil {
-		return false, err
+		return "", err
+	}
+
+	if !res.Success {
+		return "", fmt.Errorf("Unexpected response code %d", res.StatusCode)
 	}
 
-	logrus.Debug("<<< Ending test success of request")
+	return res.IP, nil
+}
+
+func (e *IPEcho) request(transport *http.Transport) (*RequestResult, error) {
+	transport.DisableKeepAlives = true
+	httpClient := &http.Client{Transport: transport, Timeout: e.timeout()}
+
+	start := time.Now()
+
+	resp, err := httpClient.Get(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}()
+
+	res := &RequestResult{
+		Success:    resp.StatusCode == http.StatusOK,
+		StatusCode: resp.StatusCode,
+	}
+
+	if res.Success {
+		if res.IP, err = e.parse(resp.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	res.Latency = time.Since(start)
+
+	return res, nil
+}
+
+// Получение IP из ответа сервиса
+func (e *IPEcho) parse(body io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+
+	var ip string
+
+	switch e.Format {
+	case IPFormatPlain:
+		ip = strings.TrimSpace(string(data))
+	case IPFormatJSON, "":
+		_json := make(map[string]interface{})
+		if err := json.Unmarshal(data, &_json); err != nil {
+			return "", fmt.Errorf("Invalid IP echo response: %s", err)
+		}
+		field := e.Field
+		if field == "" {
+			field = DefaultIPField
+		}
+		ip, _ = _json[field].(string)
+	default:
+		return "", fmt.Errorf("Unknown IP echo format %q", e.Format)
+	}
+
+	// сервис может вернуть цепочку адресов через запятую, первым идёт адрес клиента
+	ip = strings.TrimSpace(strings.Split(ip, ",")[0])
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("IP echo response does not contain IP address")
+	}
+
+	return ip, nil
+}
+
+// Время ожидания ответа, без него зависший сервис блокировал бы проверку навсегда
+func (e *IPEcho) timeout() time.Duration {
+	if e.Timeout <= 0 {
+		return DefaultIPTimeout
+	}
 
-	return resp.StatusCode == 200, nil
+	return e.Timeout
 }
@@ -0,0 +1,232 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Сервис внешнего IP, отвечающий адресом клиента в формате format
+func echoServer(t *testing.T, format, field string, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if format == IPFormatPlain {
+			_, _ = fmt.Fprintf(w, "%s\n", host)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{%q: "%s, 10.0.0.1"}`, field, host)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestDirectIP(t *testing.T) {
+	tests := []struct {
+		name string
+		// формат и поле ответа сервиса
+		served      string
+		servedField string
+		// настройки IPEcho
+		format    string
+		field     string
+		delay     time.Duration
+		timeout   time.Duration
+		want      string
+		wantError bool
+	}{
+		{name: "plain", served: IPFormatPlain, format: IPFormatPlain, want: "127.0.0.1"},
+		{name: "json", served: IPFormatJSON, servedField: "ip", format: IPFormatJSON, field: "ip", want: "127.0.0.1"},
+		{name: "json default field", served: IPFormatJSON, servedField: DefaultIPField, format: IPFormatJSON, want: "127.0.0.1"},
+		{name: "empty format is json", served: IPFormatJSON, servedField: DefaultIPField, want: "127.0.0.1"},
+		{name: "missing field", served: IPFormatJSON, servedField: DefaultIPField, format: IPFormatJSON, field: "ip", wantError: true},
+		{name: "plain response as json", served: IPFormatPlain, format: IPFormatJSON, wantError: true},
+		{name: "unknown format", served: IPFormatJSON, servedField: DefaultIPField, format: "xml", wantError: true},
+		{name: "timeout", served: IPFormatPlain, format: IPFormatPlain, delay: 2 * time.Second,
+			timeout: 100 * time.Millisecond, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := echoServer(t, tt.served, tt.servedField, tt.delay)
+
+			echo := &IPEcho{URL: srv.URL, Format: tt.format, Field: tt.field, Timeout: tt.timeout}
+
+			start := time.Now()
+			ip, err := DirectIP(echo)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("expected error, got IP %s", ip)
+				}
+				if tt.timeout > 0 && time.Since(start) >= tt.delay {
+					t.Fatalf("request was not interrupted by timeout %s", tt.timeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip != tt.want {
+				t.Fatalf("got IP %s, want %s", ip, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectIPUnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	if _, err := DirectIP(&IPEcho{URL: srv.URL}); err == nil {
+		t.Fatal("expected error for status 502")
+	}
+}
+
+// Туннель с утечкой выходит в сеть с адреса хоста, исправный — с другого адреса.
+// vpn.checkProxy считает утечкой совпадение IP через прокси с DirectIP
+func TestRequestThroughProxyLeak(t *testing.T) {
+	srv := echoServer(t, IPFormatPlain, "", 0)
+	echo := &IPEcho{URL: srv.URL, Format: IPFormatPlain, Timeout: 5 * time.Second}
+
+	direct, err := DirectIP(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		local string
+		leak  bool
+	}{
+		{name: "leak", local: "127.0.0.1", leak: true},
+		{name: "vpn exit", local: "127.0.0.2", leak: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := socksServer(t, tt.local)
+
+			res, err := RequestThroughProxy(addr, nil, echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Success {
+				t.Fatalf("unexpected status %d", res.StatusCode)
+			}
+			if res.IP != tt.local {
+				t.Fatalf("got exit IP %s, want %s", res.IP, tt.local)
+			}
+			if leak := res.IP == direct; leak != tt.leak {
+				t.Fatalf("exit IP %s, direct IP %s: leak %v, want %v", res.IP, direct, leak, tt.leak)
+			}
+		})
+	}
+}
+
+// Минимальный socks5 сервер без авторизации, соединения уходят с адреса local
+func socksServer(t *testing.T, local string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}, Timeout: 5 * time.Second}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(conn, dialer)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSocks(conn net.Conn, dialer *net.Dialer) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// приветствие: версия, количество методов, методы
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// запрос: версия, команда, резерв, тип адреса
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	upstream, err := dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+	}()
+	_, _ = io.Copy(conn, upstream)
+}
@@ -0,0 +1,35 @@
+package ovpn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ошибка в конфигурации
+type Issue struct {
+	Line      int    `json:"line,omitempty"`
+	Directive string `json:"directive,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (i Issue) String() string {
+	if i.Line > 0 {
+		return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+	}
+
+	return i.Message
+}
+
+// Ошибка проверки конфигурации со списком найденных ошибок
+type ValidationError struct {
+	Issues []Issue `json:"issues"`
+}
+
+func (e *ValidationError) Error() string {
+	items := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		items = append(items, issue.String())
+	}
+
+	return "Invalid vpn config: " + strings.Join(items, "; ")
+}
@@ -0,0 +1,346 @@
+// пакет разбора и проверки конфигураций OpenVPN
+package ovpn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Значения по умолчанию OpenVPN
+const (
+	DefaultPort  = 1194
+	DefaultProto = "udp"
+)
+
+// Сервер из директивы remote
+type Remote struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Proto string `json:"proto"`
+}
+
+// Разобранная конфигурация OpenVPN
+type Config struct {
+	Remotes []Remote `json:"remotes"`
+	Proto   string   `json:"proto"`
+	Port    int      `json:"port"`
+	Dev     string   `json:"dev,omitempty"`
+	Client  bool     `json:"client"`
+	// сервер требует имя пользователя и пароль
+	AuthUserPass     bool   `json:"auth_user_pass"`
+	AuthUserPassFile string `json:"auth_user_pass_file,omitempty"`
+	// закрытый ключ защищён паролем
+	AskPass bool `json:"askpass"`
+	// встроенные блоки <ca>, <cert>, <key>, <tls-auth> и другие
+	Blocks map[string]string `json:"-"`
+	// директивы с номером первой строки, в которой они встретились
+	directives map[string]int
+	files      map[string]fileRef
+	issues     []Issue
+}
+
+// Ссылка директивы на внешний файл
+type fileRef struct {
+	line int
+	path string
+}
+
+// Директивы, ссылающиеся на файлы, которые должны быть встроены в конфигурацию
+var fileDirectives = []string{"ca", "cert", "key", "tls-auth", "tls-crypt", "tls-crypt-v2", "pkcs12", "extra-certs", "secret", "crl-verify"}
+
+// Директивы, которые нельзя использовать в контейнере
+var unsupported = map[string]string{
+	"up":                    "scripts are not available in the container",
+	"down":                  "scripts are not available in the container",
+	"route-up":              "scripts are not available in the container",
+	"route-pre-down":        "scripts are not available in the container",
+	"ipchange":              "scripts are not available in the container",
+	"tls-verify":            "scripts are not available in the container",
+	"auth-user-pass-verify": "server-side directive",
+	"plugin":                "plugins are not available in the container",
+	"management":            "management interface is not supported",
+	"daemon":                "openvpn must run in the foreground",
+	"log":                   "log must go to the container output",
+	"log-append":            "log must go to the container output",
+	"server":                "server mode is not supported",
+	"mode":                  "server mode is not supported",
+	"dev-node":              "windows-only directive",
+	"ip-win32":              "windows-only directive",
+	"route-method":          "windows-only directive",
+	"register-dns":          "windows-only directive",
+	"block-outside-dns":     "windows-only directive",
+	"win-sys":               "windows-only directive",
+}
+
+// Допустимые протоколы
+var protocols = map[string]bool{
+	"udp": true, "udp4": true, "udp6": true,
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"tcp-client": true, "tcp4-client": true, "tcp6-client": true,
+}
+
+// Чтение и разбор файла конфигурации
+func ParseFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(bytes.NewReader(data))
+}
+
+// Разбор конфигурации. Ошибки синтаксиса и содержимого накапливаются и возвращаются методом Validate
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{
+		Blocks:     make(map[string]string),
+		directives: make(map[string]int),
+		files:      make(map[string]fileRef),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	block, blockLine := "", 0
+	var content strings.Builder
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if block != "" {
+			if strings.EqualFold(text, "</"+block+">") {
+				c.Blocks[block] = content.String()
+				c.directives[block] = blockLine
+				block = ""
+				content.Reset()
+				continue
+			}
+			content.WriteString(text)
+			content.WriteString("\n")
+			continue
+		}
+
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(text, "<") && strings.HasSuffix(text, ">") && !strings.HasPrefix(text, "</") {
+			block = strings.ToLower(strings.Trim(text, "<>"))
+			blockLine = line
+			continue
+		}
+
+		c.directive(line, strings.Fields(text))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if block != "" {
+		c.issue(blockLine, block, "block <%s> is not closed", block)
+	}
+
+	c.resolve()
+
+	return c, nil
+}
+
+// Разбор директивы
+func (c *Config) directive(line int, fields []string) {
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "--"))
+	args := fields[1:]
+
+	if _, ok := c.directives[name]; !ok {
+		c.directives[name] = line
+	}
+
+	if reason, ok := unsupported[name]; ok {
+		c.issue(line, name, "directive %s is not supported: %s", name, reason)
+		return
+	}
+
+	switch name {
+	case "remote":
+		if len(args) == 0 {
+			c.issue(line, name, "remote host is missing")
+			return
+		}
+		remote := Remote{Host: args[0]}
+		if len(args) > 1 {
+			port, err := strconv.Atoi(args[1])
+			if err != nil || port < 1 || port > 65535 {
+				c.issue(line, name, "invalid remote port %q", args[1])
+				return
+			}
+			remote.Port = port
+		}
+		if len(args) > 2 {
+			remote.Proto = strings.ToLower(args[2])
+			if !protocols[remote.Proto] {
+				c.issue(line, name, "unsupported protocol %q", args[2])
+			}
+		}
+		c.Remotes = append(c.Remotes, remote)
+	case "proto":
+		if len(args) == 0 || !protocols[strings.ToLower(args[0])] {
+			c.issue(line, name, "unsupported protocol %q", strings.Join(args, " "))
+			return
+		}
+		c.Proto = strings.ToLower(args[0])
+	case "port", "rport":
+		if len(args) == 0 {
+			c.issue(line, name, "port is missing")
+			return
+		}
+		port, err := strconv.Atoi(args[0])
+		if err != nil || port < 1 || port > 65535 {
+			c.issue(line, name, "invalid port %q", args[0])
+			return
+		}
+		c.Port = port
+	case "dev":
+		if len(args) == 0 {
+			c.issue(line, name, "device is missing")
+			return
+		}
+		c.Dev = args[0]
+		if !strings.HasPrefix(c.Dev, "tun") && !strings.HasPrefix(c.Dev, "tap") {
+			c.issue(line, name, "unsupported device %q, tun or tap expected", c.Dev)
+		}
+	case "client":
+		c.Client = true
+	case "pull", "tls-client":
+		// client равносилен паре pull и tls-client
+		_, pull := c.directives["pull"]
+		_, tls := c.directives["tls-client"]
+		c.Client = c.Client || (pull && tls)
+	case "auth-user-pass":
+		c.AuthUserPass = true
+		if len(args) > 0 {
+			c.AuthUserPassFile = args[0]
+		}
+	case "askpass":
+		c.AskPass = true
+	default:
+		for _, file := range fileDirectives {
+			if name == file && len(args) > 0 && args[0] != "[inline]" {
+				c.files[name] = fileRef{line: line, path: args[0]}
+			}
+		}
+	}
+}
+
+// Заполнение значений по умолчанию для серверов
+func (c *Config) resolve() {
+	if c.Proto == "" {
+		c.Proto = DefaultProto
+	}
+	if c.Port == 0 {
+		c.Port = DefaultPort
+	}
+
+	for i := range c.Remotes {
+		if c.Remotes[i].Port == 0 {
+			c.Remotes[i].Port = c.Port
+		}
+		if c.Remotes[i].Proto == "" {
+			c.Remotes[i].Proto = c.Proto
+		}
+	}
+}
+
+// Первый сервер конфигурации
+func (c *Config) Remote() *Remote {
+	if len(c.Remotes) == 0 {
+		return nil
+	}
+
+	return &c.Remotes[0]
+}
+
+// Проверка наличия встроенного блока или директивы
+func (c *Config) Has(name string) bool {
+	_, ok := c.directives[name]
+	return ok
+}
+
+// Проверка конфигурации перед запуском контейнера
+func (c *Config) Validate() error {
+	issues := append([]Issue(nil), c.issues...)
+
+	add := func(line int, directive string, format string, args ...interface{}) {
+		issues = append(issues, Issue{Line: line, Directive: directive, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.Remotes) == 0 {
+		add(0, "remote", "remote server is missing")
+	}
+
+	if !c.Client {
+		add(0, "client", "client mode is not enabled, add directive client")
+	}
+
+	if c.Dev == "" {
+		add(0, "dev", "device is missing, add directive dev tun")
+	}
+
+	// в контейнер монтируется только файл конфигурации, поэтому все файлы должны быть встроены
+	for _, name := range fileDirectives {
+		if ref, ok := c.files[name]; ok {
+			add(ref.line, name, "external file %q is not available in the container, embed it as <%s> block", ref.path, name)
+		}
+	}
+
+	if _, ok := c.Blocks["ca"]; !ok && c.files["ca"].path == "" {
+		if _, pkcs12 := c.Blocks["pkcs12"]; !pkcs12 {
+			add(0, "ca", "CA certificate is missing, add <ca> block")
+		}
+	}
+
+	_, cert := c.Blocks["cert"]
+	_, key := c.Blocks["key"]
+	if cert != key {
+		add(0, "key", "client certificate and key must be given together")
+	}
+
+	if c.AuthUserPassFile != "" {
+		add(c.directives["auth-user-pass"], "auth-user-pass",
+			"credentials file %q is not available in the container, use auth-user-pass without arguments", c.AuthUserPassFile)
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	// ошибки по строкам идут первыми, затем ошибки конфигурации в целом
+	sort.SliceStable(issues, func(i, j int) bool {
+		li, lj := issues[i].Line, issues[j].Line
+		if li == 0 || lj == 0 {
+			return li > 0 && lj == 0
+		}
+		return li < lj
+	})
+
+	return &ValidationError{Issues: issues}
+}
+
+func (c *Config) issue(line int, directive string, format string, args ...interface{}) {
+	c.issues = append(c.issues, Issue{Line: line, Directive: directive, Message: fmt.Sprintf(format, args...)})
+}
+
+// Разбор и проверка файла конфигурации
+func Check(path string) (*Config, error) {
+	c, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
@@ -0,0 +1,232 @@
+package ovpn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Минимальная рабочая конфигурация клиента
+const validConfig = "client\ndev tun\nremote vpn.example.com\n<ca>\nCA\n</ca>\n"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		remotes []Remote
+		client  bool
+		dev     string
+		auth    bool
+		file    string
+		askPass bool
+		blocks  map[string]string
+	}{
+		{
+			name:    "defaults",
+			data:    validConfig,
+			remotes: []Remote{{Host: "vpn.example.com", Port: DefaultPort, Proto: DefaultProto}},
+			client:  true,
+			dev:     "tun",
+			blocks:  map[string]string{"ca": "CA\n"},
+		},
+		{
+			name: "global proto and port apply to remotes without their own",
+			data: "client\ndev tun0\nproto TCP\nport 443\nremote a.example.com\nremote b.example.com 1195 udp\n" +
+				"remote c.example.com 8443\n",
+			remotes: []Remote{
+				{Host: "a.example.com", Port: 443, Proto: "tcp"},
+				{Host: "b.example.com", Port: 1195, Proto: "udp"},
+				{Host: "c.example.com", Port: 8443, Proto: "tcp"},
+			},
+			client: true,
+			dev:    "tun0",
+		},
+		{
+			name:    "rport and dashes",
+			data:    "--client\n--dev tap\n--rport 1300\n--remote vpn.example.com\n",
+			remotes: []Remote{{Host: "vpn.example.com", Port: 1300, Proto: DefaultProto}},
+			client:  true,
+			dev:     "tap",
+		},
+		{
+			name:   "pull and tls-client mean client",
+			data:   "pull\n# comment\n; comment\n\ntls-client\n",
+			client: true,
+		},
+		{
+			name: "pull alone is not client",
+			data: "pull\n",
+		},
+		{
+			name:    "credentials",
+			data:    "auth-user-pass\naskpass\n",
+			auth:    true,
+			askPass: true,
+		},
+		{
+			name: "credentials file",
+			data: "auth-user-pass /etc/openvpn/pass.txt\n",
+			auth: true,
+			file: "/etc/openvpn/pass.txt",
+		},
+		{
+			name:   "blocks are case insensitive and keep content",
+			data:   "<TLS-Auth>\n  key line 1\nkey line 2\n</tls-auth>\n<cert>\nCERT\n</CERT>\n",
+			blocks: map[string]string{"tls-auth": "key line 1\nkey line 2\n", "cert": "CERT\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(c.Remotes) != 0 || len(tt.remotes) != 0 {
+				if !reflect.DeepEqual(c.Remotes, tt.remotes) {
+					t.Errorf("got remotes %+v, want %+v", c.Remotes, tt.remotes)
+				}
+			}
+			if c.Client != tt.client {
+				t.Errorf("got client %v, want %v", c.Client, tt.client)
+			}
+			if c.Dev != tt.dev {
+				t.Errorf("got dev %q, want %q", c.Dev, tt.dev)
+			}
+			if c.AuthUserPass != tt.auth || c.AuthUserPassFile != tt.file || c.AskPass != tt.askPass {
+				t.Errorf("got auth-user-pass %v %q, askpass %v, want %v %q, %v",
+					c.AuthUserPass, c.AuthUserPassFile, c.AskPass, tt.auth, tt.file, tt.askPass)
+			}
+			if tt.blocks == nil {
+				tt.blocks = map[string]string{}
+			}
+			if !reflect.DeepEqual(c.Blocks, tt.blocks) {
+				t.Errorf("got blocks %q, want %q", c.Blocks, tt.blocks)
+			}
+			if len(c.issues) != 0 {
+				t.Errorf("unexpected issues %v", c.issues)
+			}
+		})
+	}
+}
+
+func TestRemote(t *testing.T) {
+	c, err := Parse(strings.NewReader("dev tun\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Remote(); r != nil {
+		t.Fatalf("got remote %+v for config without remote", r)
+	}
+
+	c, err = Parse(strings.NewReader("remote a.example.com 1195\nremote b.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := c.Remote(); r == nil || r.Host != "a.example.com" || r.Port != 1195 {
+		t.Fatalf("got remote %+v, want a.example.com:1195", r)
+	}
+	if !c.Has("remote") || c.Has("dev") {
+		t.Fatalf("Has reports remote %v and dev %v, want true and false", c.Has("remote"), c.Has("dev"))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// ошибки в порядке вывода
+		want []Issue
+	}{
+		{name: "valid", data: validConfig},
+		{name: "pkcs12 instead of ca", data: "client\ndev tun\nremote vpn.example.com\n<pkcs12>\nP12\n</pkcs12>\n"},
+		{
+			name: "empty config",
+			data: "",
+			want: []Issue{
+				{Directive: "remote", Message: "remote server is missing"},
+				{Directive: "client", Message: "client mode is not enabled, add directive client"},
+				{Directive: "dev", Message: "device is missing, add directive dev tun"},
+				{Directive: "ca", Message: "CA certificate is missing, add <ca> block"},
+			},
+		},
+		{
+			name: "invalid directives",
+			data: validConfig + "remote\nremote b.example.com 70000\nremote c.example.com 1194 sctp\nproto icmp\n" +
+				"port x\ndev wg0\n",
+			want: []Issue{
+				{Line: 7, Directive: "remote", Message: "remote host is missing"},
+				{Line: 8, Directive: "remote", Message: `invalid remote port "70000"`},
+				{Line: 9, Directive: "remote", Message: `unsupported protocol "sctp"`},
+				{Line: 10, Directive: "proto", Message: `unsupported protocol "icmp"`},
+				{Line: 11, Directive: "port", Message: `invalid port "x"`},
+				{Line: 12, Directive: "dev", Message: `unsupported device "wg0", tun or tap expected`},
+			},
+		},
+		{
+			name: "unsupported directives",
+			data: "up /etc/up.sh\n" + validConfig + "daemon\nplugin auth.so\n",
+			want: []Issue{
+				{Line: 1, Directive: "up", Message: "directive up is not supported: scripts are not available in the container"},
+				{Line: 8, Directive: "daemon", Message: "directive daemon is not supported: openvpn must run in the foreground"},
+				{Line: 9, Directive: "plugin", Message: "directive plugin is not supported: plugins are not available in the container"},
+			},
+		},
+		{
+			name: "external files",
+			data: "client\ndev tun\nremote vpn.example.com\nca ca.crt\ncert client.crt\nkey [inline]\n<key>\nKEY\n</key>\n" +
+				"auth-user-pass pass.txt\n",
+			want: []Issue{
+				{Line: 4, Directive: "ca", Message: `external file "ca.crt" is not available in the container, embed it as <ca> block`},
+				{Line: 5, Directive: "cert", Message: `external file "client.crt" is not available in the container, embed it as <cert> block`},
+				{Line: 10, Directive: "auth-user-pass",
+					Message: `credentials file "pass.txt" is not available in the container, use auth-user-pass without arguments`},
+				{Directive: "key", Message: "client certificate and key must be given together"},
+			},
+		},
+		{
+			name: "block is not closed",
+			data: validConfig + "<tls-crypt>\nKEY\n",
+			want: []Issue{
+				{Line: 7, Directive: "tls-crypt", Message: "block <tls-crypt> is not closed"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			verr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("got error %v, want *ValidationError", err)
+			}
+			if !reflect.DeepEqual(verr.Issues, tt.want) {
+				t.Fatalf("got issues\n%+v\nwant\n%+v", verr.Issues, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := &ValidationError{Issues: []Issue{
+		{Line: 3, Directive: "dev", Message: "device is missing"},
+		{Directive: "ca", Message: "CA certificate is missing"},
+	}}
+
+	if want := "Invalid vpn config: line 3: device is missing; CA certificate is missing"; err.Error() != want {
+		t.Fatalf("got %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,254 @@
+// пакет политик плановой смены сервера туннелей
+package policy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/storage"
+)
+
+const bucket = "policies"
+
+// Ожидание закрытия соединений шлюза по умолчанию, секунды
+const DefaultDrainTimeout = 60
+
+// Ошибка отсутствия политики
+var ErrNotFound = fmt.Errorf("Policy not found")
+
+// Политика смены сервера туннеля или всех туннелей с меткой по расписанию
+type Policy struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// туннель или метка туннелей, к которым применяется политика
+	Tunnel string `json:"tunnel,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	// интервал (30m, 2h) или расписание cron из пяти полей
+	Every string `json:"every,omitempty"`
+	Cron  string `json:"cron,omitempty"`
+	// вывод туннеля из балансировки шлюза перед сменой сервера с ожиданием закрытия соединений
+	Drain        bool `json:"drain"`
+	DrainTimeout int  `json:"drain_timeout,omitempty"`
+	Enabled      bool `json:"enabled"`
+	// откуда берётся новая конфигурация
+	Rotate    rotation.Source `json:"rotate"`
+	NextRun   *time.Time      `json:"next_run,omitempty"`
+	LastRun   *Run            `json:"last_run,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Выполнение политики
+type Run struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Results    []Result  `json:"results"`
+}
+
+// Результат смены сервера одного туннеля
+type Result struct {
+	Tunnel    string `json:"tunnel"`
+	Success   bool   `json:"success"`
+	OldExitIP string `json:"old_exit_ip,omitempty"`
+	NewExitIP string `json:"new_exit_ip,omitempty"`
+	// внешний IP изменился, null если прежний IP неизвестен
+	Changed *bool `json:"changed,omitempty"`
+	// соединения шлюза, не закрытые до смены сервера
+	Dropped int    `json:"dropped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Проверка применимости политики к туннелю
+func (p *Policy) Matches(t *registry.Tunnel) bool {
+	if p.Tunnel != "" {
+		return p.Tunnel == t.ID
+	}
+
+	return t.HasTag(p.Tag)
+}
+
+// Время ожидания закрытия соединений шлюза
+func (p *Policy) DrainWait() time.Duration {
+	if p.DrainTimeout <= 0 {
+		return DefaultDrainTimeout * time.Second
+	}
+
+	return time.Duration(p.DrainTimeout) * time.Second
+}
+
+type Store struct {
+	store *storage.Storage
+	mu    sync.Mutex
+}
+
+// Инициализация хранилища политик
+func New(store *storage.Storage) *Store {
+	return &Store{store: store}
+}
+
+// Получение списка политик, упорядоченного по времени создания
+func (s *Store) List() ([]*Policy, error) {
+	res := make([]*Policy, 0)
+
+	err := s.store.List(bucket, func(key string, data []byte) error {
+		p := &Policy{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		res = append(res, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+
+	return res, nil
+}
+
+// Получение политики
+func (s *Store) Get(id string) (*Policy, error) {
+	p := &Policy{}
+	if err := s.store.Get(bucket, id, p); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Добавление политики, время следующего запуска считается от текущего
+func (s *Store) Add(p *Policy) (*Policy, error) {
+	schedule, err := parseSchedule(p.Every, p.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	p.ID = id
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	p.LastRun = nil
+	p.NextRun = nextRun(p, schedule, now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.Put(bucket, p.ID, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Замена параметров политики с сохранением истории запусков.
+// Время следующего запуска пересчитывается при изменении расписания или включении политики
+func (s *Store) Replace(id string, p *Policy) (*Policy, error) {
+	schedule, err := parseSchedule(p.Every, p.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.update(id, func(current *Policy) error {
+		rescheduled := current.Every != p.Every || current.Cron != p.Cron || !current.Enabled
+
+		p.ID = current.ID
+		p.CreatedAt = current.CreatedAt
+		p.LastRun = current.LastRun
+		p.NextRun = current.NextRun
+		if rescheduled || p.NextRun == nil {
+			p.NextRun = nextRun(p, schedule, time.Now())
+		}
+		if !p.Enabled {
+			p.NextRun = nil
+		}
+
+		*current = *p
+		return nil
+	})
+}
+
+// Удаление политики
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Get(id); err != nil {
+		return err
+	}
+
+	return s.store.Delete(bucket, id)
+}
+
+// Запись выполнения политики и времени следующего запуска
+func (s *Store) finish(id string, run *Run) (*Policy, error) {
+	return s.update(id, func(p *Policy) error {
+		schedule, err := parseSchedule(p.Every, p.Cron)
+		if err != nil {
+			return err
+		}
+
+		p.LastRun = run
+		p.NextRun = nextRun(p, schedule, run.FinishedAt)
+		return nil
+	})
+}
+
+// Изменение политики под блокировкой хранилища
+func (s *Store) update(id string, fn func(p *Policy) error) (*Policy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	p.UpdatedAt = time.Now()
+
+	if err := s.store.Put(bucket, p.ID, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Время следующего запуска включённой политики
+func nextRun(p *Policy, schedule schedule, from time.Time) *time.Time {
+	if !p.Enabled {
+		return nil
+	}
+
+	next := schedule.next(from)
+
+	return &next
+}
+
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,233 @@
+package policy
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/vpn"
+)
+
+// Интервал проверки наступления запусков политик
+const pollInterval = 10 * time.Second
+
+// Вывод туннеля из балансировки шлюза на время смены сервера
+type Drainer interface {
+	// ожидание закрытия соединений туннеля не дольше timeout, возвращает количество оставшихся
+	Drain(id string, timeout time.Duration) int
+	Undrain(id string)
+}
+
+// Выполнение политик по расписанию
+type Runner struct {
+	store    *Store
+	manager  *vpn.Manager
+	resolver *rotation.Resolver
+	drainer  Drainer
+
+	// выполняющиеся политики
+	mu      sync.Mutex
+	running map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Инициализация выполнения политик
+func NewRunner(store *Store, manager *vpn.Manager, resolver *rotation.Resolver) *Runner {
+	return &Runner{
+		store:    store,
+		manager:  manager,
+		resolver: resolver,
+		running:  make(map[string]bool),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Подключение шлюза для вывода туннелей из балансировки, вызывается до запуска
+func (r *Runner) SetDrainer(drainer Drainer) {
+	r.drainer = drainer
+}
+
+// Запуск проверки расписания в отдельной горутине
+func (r *Runner) Start() {
+	logrus.Info("Starting rotation policies")
+
+	go r.run()
+}
+
+// Остановка с ожиданием завершения выполняющихся политик
+func (r *Runner) Stop() {
+	close(r.stop)
+	<-r.done
+
+	logrus.Info("Rotation policies stopped")
+}
+
+func (r *Runner) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			policies, err := r.store.List()
+			if err != nil {
+				logrus.Error(err)
+				continue
+			}
+
+			for _, p := range policies {
+				if !p.Enabled || p.NextRun == nil || p.NextRun.After(now) || r.isRunning(p.ID) {
+					continue
+				}
+
+				wg.Add(1)
+				go func(p *Policy) {
+					defer wg.Done()
+
+					if _, err := r.Run(p); err != nil {
+						logrus.Errorf("Policy %s: %s", p.ID, err)
+					}
+				}(p)
+			}
+		}
+	}
+}
+
+// Выполнение политики: смена сервера подходящих туннелей по очереди, чтобы группа не теряла все туннели сразу.
+// Остановленные туннели пропускаются
+func (r *Runner) Run(p *Policy) (*Policy, error) {
+	if !r.begin(p.ID) {
+		return nil, fmt.Errorf("Policy %s is already running", p.ID)
+	}
+	defer r.end(p.ID)
+
+	logrus.Infof("Running rotation policy %s", p.ID)
+
+	run := &Run{StartedAt: time.Now(), Results: make([]Result, 0)}
+
+	tunnels, err := r.manager.Registry().List()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, t := range tunnels {
+		if !p.Matches(t) {
+			continue
+		}
+		found = true
+
+		if t.DesiredState != registry.StateRunning {
+			continue
+		}
+
+		run.Results = append(run.Results, r.rotate(p, t))
+	}
+
+	if !found && p.Tunnel != "" {
+		run.Results = append(run.Results, Result{Tunnel: p.Tunnel, Error: registry.ErrNotFound.Error()})
+	}
+
+	run.FinishedAt = time.Now()
+
+	return r.store.finish(p.ID, run)
+}
+
+// Смена сервера туннеля с выводом из балансировки шлюза на это время
+func (r *Runner) rotate(p *Policy, t *registry.Tunnel) Result {
+	res := Result{Tunnel: t.ID}
+
+	// туннель, сервер которого меняется вручную или пересоздаётся восстановлением, пропускается до вывода из балансировки
+	if r.manager.Rotating(t.ID) {
+		res.Error = (&vpn.RotatingError{ID: t.ID}).Error()
+		return res
+	}
+
+	targets, err := r.resolver.Targets(t, &p.Rotate)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if p.Drain && r.drainer != nil {
+		// туннель возвращается в балансировку при любом исходе смены сервера
+		defer r.drainer.Undrain(t.ID)
+		res.Dropped = r.drainer.Drain(t.ID, p.DrainWait())
+
+		if res.Dropped > 0 {
+			logrus.Warnf("Policy %s: %d gateway connections of tunnel %s are still open", p.ID, res.Dropped, t.ID)
+		}
+	}
+
+	rotated, err := r.manager.Rotate(t, targets)
+	if rotated != nil {
+		res.OldExitIP = rotated.OldExitIP
+		res.NewExitIP = rotated.NewExitIP
+		res.Changed = rotated.Changed
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Success = true
+
+	return res
+}
+
+// Время ближайшей плановой смены сервера туннеля
+func (r *Runner) NextRotation(t *registry.Tunnel) *time.Time {
+	policies, err := r.store.List()
+	if err != nil {
+		logrus.Error(err)
+		return nil
+	}
+
+	var next *time.Time
+	for _, p := range policies {
+		if p.Enabled && p.NextRun != nil && p.Matches(t) && (next == nil || p.NextRun.Before(*next)) {
+			next = p.NextRun
+		}
+	}
+
+	return next
+}
+
+// Отметка начала выполнения политики, false если она уже выполняется
+func (r *Runner) begin(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running[id] {
+		return false
+	}
+	r.running[id] = true
+
+	return true
+}
+
+func (r *Runner) isRunning(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.running[id]
+}
+
+func (r *Runner) end(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.running, id)
+}
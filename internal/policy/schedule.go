@@ -0,0 +1,194 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Минимальный интервал смены сервера
+const minInterval = time.Minute
+
+// Предел поиска следующего запуска по расписанию cron
+const maxCronLookahead = 5 * 366 * 24 * time.Hour
+
+// Расписание запусков политики
+type schedule interface {
+	// время первого запуска после from
+	next(from time.Time) time.Time
+}
+
+// Разбор интервала или расписания cron, задаётся ровно одно из них
+func parseSchedule(every, cron string) (schedule, error) {
+	switch {
+	case every != "" && cron != "":
+		return nil, fmt.Errorf("Only one of every and cron can be set")
+	case every != "":
+		d, err := time.ParseDuration(every)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid interval %q: %s", every, err)
+		}
+		if d < minInterval {
+			return nil, fmt.Errorf("Interval %s is less than %s", d, minInterval)
+		}
+		return interval(d), nil
+	case cron != "":
+		return parseCron(cron)
+	}
+
+	return nil, fmt.Errorf("every or cron is required")
+}
+
+// Запуск через равные промежутки времени
+type interval time.Duration
+
+func (i interval) next(from time.Time) time.Time {
+	return from.Add(time.Duration(i))
+}
+
+// Расписание cron: минуты, часы, дни месяца, месяцы и дни недели (0 или 7 - воскресенье).
+// Поля поддерживают *, списки через запятую, диапазоны a-b и шаг /n
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// день месяца или день недели ограничен: запуск, если совпадает любой из них
+	anyDay bool
+}
+
+// Границы значений полей cron
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Invalid cron %q: expected %d fields", expr, len(cronFields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cron %q: %s: %s", expr, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+
+	// воскресенье записывается как 0 или 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	c := &cronSchedule{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		anyDay:   !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*"),
+	}
+
+	now := time.Now()
+	if !c.next(now).Before(now.Add(maxCronLookahead)) {
+		return nil, fmt.Errorf("Cron %q never fires", expr)
+	}
+
+	return c, nil
+}
+
+// Разбор поля cron в набор битов значений
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+
+		from, to := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[1])
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			from, to = n, n
+			// n/step означает от n до конца диапазона
+			if step > 1 {
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("value out of range %d-%d", min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cronSchedule) next(from time.Time) time.Time {
+	t := from.Truncate(time.Minute).Add(time.Minute)
+	limit := from.Add(maxCronLookahead)
+
+	for t.Before(limit) {
+		switch {
+		case !has(c.months, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(c.hours, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(c.minutes, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	// расписание без подходящих дат, например 30 февраля, отклоняется при разборе
+	return limit
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	day := has(c.days, t.Day())
+	weekday := has(c.weekdays, int(t.Weekday()))
+
+	if c.anyDay {
+		return day || weekday
+	}
+
+	return day && weekday
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		every     string
+		cron      string
+		want      time.Time
+		wantError string
+	}{
+		{name: "interval", every: "1h30m", want: from.Add(90 * time.Minute)},
+		{name: "cron", cron: "0 * * * *", want: from.Add(time.Hour)},
+		{name: "interval too short", every: "30s", wantError: "less than 1m0s"},
+		{name: "invalid interval", every: "hourly", wantError: `Invalid interval "hourly"`},
+		{name: "both", every: "1h", cron: "0 * * * *", wantError: "Only one of every and cron"},
+		{name: "none", wantError: "every or cron is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseSchedule(tt.every, tt.cron)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("got error %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(from); !got.Equal(tt.want) {
+				t.Fatalf("got next run %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 1 января 2026 года - четверг
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		cron string
+		from time.Time
+		want time.Time
+	}{
+		{cron: "* * * * *", from: at(1, 1, 0, 0), want: at(1, 1, 0, 1)},
+		{cron: "* * * * *", from: at(1, 1, 0, 0).Add(59 * time.Second), want: at(1, 1, 0, 1)},
+		{cron: "*/15 * * * *", from: at(1, 1, 0, 7), want: at(1, 1, 0, 15)},
+		{cron: "5/20 * * * *", from: at(1, 1, 0, 30), want: at(1, 1, 0, 45)},
+		{cron: "1,2 * * * *", from: at(1, 1, 0, 2), want: at(1, 1, 1, 1)},
+		{cron: "30 9 * * *", from: at(1, 1, 10, 0), want: at(1, 2, 9, 30)},
+		{cron: "0 8-12/2 * * *", from: at(1, 1, 8, 0), want: at(1, 1, 10, 0)},
+		{cron: "0 0 1 * *", from: at(1, 1, 0, 0), want: at(2, 1, 0, 0)},
+		{cron: "0 0 */10 * *", from: at(1, 1, 0, 0), want: at(1, 11, 0, 0)},
+		{cron: "59 23 31 12 *", from: at(1, 1, 0, 0), want: at(12, 31, 23, 59)},
+		{cron: "0 12 * * 1", from: at(1, 1, 0, 0), want: at(1, 5, 12, 0)},
+		// воскресенье записывается как 0 или 7
+		{cron: "0 12 * * 0", from: at(1, 1, 0, 0), want: at(1, 4, 12, 0)},
+		{cron: "0 12 * * 7", from: at(1, 1, 0, 0), want: at(1, 4, 12, 0)},
+		{cron: "0 0 * * 1-5", from: at(1, 2, 0, 0), want: at(1, 5, 0, 0)},
+		// ограничены и день месяца, и день недели: подходит любой из них
+		{cron: "0 0 13 * 5", from: at(1, 1, 0, 0), want: at(1, 2, 0, 0)},
+		{cron: "0 0 13 * 5", from: at(1, 9, 0, 0), want: at(1, 13, 0, 0)},
+		// день месяца ограничен, день недели нет
+		{cron: "0 0 13 * *", from: at(1, 1, 0, 0), want: at(1, 13, 0, 0)},
+		{cron: "0 0 29 2 *", from: at(1, 1, 0, 0), want: time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cron+" from "+tt.from.Format("01-02 15:04:05"), func(t *testing.T) {
+			c, err := parseCron(tt.cron)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.next(tt.from); !got.Equal(tt.want) {
+				t.Fatalf("got %s, want %s", got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		cron      string
+		wantError string
+	}{
+		{cron: "* * * *", wantError: "expected 5 fields"},
+		{cron: "* * * * * *", wantError: "expected 5 fields"},
+		{cron: "60 * * * *", wantError: "minute: value out of range 0-59"},
+		{cron: "* 24 * * *", wantError: "hour: value out of range 0-23"},
+		{cron: "* * 0 * *", wantError: "day of month: value out of range 1-31"},
+		{cron: "* * * 13 *", wantError: "month: value out of range 1-12"},
+		{cron: "* * * * 8", wantError: "day of week: value out of range 0-7"},
+		{cron: "5-1 * * * *", wantError: "value out of range"},
+		{cron: "*/0 * * * *", wantError: `invalid step "0"`},
+		{cron: "*/x * * * *", wantError: `invalid step "x"`},
+		{cron: "a * * * *", wantError: `invalid value "a"`},
+		{cron: "1-b * * * *", wantError: `invalid value "b"`},
+		{cron: "1,,2 * * * *", wantError: `invalid value ""`},
+		{cron: "0 0 30 2 *", wantError: "never fires"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cron, func(t *testing.T) {
+			_, err := parseCron(tt.cron)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("got error %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/vpn"
+)
+
+// Время, на которое конфигурация заменённого или не созданного туннеля исключается из выбора
+const badConfigTTL = 30 * time.Minute
+
+// Состояние пула по последней сверке
+type Status struct {
+	Total    int `json:"total"`
+	Healthy  int `json:"healthy"`
+	Starting int `json:"starting"`
+	Stopped  int `json:"stopped"`
+	// туннели, сервер которых меняется, не заменяются и не удаляются до окончания смены
+	Rotating int `json:"rotating,omitempty"`
+	// изменения при последней сверке
+	Created  int      `json:"created"`
+	Replaced int      `json:"replaced"`
+	Removed  int      `json:"removed"`
+	Tunnels  []string `json:"tunnels"`
+	// ошибки последней сверки
+	Errors       []string  `json:"errors,omitempty"`
+	ReconciledAt time.Time `json:"reconciled_at"`
+}
+
+// Пул вместе с состоянием
+type Info struct {
+	*Pool
+	Status *Status `json:"status,omitempty"`
+}
+
+// Контроллер пулов, периодически приводит туннели каждого пула к его описанию
+type Controller struct {
+	store       *Store
+	manager     *vpn.Manager
+	resolver    *rotation.Resolver
+	credentials *credentials.Store
+	providers   *provider.Registry
+	cnf         *config.Pools
+
+	// одновременно выполняется одна сверка
+	mu sync.Mutex
+	// исключённые конфигурации по пулам: путь и время окончания исключения
+	bad map[string]map[string]time.Time
+
+	statusMu sync.Mutex
+	status   map[string]*Status
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Инициализация контроллера пулов
+func NewController(store *Store, manager *vpn.Manager, resolver *rotation.Resolver,
+	creds *credentials.Store, providers *provider.Registry) *Controller {
+	return &Controller{
+		store:       store,
+		manager:     manager,
+		resolver:    resolver,
+		credentials: creds,
+		providers:   providers,
+		cnf:         config.Get().Pools,
+		bad:         make(map[string]map[string]time.Time),
+		status:      make(map[string]*Status),
+		trigger:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Запуск сверки пулов в отдельной горутине.
+// Первая сверка ждёт закрытия ready, например применения файла состояния; nil — без ожидания
+func (c *Controller) Start(ready <-chan struct{}) {
+	logrus.Infof("Starting pool controller, interval: %ds", c.cnf.Interval)
+
+	go c.run(ready)
+}
+
+// Остановка с ожиданием завершения текущей сверки
+func (c *Controller) Stop() {
+	close(c.stop)
+	<-c.done
+
+	logrus.Info("Pool controller stopped")
+}
+
+// Внеочередная сверка, например после изменения пула
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) run(ready <-chan struct{}) {
+	defer close(c.done)
+
+	if ready != nil {
+		select {
+		case <-ready:
+		case <-c.stop:
+			return
+		}
+	}
+
+	interval := time.Duration(c.cnf.Interval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.ReconcileAll()
+
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.trigger:
+		}
+	}
+}
+
+// Сверка всех пулов
+func (c *Controller) ReconcileAll() {
+	pools, err := c.store.List()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range pools {
+		st := c.reconcile(p)
+		for _, e := range st.Errors {
+			logrus.Errorf("Pool %s: %s", p.Name, e)
+		}
+
+		c.statusMu.Lock()
+		c.status[p.Name] = st
+		c.statusMu.Unlock()
+	}
+}
+
+// Пул с состоянием последней сверки
+func (c *Controller) Info(p *Pool) *Info {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return &Info{Pool: p, Status: c.status[p.Name]}
+}
+
+// Удаление пула вместе с туннелями или с их отвязкой от пула при keepTunnels
+func (c *Controller) Remove(name string, keepTunnels bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.store.Delete(name); err != nil {
+		return err
+	}
+
+	c.statusMu.Lock()
+	delete(c.status, name)
+	c.statusMu.Unlock()
+	delete(c.bad, name)
+
+	members, err := c.members(name)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]string, 0)
+	for _, t := range members {
+		if keepTunnels {
+			_, err = c.manager.Registry().Update(t.ID, func(t *registry.Tunnel) error {
+				t.Pool = ""
+				return nil
+			})
+		} else {
+			err = c.manager.Delete(t, false)
+		}
+		if err != nil && err != registry.ErrNotFound {
+			errs = append(errs, fmt.Sprintf("%s: %s", t.ID, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Pool %s removed, tunnels failed: %s", name, strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Сверка пула: туннели, не ставшие исправными за pools.startup_grace, заменяются,
+// недостающие создаются из конфигураций, ещё не используемых пулом, лишние удаляются.
+// Остановленные вручную туннели не заменяются, но учитываются в пределах min - max
+func (c *Controller) reconcile(p *Pool) *Status {
+	st := &Status{Tunnels: make([]string, 0), Errors: make([]string, 0), ReconciledAt: time.Now()}
+
+	members, err := c.members(p.Name)
+	if err != nil {
+		st.Errors = append(st.Errors, err.Error())
+		return st
+	}
+
+	grace := time.Duration(c.cnf.StartupGrace) * time.Second
+
+	var healthy, starting, stopped, rotating []*registry.Tunnel
+	for _, t := range members {
+		switch {
+		case t.DesiredState != registry.StateRunning:
+			stopped = append(stopped, t)
+		case c.manager.Rotating(t.ID):
+			rotating = append(rotating, t)
+		case c.healthy(t):
+			healthy = append(healthy, t)
+		case failed(t, grace):
+			logrus.Warnf("Pool %s: replacing unhealthy tunnel %s (%s)", p.Name, t.ID, t.Name)
+			c.exclude(p.Name, t.ConfigPath)
+			if err := c.manager.Delete(t, true); err != nil && err != registry.ErrNotFound {
+				st.Errors = append(st.Errors, fmt.Sprintf("Remove of tunnel %s failed: %s", t.ID, err))
+				starting = append(starting, t)
+				continue
+			}
+			st.Replaced++
+		default:
+			starting = append(starting, t)
+		}
+	}
+
+	active := len(healthy) + len(starting) + len(rotating)
+	if want := shortage(p, active, active+len(stopped)); want > 0 {
+		created := c.create(p, members, want, st)
+		starting = append(starting, created...)
+		st.Created = len(created)
+	}
+
+	// лишние туннели: сначала запускающиеся, затем исправные, начиная с новых
+	active = len(healthy) + len(starting) + len(rotating)
+	if remove := surplus(p, active, active+len(stopped), len(healthy)+len(starting)); remove > 0 {
+		candidates := append(newestFirst(starting), newestFirst(healthy)...)
+		for _, t := range candidates[:remove] {
+			logrus.Infof("Pool %s: removing surplus tunnel %s (%s)", p.Name, t.ID, t.Name)
+			if err := c.manager.Delete(t, false); err != nil && err != registry.ErrNotFound {
+				st.Errors = append(st.Errors, fmt.Sprintf("Remove of tunnel %s failed: %s", t.ID, err))
+				continue
+			}
+			st.Removed++
+			healthy, starting = without(healthy, t), without(starting, t)
+		}
+	}
+
+	st.Healthy = len(healthy)
+	st.Starting = len(starting)
+	st.Stopped = len(stopped)
+	st.Rotating = len(rotating)
+	st.Total = st.Healthy + st.Starting + st.Stopped + st.Rotating
+	for _, list := range [][]*registry.Tunnel{healthy, starting, rotating, stopped} {
+		for _, t := range list {
+			st.Tunnels = append(st.Tunnels, t.ID)
+		}
+	}
+
+	return st
+}
+
+// Количество недостающих туннелей: до size исправных и запускающихся, но не меньше min и не больше max всего.
+// active - туннели, кроме остановленных, total - все туннели пула
+func shortage(p *Pool, active, total int) int {
+	want := p.Size - active
+	if p.Min-total > want {
+		want = p.Min - total
+	}
+	if p.Max-total < want {
+		want = p.Max - total
+	}
+
+	return want
+}
+
+// Количество лишних туннелей: сверх size исправных и запускающихся, но так, чтобы всего осталось
+// не меньше min и не больше max. Удалить можно только removable туннелей
+func surplus(p *Pool, active, total, removable int) int {
+	remove := active - p.Size
+	if total-remove < p.Min {
+		remove = total - p.Min
+	}
+	if total-remove > p.Max {
+		remove = total - p.Max
+	}
+	if remove > removable {
+		remove = removable
+	}
+
+	return remove
+}
+
+// Создание до n туннелей пула из конфигураций, которые пул ещё не использует
+func (c *Controller) create(p *Pool, members []*registry.Tunnel, n int, st *Status) []*registry.Tunnel {
+	inUse := make(map[string]bool)
+	exclude := make(map[string]bool)
+	for _, t := range members {
+		inUse[t.ConfigPath] = true
+		exclude[t.ConfigPath] = true
+	}
+	for path, until := range c.bad[p.Name] {
+		if time.Now().Before(until) {
+			exclude[path] = true
+		} else {
+			delete(c.bad[p.Name], path)
+		}
+	}
+
+	targets, err := c.resolver.Candidates(&p.Source, exclude, n)
+	if err == nil && len(targets) < n {
+		// свежих конфигураций не хватает, повторно пробуются исключённые
+		for _, target := range targets {
+			inUse[target.Path] = true
+		}
+		var retry []*vpn.RotateTarget
+		if retry, err = c.resolver.Candidates(&p.Source, inUse, n-len(targets)); err == nil {
+			targets = append(targets, retry...)
+		}
+	}
+	if err != nil {
+		st.Errors = append(st.Errors, err.Error())
+		return nil
+	}
+	if len(targets) < n {
+		st.Errors = append(st.Errors, fmt.Sprintf("Not enough configs: %d of %d tunnels can be created", len(targets), n))
+	}
+
+	res := make([]*registry.Tunnel, 0, len(targets))
+	for _, target := range targets {
+		opts, err := c.options(p, target)
+		if err == nil {
+			var info *vpn.Info
+			if info, err = c.manager.Create(opts); err == nil {
+				logrus.Infof("Pool %s: tunnel %s (%s) created from %s", p.Name, info.ID, info.Name, target.Source)
+				res = append(res, info.Tunnel)
+				continue
+			}
+		}
+
+		c.exclude(p.Name, target.Path)
+		st.Errors = append(st.Errors, fmt.Sprintf("Create from %s failed: %s", target.Source, err))
+	}
+
+	return res
+}
+
+// Параметры создания туннеля пула. Имя туннеля - имя пула с номером,
+// без набора учётных данных пула используется набор из описания провайдера
+func (c *Controller) options(p *Pool, target *vpn.RotateTarget) (*vpn.Options, error) {
+	opts := &vpn.Options{
+		Type:     target.Type,
+		Path:     target.Path,
+		Name:     p.Name + "-{index}",
+		Country:  target.Country,
+		Tags:     p.Tags,
+		Provider: p.Source.Provider,
+		Pool:     p.Name,
+	}
+	if opts.Country == "" {
+		opts.Country = p.Source.Country
+	}
+
+	name := p.Credentials
+	if name == "" && p.Source.Provider != "" && target.Type != vpn.TypeWireGuard {
+		_, def, err := c.providers.Get(p.Source.Provider)
+		if err != nil {
+			return nil, err
+		}
+		name = def.Credentials
+	}
+
+	if name != "" {
+		set, err := c.credentials.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.Credentials = &set.Credentials
+		opts.CredentialsName = set.Name
+	}
+
+	return opts, nil
+}
+
+// Туннели пула
+func (c *Controller) members(name string) ([]*registry.Tunnel, error) {
+	tunnels, err := c.manager.Registry().List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*registry.Tunnel, 0)
+	for _, t := range tunnels {
+		if t.Pool == name {
+			res = append(res, t)
+		}
+	}
+
+	return res, nil
+}
+
+// Исключение конфигурации из выбора для пула на badConfigTTL
+func (c *Controller) exclude(pool string, path string) {
+	if c.bad[pool] == nil {
+		c.bad[pool] = make(map[string]time.Time)
+	}
+	c.bad[pool][path] = time.Now().Add(badConfigTTL)
+}
+
+// Туннель исправен по последней проверке. Без истории проверок, например при выключенном
+// scheduler, исправным считается запущенный контейнер с подключённым vpn
+func (c *Controller) healthy(t *registry.Tunnel) bool {
+	if len(t.Health) > 0 {
+		return t.Healthy()
+	}
+
+	info, err := c.manager.Info(t)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+
+	return info.State == vpn.StateUp
+}
+
+// Туннель не исправен дольше grace с момента создания или последней успешной проверки,
+// либо его восстановление не удалось
+func failed(t *registry.Tunnel, grace time.Duration) bool {
+	if t.Healing != nil && t.Healing.Failed {
+		return true
+	}
+
+	since := t.CreatedAt
+	for i := len(t.Health) - 1; i >= 0; i-- {
+		if t.Health[i].State == registry.HealthUp {
+			if t.Health[i].CheckedAt.After(since) {
+				since = t.Health[i].CheckedAt
+			}
+			break
+		}
+	}
+
+	return time.Since(since) > grace
+}
+
+func newestFirst(tunnels []*registry.Tunnel) []*registry.Tunnel {
+	res := append([]*registry.Tunnel{}, tunnels...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+
+	return res
+}
+
+func without(tunnels []*registry.Tunnel, t *registry.Tunnel) []*registry.Tunnel {
+	res := make([]*registry.Tunnel, 0, len(tunnels))
+	for _, item := range tunnels {
+		if item.ID != t.ID {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,292 @@
+package pool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/storage"
+	"vpntoproxy/internal/vpn"
+)
+
+// Конфигурация читается из ./configs, поэтому тесты работают во временном каталоге
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "vpntoproxy-pool-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	code := func() int {
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		if err := os.Mkdir(filepath.Join(dir, "configs"), 0755); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if err := os.Chdir(dir); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		cnf := config.Get()
+		cnf.Docker.DryRun = true
+		cnf.Docker.ServicePrefix = "vpn_"
+		cnf.Proxy.StartingPort, cnf.Proxy.EndingPort = 42100, 42199
+
+		return m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+func TestShortage(t *testing.T) {
+	tests := []struct {
+		name           string
+		size, min, max int
+		active, total  int
+		want           int
+	}{
+		{name: "empty pool", size: 3, min: 1, max: 5, want: 3},
+		{name: "full pool", size: 3, min: 1, max: 5, active: 3, total: 3, want: 0},
+		{name: "more than size", size: 3, min: 1, max: 5, active: 4, total: 4, want: -1},
+		{name: "stopped tunnels do not count toward size", size: 3, min: 1, max: 5, active: 1, total: 3, want: 2},
+		{name: "stopped tunnels count toward max", size: 3, min: 1, max: 4, active: 1, total: 3, want: 1},
+		{name: "max reached by stopped tunnels", size: 2, min: 0, max: 2, active: 0, total: 2, want: 0},
+		{name: "min above size", size: 0, min: 0, max: 0, want: 0},
+		{name: "min raises shortage", size: 1, min: 1, max: 3, active: 2, total: 2, want: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pool{Size: tt.size, Min: tt.min, Max: tt.max}
+			if got := shortage(p, tt.active, tt.total); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSurplus(t *testing.T) {
+	tests := []struct {
+		name                     string
+		size, min, max           int
+		active, total, removable int
+		want                     int
+	}{
+		{name: "size reached", size: 3, min: 1, max: 5, active: 3, total: 3, removable: 3, want: 0},
+		{name: "above size", size: 1, min: 0, max: 5, active: 3, total: 3, removable: 3, want: 2},
+		{name: "min is kept", size: 1, min: 2, max: 5, active: 3, total: 3, removable: 3, want: 1},
+		{name: "stopped tunnels count toward min", size: 1, min: 2, max: 5, active: 3, total: 4, removable: 3, want: 2},
+		{name: "stopped tunnels count toward max", size: 3, min: 0, max: 3, active: 3, total: 5, removable: 3, want: 2},
+		{name: "rotating tunnels are not removed", size: 1, min: 0, max: 5, active: 4, total: 4, removable: 1, want: 1},
+		{name: "below size", size: 3, min: 0, max: 5, active: 1, total: 1, removable: 1, want: -2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pool{Size: tt.size, Min: tt.min, Max: tt.max}
+			if got := surplus(p, tt.active, tt.total, tt.removable); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// Контроллер с хранимой в памяти средой выполнения и n конфигурациями OpenVPN в каталоге пула
+func newTestController(t *testing.T, n int) (*Controller, string) {
+	store, err := storage.Open(filepath.Join(t.TempDir(), "vpn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	dir := t.TempDir()
+	for i := 1; i <= n; i++ {
+		data := fmt.Sprintf("client\ndev tun\nremote us%d.example.com 1194\n<ca>\nCA\n</ca>\n", i)
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("us%d.ovpn", i)), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager := vpn.NewManager(docker.NewFake(), registry.New(store))
+
+	return NewController(New(store), manager, rotation.New(nil, nil), nil, nil), dir
+}
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs int
+		// размер пула при первой и второй сверке
+		first, second [3]int
+		// действие над туннелями пула между сверками
+		prepare func(t *testing.T, c *Controller, members []*registry.Tunnel)
+		want    Status
+		// фрагмент ошибки второй сверки
+		wantError string
+	}{
+		{
+			name: "size reached", configs: 3, first: [3]int{2, 1, 3}, second: [3]int{2, 1, 3},
+			want: Status{Total: 2, Healthy: 2},
+		},
+		{
+			name: "scale up", configs: 3, first: [3]int{1, 0, 3}, second: [3]int{3, 0, 3},
+			want: Status{Total: 3, Healthy: 1, Starting: 2, Created: 2},
+		},
+		{
+			name: "scale down", configs: 3, first: [3]int{3, 0, 3}, second: [3]int{1, 0, 3},
+			want: Status{Total: 1, Healthy: 1, Removed: 2},
+		},
+		{
+			name: "stopped tunnel counts toward max", configs: 3, first: [3]int{2, 0, 2}, second: [3]int{2, 0, 2},
+			prepare: func(t *testing.T, c *Controller, members []*registry.Tunnel) {
+				if _, err := c.manager.Stop(members[0], 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: Status{Total: 2, Healthy: 1, Stopped: 1},
+		},
+		{
+			name: "stopped tunnel is replaced below max", configs: 3, first: [3]int{2, 0, 3}, second: [3]int{2, 0, 3},
+			prepare: func(t *testing.T, c *Controller, members []*registry.Tunnel) {
+				if _, err := c.manager.Stop(members[0], 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: Status{Total: 3, Healthy: 1, Starting: 1, Stopped: 1, Created: 1},
+		},
+		{
+			name: "failed tunnel is replaced", configs: 3, first: [3]int{2, 0, 3}, second: [3]int{2, 0, 3},
+			prepare: func(t *testing.T, c *Controller, members []*registry.Tunnel) {
+				if _, err := c.manager.Registry().Update(members[0].ID, func(t *registry.Tunnel) error {
+					t.Health = []registry.Health{{State: registry.HealthVPNDown, CheckedAt: time.Now()}}
+					t.Healing = &registry.Healing{Failed: true}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: Status{Total: 2, Healthy: 1, Starting: 1, Created: 1, Replaced: 1},
+		},
+		{
+			name: "not enough configs", configs: 2, first: [3]int{1, 0, 4}, second: [3]int{4, 0, 4},
+			want:      Status{Total: 2, Healthy: 1, Starting: 1, Created: 1},
+			wantError: "Not enough configs: 1 of 3 tunnels can be created",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := newTestController(t, tt.configs)
+			p := &Pool{Name: "edge", Source: rotation.Source{Dir: dir}}
+
+			p.Size, p.Min, p.Max = tt.first[0], tt.first[1], tt.first[2]
+			if st := c.reconcile(p); len(st.Errors) != 0 {
+				t.Fatalf("first reconcile: %v", st.Errors)
+			}
+
+			members, err := c.members(p.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, c, newestFirst(members))
+			}
+
+			p.Size, p.Min, p.Max = tt.second[0], tt.second[1], tt.second[2]
+			st := c.reconcile(p)
+
+			if tt.wantError == "" && len(st.Errors) != 0 {
+				t.Fatalf("second reconcile: %v", st.Errors)
+			}
+			if tt.wantError != "" && !strings.Contains(strings.Join(st.Errors, "; "), tt.wantError) {
+				t.Fatalf("got errors %v, want %q", st.Errors, tt.wantError)
+			}
+
+			got := Status{Total: st.Total, Healthy: st.Healthy, Starting: st.Starting, Stopped: st.Stopped,
+				Created: st.Created, Replaced: st.Replaced, Removed: st.Removed}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got status %+v, want %+v", got, tt.want)
+			}
+
+			// в реестре остаются ровно туннели из состояния пула
+			members, err = c.members(p.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(members) != len(st.Tunnels) {
+				t.Fatalf("got %d registered pool tunnels, status lists %d", len(members), len(st.Tunnels))
+			}
+		})
+	}
+}
+
+// Замена не берёт конфигурацию неисправного туннеля, при уменьшении пула удаляются самые новые туннели
+func TestReconcileChoice(t *testing.T) {
+	c, dir := newTestController(t, 3)
+	p := &Pool{Name: "edge", Source: rotation.Source{Dir: dir}, Size: 2, Max: 3}
+
+	if st := c.reconcile(p); st.Created != 2 {
+		t.Fatalf("created %d tunnels, want 2: %v", st.Created, st.Errors)
+	}
+	members, err := c.members(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, kept := members[0], members[1]
+
+	if _, err := c.manager.Registry().Update(broken.ID, func(t *registry.Tunnel) error {
+		t.Health = []registry.Health{{State: registry.HealthProxyDown, CheckedAt: time.Now()}}
+		t.Healing = &registry.Healing{Failed: true}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.reconcile(p); st.Replaced != 1 || st.Created != 1 {
+		t.Fatalf("replaced %d and created %d tunnels, want 1 and 1: %v", st.Replaced, st.Created, st.Errors)
+	}
+
+	members, err = c.members(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]bool)
+	for _, m := range members {
+		paths[m.ConfigPath] = true
+	}
+	if paths[broken.ConfigPath] || !paths[kept.ConfigPath] || len(paths) != 2 {
+		t.Fatalf("got configs %v, config %s of the failed tunnel must be replaced", paths, broken.ConfigPath)
+	}
+
+	// время создания берётся из контейнера с точностью до секунды, поэтому задаётся явно
+	if _, err := c.manager.Registry().Update(kept.ID, func(t *registry.Tunnel) error {
+		t.CreatedAt = time.Now().Add(-time.Hour)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Size = 1
+	if st := c.reconcile(p); st.Removed != 1 {
+		t.Fatalf("removed %d tunnels, want 1: %v", st.Removed, st.Errors)
+	}
+	members, err = c.members(p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].ID != kept.ID {
+		t.Fatalf("got tunnels %v, want only the oldest tunnel %s", members, kept.ID)
+	}
+}
@@ -0,0 +1,151 @@
+// пакет пулов туннелей с заданным количеством исправных туннелей
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/storage"
+)
+
+const bucket = "pools"
+
+// Ошибка отсутствия пула
+var ErrNotFound = fmt.Errorf("Pool not found")
+
+// Пул туннелей: контроллер создаёт, заменяет и удаляет туннели из конфигураций источника,
+// пока исправных туннелей не станет size. Общее количество туннелей пула держится в пределах min - max
+type Pool struct {
+	Name string `json:"name"`
+	// откуда берутся конфигурации туннелей: каталог, конфигурации библиотеки или провайдер с фильтром
+	Source rotation.Source `json:"source"`
+	Size   int             `json:"size"`
+	Min    int             `json:"min"`
+	Max    int             `json:"max"`
+	// метки и набор учётных данных туннелей пула
+	Tags        []string  `json:"tags,omitempty"`
+	Credentials string    `json:"credentials,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Проверка границ количества туннелей
+func (p *Pool) Validate() error {
+	if p.Min > p.Size || p.Size > p.Max {
+		return fmt.Errorf("Pool %s: min %d, size %d and max %d must be in ascending order", p.Name, p.Min, p.Size, p.Max)
+	}
+
+	return nil
+}
+
+type Store struct {
+	store *storage.Storage
+	mu    sync.Mutex
+}
+
+// Инициализация хранилища пулов
+func New(store *storage.Storage) *Store {
+	return &Store{store: store}
+}
+
+// Получение списка пулов, упорядоченного по имени
+func (s *Store) List() ([]*Pool, error) {
+	res := make([]*Pool, 0)
+
+	err := s.store.List(bucket, func(key string, data []byte) error {
+		p := &Pool{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return err
+		}
+		res = append(res, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// Получение пула
+func (s *Store) Get(name string) (*Pool, error) {
+	p := &Pool{}
+	if err := s.store.Get(bucket, name, p); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Добавление пула, имя должно быть свободно
+func (s *Store) Add(p *Pool) (*Pool, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Get(p.Name); err == nil {
+		return nil, fmt.Errorf("Pool %s already exists", p.Name)
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	now := time.Now()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+
+	if err := s.store.Put(bucket, p.Name, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Замена параметров пула
+func (s *Store) Replace(name string, p *Pool) (*Pool, error) {
+	p.Name = name
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.CreatedAt = current.CreatedAt
+	p.UpdatedAt = time.Now()
+
+	if err := s.store.Put(bucket, p.Name, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Удаление пула
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Get(name); err != nil {
+		return err
+	}
+
+	return s.store.Delete(bucket, name)
+}
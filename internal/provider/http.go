@@ -0,0 +1,404 @@
+package provider
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Форматы списка серверов http провайдера
+const (
+	// html или текстовый каталог со ссылками на файлы конфигураций
+	FormatIndex = "index"
+	// zip архив с файлами конфигураций
+	FormatZip = "zip"
+	// json массив серверов с полями id, name, country, city, load, type и url
+	FormatJSON = "json"
+)
+
+const (
+	// максимальный размер каталога или архива
+	maxIndexSize = 64 << 20
+	// максимальный размер файла конфигурации
+	maxConfigSize = 1 << 20
+)
+
+// Имя файла по умолчанию начинается с кода страны и, возможно, города: us-nyc-01.ovpn, de_berlin.conf
+var defaultNamePattern = regexp.MustCompile(`(?i)^(?P<country>[a-z]{2})(?:[-_.](?P<city>[a-z]{3,}))?(?:[-_.]|$)`)
+
+// Ссылки на файлы конфигураций в html каталоге, возможно с параметрами запроса
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']?([^"'\s>?#]+\.(?:ovpn|conf)(?:[?#][^"'\s>]*)?)["'\s>]`)
+
+// Провайдер, отдающий конфигурации по http
+type httpProvider struct {
+	def *Definition
+	// схема и хост адреса провайдера, только туда отправляются заголовки провайдера
+	origin  string
+	pattern *regexp.Regexp
+	client  *http.Client
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	servers  []Server
+	archive  *zip.Reader
+	cachedAt time.Time
+}
+
+// Сервер в json списке
+type jsonServer struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	City    string `json:"city"`
+	Load    int    `json:"load"`
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+}
+
+func newHTTP(def *Definition, cnf *config.Providers) (*httpProvider, error) {
+	u, err := url.Parse(def.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid url %q", def.URL)
+	}
+
+	switch def.Format {
+	case "", FormatIndex, FormatZip, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", def.Format)
+	}
+
+	pattern := defaultNamePattern
+	if def.NamePattern != "" {
+		if pattern, err = regexp.Compile(def.NamePattern); err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %s", err)
+		}
+	}
+
+	p := &httpProvider{
+		def:     def,
+		origin:  origin(u),
+		pattern: pattern,
+		ttl:     time.Duration(cnf.CacheTTL) * time.Second,
+	}
+	p.client = &http.Client{
+		Timeout: time.Duration(cnf.Timeout) * time.Second,
+		// при перенаправлении на другой хост заголовки провайдера не передаются
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("Provider %s: stopped after 10 redirects", def.Name)
+			}
+			if !p.ownHost(req.URL) {
+				for key := range def.Headers {
+					req.Header.Del(key)
+				}
+			}
+			return nil
+		},
+	}
+
+	return p, nil
+}
+
+// Получение списка серверов, список кэшируется на providers.cache_ttl
+func (p *httpProvider) Servers() ([]Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.servers != nil && time.Since(p.cachedAt) < p.ttl {
+		return p.servers, nil
+	}
+
+	data, contentType, err := p.get(p.def.URL, maxIndexSize)
+	if err != nil {
+		return nil, err
+	}
+
+	format := p.def.Format
+	if format == "" {
+		format = detectFormat(p.def.URL, contentType, data)
+	}
+
+	var servers []Server
+	p.archive = nil
+
+	switch format {
+	case FormatZip:
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid zip archive of provider %s: %s", p.def.Name, err)
+		}
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") {
+				continue
+			}
+			if server, ok := p.server(file.Name, file.Name); ok {
+				servers = append(servers, server)
+			}
+		}
+		p.archive = archive
+	case FormatJSON:
+		var items []jsonServer
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("Invalid server list of provider %s: %s", p.def.Name, err)
+		}
+		for _, item := range items {
+			if item.URL == "" {
+				continue
+			}
+			server, _ := p.server(item.URL, p.resolve(item.URL))
+			if item.ID != "" {
+				server.ID = item.ID
+			}
+			if item.Name != "" {
+				server.Name = item.Name
+			}
+			if item.Country != "" {
+				server.Country = strings.ToLower(item.Country)
+			}
+			if item.City != "" {
+				server.City = item.City
+			}
+			if item.Type != "" {
+				server.Type = item.Type
+			}
+			if server.ID == "" {
+				server.ID = server.Name
+			}
+			if server.ID == "" {
+				continue
+			}
+			server.Load = item.Load
+			servers = append(servers, server)
+		}
+	default:
+		for _, link := range indexLinks(data) {
+			if server, ok := p.server(link, p.resolve(link)); ok {
+				servers = append(servers, server)
+			}
+		}
+	}
+
+	if servers == nil {
+		servers = make([]Server, 0)
+	}
+
+	p.servers = servers
+	p.cachedAt = time.Now()
+
+	logrus.Debugf("Provider %s: %d servers loaded from %s", p.def.Name, len(servers), format)
+
+	return servers, nil
+}
+
+// Загрузка конфигурации сервера из архива или по ссылке
+func (p *httpProvider) Fetch(server *Server) ([]byte, error) {
+	servers, err := p.Servers()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Server
+	for i := range servers {
+		if servers[i].ID == server.ID {
+			found = &servers[i]
+			break
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("Server %s of provider %s not found", server.ID, p.def.Name)
+	}
+
+	p.mu.Lock()
+	archive := p.archive
+	p.mu.Unlock()
+
+	if archive == nil {
+		data, _, err := p.get(found.source, maxConfigSize)
+		return data, err
+	}
+
+	for _, file := range archive.File {
+		if file.Name != found.source {
+			continue
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = r.Close()
+		}()
+
+		return readLimited(r, maxConfigSize)
+	}
+
+	return nil, fmt.Errorf("File %s not found in archive of provider %s", found.source, p.def.Name)
+}
+
+// Сервер по имени файла конфигурации
+func (p *httpProvider) server(file string, source string) (Server, bool) {
+	name := path.Base(file)
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+
+	server := Server{Type: ConfigOpenVPN, source: source}
+
+	ext := strings.ToLower(path.Ext(name))
+	switch ext {
+	case ".ovpn":
+	case ".conf":
+		server.Type = ConfigWireGuard
+	default:
+		return server, false
+	}
+
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	server.Name = strings.TrimSuffix(name, path.Ext(name))
+	server.ID = server.Name
+	server.Country = strings.ToLower(p.def.Country)
+
+	if m := p.pattern.FindStringSubmatch(server.Name); m != nil {
+		for i, group := range p.pattern.SubexpNames() {
+			switch group {
+			case "country":
+				if m[i] != "" {
+					server.Country = strings.ToLower(m[i])
+				}
+			case "city":
+				server.City = m[i]
+			}
+		}
+	}
+
+	return server, true
+}
+
+// Абсолютный адрес ссылки относительно адреса провайдера
+func (p *httpProvider) resolve(link string) string {
+	base, err := url.Parse(p.def.URL)
+	if err != nil {
+		return link
+	}
+
+	ref, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	return base.ResolveReference(ref).String()
+}
+
+// Адрес на хосте провайдера с той же схемой
+func (p *httpProvider) ownHost(u *url.URL) bool {
+	return origin(u) == p.origin
+}
+
+func origin(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// Запрос с заголовками провайдера, если адрес на хосте провайдера
+func (p *httpProvider) get(addr string, limit int64) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if p.ownHost(req.URL) {
+		for key, value := range p.def.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Provider %s responded with status %d", p.def.Name, resp.StatusCode)
+	}
+
+	data, err := readLimited(resp.Body, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// Чтение не более limit байт, больший ответ считается ошибкой
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("Response is larger than %d bytes", limit)
+	}
+
+	return data, nil
+}
+
+// Определение формата списка серверов по адресу, типу и содержимому ответа
+func detectFormat(addr string, contentType string, data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")),
+		strings.Contains(contentType, "zip"),
+		strings.HasSuffix(strings.ToLower(addr), ".zip"):
+		return FormatZip
+	case strings.Contains(contentType, "json"),
+		bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")):
+		return FormatJSON
+	}
+
+	return FormatIndex
+}
+
+// Ссылки на файлы конфигураций: href в html или строки текстового списка
+func indexLinks(data []byte) []string {
+	seen := make(map[string]bool)
+	links := make([]string, 0)
+
+	add := func(link string) {
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	for _, m := range hrefPattern.FindAllSubmatch(data, -1) {
+		add(string(m[1]))
+	}
+	if len(links) > 0 {
+		return links
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		if strings.HasSuffix(lower, ".ovpn") || strings.HasSuffix(lower, ".conf") {
+			add(line)
+		}
+	}
+
+	return links
+}
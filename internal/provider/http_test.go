@@ -0,0 +1,418 @@
+package provider
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Содержимое файлов конфигураций провайдера
+var fixtureConfigs = map[string]string{
+	"us-nyc-01.ovpn":   "remote us-nyc-01.example.com 1194\n",
+	"de_berlin.conf":   "[Interface]\nPrivateKey = key\n",
+	"fr.ovpn":          "remote fr.example.com 1194\n",
+	"server-east.ovpn": "remote east.example.com 1194\n",
+}
+
+func fixtureZip(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+
+	names := []string{"__MACOSX/us-nyc-01.ovpn", "configs/", "readme.txt"}
+	for name := range fixtureConfigs {
+		names = append(names, "configs/"+name)
+	}
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := fixtureConfigs[strings.TrimPrefix(name, "configs/")]; ok && !strings.HasPrefix(name, "__MACOSX/") {
+			_, _ = f.Write([]byte(data))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// Сервер провайдера: список по адресу /list в формате format, конфигурации по /files/<имя>
+func providerServer(t *testing.T, format string, contentType string, requests *int32) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		switch format {
+		case FormatZip:
+			_, _ = w.Write(fixtureZip(t))
+		case FormatJSON:
+			_, _ = fmt.Fprint(w, `[
+				{"id": "1", "name": "New York", "country": "US", "city": "nyc", "load": 40, "url": "/files/us-nyc-01.ovpn"},
+				{"url": "files/de_berlin.conf", "load": 10},
+				{"id": "3", "country": "FR", "url": "/files/fr.ovpn"},
+				{"id": "no-url"}
+			]`)
+		case "text":
+			_, _ = fmt.Fprint(w, "files/us-nyc-01.ovpn\n/files/de_berlin.conf\n\nfiles/fr.ovpn\nfiles/server-east.ovpn\nreadme.txt\n")
+		default:
+			_, _ = fmt.Fprint(w, `<html><body>
+				<a href="files/us-nyc-01.ovpn">us-nyc-01</a>
+				<a href='/files/de_berlin.conf'>de</a>
+				<a href=files/fr.ovpn>fr</a>
+				<a href="files/fr.ovpn">fr again</a>
+				<a href="files/server-east.ovpn?download=1">east</a>
+				<a href="readme.txt">readme</a>
+			</body></html>`)
+		}
+	})
+
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := fixtureConfigs[strings.TrimPrefix(r.URL.Path, "/files/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprint(w, data)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func newTestProvider(t *testing.T, def *Definition, ttl int) *httpProvider {
+	p, err := newHTTP(def, &config.Providers{CacheTTL: ttl, Timeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestHTTPProviderFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		served      string
+		contentType string
+		format      string
+		country     string
+		want        []Server
+	}{
+		{name: "html index", served: FormatIndex, contentType: "text/html", country: "NL", want: []Server{
+			{ID: "de_berlin", Name: "de_berlin", Country: "de", City: "berlin", Type: ConfigWireGuard},
+			{ID: "fr", Name: "fr", Country: "fr", Type: ConfigOpenVPN},
+			{ID: "server-east", Name: "server-east", Country: "nl", Type: ConfigOpenVPN},
+			{ID: "us-nyc-01", Name: "us-nyc-01", Country: "us", City: "nyc", Type: ConfigOpenVPN},
+		}},
+		{name: "text index", served: "text", contentType: "text/plain", want: []Server{
+			{ID: "de_berlin", Name: "de_berlin", Country: "de", City: "berlin", Type: ConfigWireGuard},
+			{ID: "fr", Name: "fr", Country: "fr", Type: ConfigOpenVPN},
+			{ID: "server-east", Name: "server-east", Type: ConfigOpenVPN},
+			{ID: "us-nyc-01", Name: "us-nyc-01", Country: "us", City: "nyc", Type: ConfigOpenVPN},
+		}},
+		{name: "zip detected by content", served: FormatZip, contentType: "application/octet-stream", want: []Server{
+			{ID: "de_berlin", Name: "de_berlin", Country: "de", City: "berlin", Type: ConfigWireGuard},
+			{ID: "fr", Name: "fr", Country: "fr", Type: ConfigOpenVPN},
+			{ID: "server-east", Name: "server-east", Type: ConfigOpenVPN},
+			{ID: "us-nyc-01", Name: "us-nyc-01", Country: "us", City: "nyc", Type: ConfigOpenVPN},
+		}},
+		{name: "json detected by content", served: FormatJSON, contentType: "text/plain", want: []Server{
+			{ID: "1", Name: "New York", Country: "us", City: "nyc", Load: 40, Type: ConfigOpenVPN},
+			{ID: "3", Name: "fr", Country: "fr", Type: ConfigOpenVPN},
+			{ID: "de_berlin", Name: "de_berlin", Country: "de", City: "berlin", Load: 10, Type: ConfigWireGuard},
+		}},
+		{name: "json configured format", served: FormatJSON, format: FormatJSON, want: []Server{
+			{ID: "1", Name: "New York", Country: "us", City: "nyc", Load: 40, Type: ConfigOpenVPN},
+			{ID: "3", Name: "fr", Country: "fr", Type: ConfigOpenVPN},
+			{ID: "de_berlin", Name: "de_berlin", Country: "de", City: "berlin", Load: 10, Type: ConfigWireGuard},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := providerServer(t, tt.served, tt.contentType, &requests)
+
+			p := newTestProvider(t, &Definition{
+				Name:    "test",
+				URL:     srv.URL + "/list",
+				Format:  tt.format,
+				Country: tt.country,
+				Headers: map[string]string{"Authorization": "Bearer token"},
+			}, 600)
+
+			servers, err := p.Servers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]Server, len(servers))
+			copy(got, servers)
+			sort.Slice(got, func(i, j int) bool { return got[i].ID < got[j].ID })
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d servers %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				source := got[i].source
+				got[i].source = ""
+				if got[i] != tt.want[i] {
+					t.Errorf("server %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+				got[i].source = source
+			}
+
+			// конфигурации загружаются из архива или по ссылке
+			for _, server := range got {
+				data, err := p.Fetch(&server)
+				if err != nil {
+					t.Fatalf("fetch %s: %s", server.ID, err)
+				}
+				file := strings.SplitN(path.Base(server.source), "?", 2)[0]
+				if want := fixtureConfigs[file]; string(data) != want {
+					t.Errorf("fetch %s: got %q, want %q", server.ID, data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPProviderErrors(t *testing.T) {
+	var requests int32
+	srv := providerServer(t, FormatIndex, "", &requests)
+
+	// без заголовка авторизации сервер отвечает 401
+	p := newTestProvider(t, &Definition{Name: "test", URL: srv.URL + "/list"}, 600)
+	if _, err := p.Servers(); err == nil {
+		t.Fatal("expected error for status 401")
+	}
+
+	p = newTestProvider(t, &Definition{
+		Name:    "test",
+		URL:     srv.URL + "/list",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}, 600)
+	if _, err := p.Fetch(&Server{ID: "missing"}); err == nil {
+		t.Fatal("expected error for unknown server")
+	}
+
+	for _, def := range []*Definition{
+		{Name: "bad url", URL: "ftp://example.com/list"},
+		{Name: "bad format", URL: "http://example.com/list", Format: "xml"},
+		{Name: "bad pattern", URL: "http://example.com/list", NamePattern: "("},
+	} {
+		if _, err := newHTTP(def, &config.Providers{}); err == nil {
+			t.Errorf("%s: expected error", def.Name)
+		}
+	}
+}
+
+func TestHTTPProviderCache(t *testing.T) {
+	var requests int32
+	srv := providerServer(t, FormatIndex, "", &requests)
+
+	p := newTestProvider(t, &Definition{
+		Name:    "test",
+		URL:     srv.URL + "/list",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}, 60)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Servers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d list requests within cache ttl, want 1", n)
+	}
+
+	// список устарел
+	p.mu.Lock()
+	p.cachedAt = time.Now().Add(-61 * time.Second)
+	p.mu.Unlock()
+
+	if _, err := p.Servers(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("got %d list requests after cache ttl, want 2", n)
+	}
+
+	// при нулевом ttl список загружается каждый раз
+	p = newTestProvider(t, &Definition{
+		Name:    "test",
+		URL:     srv.URL + "/list",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := p.Servers(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Fatalf("got %d list requests without cache, want 4", n)
+	}
+}
+
+// Заголовки провайдера отправляются только на хост провайдера, но не по ссылкам и перенаправлениям на другие хосты
+func TestHTTPProviderHeadersScope(t *testing.T) {
+	var leaked int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-Api-Key") != "" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		_, _ = fmt.Fprint(w, fixtureConfigs["fr.ovpn"])
+	}))
+	t.Cleanup(other.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `[
+			{"id": "own", "url": "/files/us-nyc-01.ovpn"},
+			{"id": "foreign", "url": "%s/fr.ovpn"},
+			{"id": "redirect", "url": "/redirect/fr.ovpn"}
+		]`, other.URL)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = fmt.Fprint(w, fixtureConfigs[strings.TrimPrefix(r.URL.Path, "/files/")])
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+"/"+strings.TrimPrefix(r.URL.Path, "/redirect/"), http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	p := newTestProvider(t, &Definition{
+		Name:    "test",
+		URL:     srv.URL + "/list",
+		Headers: map[string]string{"Authorization": "Bearer token", "X-Api-Key": "key"},
+	}, 600)
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "own", want: fixtureConfigs["us-nyc-01.ovpn"]},
+		{id: "foreign", want: fixtureConfigs["fr.ovpn"]},
+		{id: "redirect", want: fixtureConfigs["fr.ovpn"]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			data, err := p.Fetch(&Server{ID: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	if n := atomic.LoadInt32(&leaked); n != 0 {
+		t.Fatalf("provider headers sent to another host %d times", n)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		addr        string
+		contentType string
+		data        string
+		want        string
+	}{
+		{"http://example.com/configs.zip", "", "", FormatZip},
+		{"http://example.com/configs", "application/zip", "", FormatZip},
+		{"http://example.com/configs", "application/octet-stream", "PK\x03\x04rest", FormatZip},
+		{"http://example.com/servers", "application/json; charset=utf-8", "{}", FormatJSON},
+		{"http://example.com/servers", "text/plain", "  \n[{\"id\": \"1\"}]", FormatJSON},
+		{"http://example.com/", "text/html", "<html></html>", FormatIndex},
+		{"http://example.com/list.txt", "", "us.ovpn\n", FormatIndex},
+	}
+
+	for _, tt := range tests {
+		if got := detectFormat(tt.addr, tt.contentType, []byte(tt.data)); got != tt.want {
+			t.Errorf("detectFormat(%q, %q, %q) = %s, want %s", tt.addr, tt.contentType, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestServerNamePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		country string
+		file    string
+		want    Server
+		ok      bool
+	}{
+		{file: "us-nyc-01.ovpn", ok: true, want: Server{ID: "us-nyc-01", Country: "us", City: "nyc", Type: ConfigOpenVPN}},
+		{file: "DE_Berlin.conf", ok: true, want: Server{ID: "DE_Berlin", Country: "de", City: "Berlin", Type: ConfigWireGuard}},
+		{file: "fr.ovpn", ok: true, want: Server{ID: "fr", Country: "fr", Type: ConfigOpenVPN}},
+		{file: "gb.lon.ovpn", ok: true, want: Server{ID: "gb.lon", Country: "gb", City: "lon", Type: ConfigOpenVPN}},
+		// двухбуквенный город не считается городом
+		{file: "us-ny-01.ovpn", ok: true, want: Server{ID: "us-ny-01", Country: "us", Type: ConfigOpenVPN}},
+		// три буквы в начале не код страны, берётся страна провайдера
+		{file: "usa-east.ovpn", country: "CA", ok: true, want: Server{ID: "usa-east", Country: "ca", Type: ConfigOpenVPN}},
+		{file: "dir/sub/jp-tokyo.ovpn?token=1", ok: true, want: Server{ID: "jp-tokyo", Country: "jp", City: "tokyo", Type: ConfigOpenVPN}},
+		{file: "de%5Fhamburg.ovpn", ok: true, want: Server{ID: "de_hamburg", Country: "de", City: "hamburg", Type: ConfigOpenVPN}},
+		{file: "readme.txt", ok: false},
+		{pattern: `^node-(?P<city>[a-z]+)-(?P<country>[a-z]{2})$`, file: "node-paris-fr.ovpn", ok: true,
+			want: Server{ID: "node-paris-fr", Country: "fr", City: "paris", Type: ConfigOpenVPN}},
+		{pattern: `^node-(?P<city>[a-z]+)-(?P<country>[a-z]{2})$`, file: "us-nyc.ovpn", country: "NL", ok: true,
+			want: Server{ID: "us-nyc", Country: "nl", Type: ConfigOpenVPN}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			p := newTestProvider(t, &Definition{
+				Name:        "test",
+				URL:         "http://example.com/list",
+				NamePattern: tt.pattern,
+				Country:     tt.country,
+			}, 0)
+
+			server, ok := p.server(tt.file, tt.file)
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+
+			tt.want.Name = tt.want.ID
+			tt.want.source = tt.file
+			if server != tt.want {
+				t.Fatalf("got %+v, want %+v", server, tt.want)
+			}
+		})
+	}
+}
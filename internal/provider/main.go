@@ -0,0 +1,340 @@
+// пакет провайдеров vpn: списки серверов и загрузка их конфигураций
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Типы провайдеров
+const (
+	// каталог файлов конфигураций, zip архив или json список серверов по http
+	TypeHTTP = "http"
+)
+
+// Типы конфигураций серверов, совпадают с типами туннелей
+const (
+	ConfigOpenVPN   = "openvpn"
+	ConfigWireGuard = "wireguard"
+)
+
+// Ошибка отсутствия провайдера
+var ErrNotFound = fmt.Errorf("Provider not found")
+
+// Сервер провайдера
+type Server struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	// загрузка сервера в процентах, 0 если провайдер её не сообщает
+	Load int    `json:"load,omitempty"`
+	Type string `json:"type"`
+	// адрес или имя файла конфигурации
+	source string
+}
+
+// Провайдер vpn
+type Provider interface {
+	// Получение списка доступных серверов
+	Servers() ([]Server, error)
+	// Загрузка конфигурации сервера
+	Fetch(server *Server) ([]byte, error)
+}
+
+// Описание провайдера в файле провайдеров
+type Definition struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// index, zip или json, по умолчанию определяется по ответу
+	Format string `json:"format,omitempty"`
+	// регулярное выражение с группами country и city для разбора имени файла
+	NamePattern string `json:"name_pattern,omitempty"`
+	// страна всех серверов, если каталог содержит серверы одной страны
+	Country string `json:"country,omitempty"`
+	// набор учётных данных, с которым создаются туннели провайдера
+	Credentials string `json:"credentials,omitempty"`
+	// заголовки запросов, например токен доступа, в ответах API не отдаются
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Сведения о провайдере без заголовков запросов
+type Info struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	Format      string `json:"format,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// Условия выбора сервера
+type Filter struct {
+	Country string
+	City    string
+	// идентификатор конкретного сервера
+	Server string
+}
+
+type entry struct {
+	def      *Definition
+	provider Provider
+}
+
+// Провайдеры из файла описаний. Файл перечитывается при изменении
+type Registry struct {
+	cnf *config.Providers
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	modTime time.Time
+}
+
+// Инициализация провайдеров, отсутствующий файл означает пустой список
+func New() (*Registry, error) {
+	r := &Registry{cnf: config.Get().Providers, entries: make(map[string]*entry)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Получение списка провайдеров, упорядоченного по имени
+func (r *Registry) List() ([]*Info, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	res := make([]*Info, 0, len(r.entries))
+	for _, e := range r.entries {
+		res = append(res, e.def.Info())
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// Получение провайдера и его описания
+func (r *Registry) Get(name string) (Provider, *Definition, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		return nil, nil, err
+	}
+
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	return e.provider, e.def, nil
+}
+
+// Получение серверов провайдера, удовлетворяющих условиям
+func (r *Registry) Servers(name string, filter *Filter) ([]Server, error) {
+	p, _, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := p.Servers()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Server, 0, len(servers))
+	for _, s := range servers {
+		if filter.match(&s) {
+			res = append(res, s)
+		}
+	}
+
+	return res, nil
+}
+
+// Выбор наименее загруженного сервера, удовлетворяющего условиям
+func (r *Registry) Pick(name string, filter *Filter) (*Server, error) {
+	servers, err := r.Ranked(name, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &servers[0], nil
+}
+
+// Серверы, удовлетворяющие условиям, от наименее загруженного
+func (r *Registry) Ranked(name string, filter *Filter) ([]Server, error) {
+	servers, err := r.Servers(name, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No servers of provider %s match the request", name)
+	}
+
+	// серверы с неизвестной загрузкой идут после серверов с известной
+	load := func(s *Server) int {
+		if s.Load <= 0 {
+			return 101
+		}
+		return s.Load
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return load(&servers[i]) < load(&servers[j])
+	})
+
+	return servers, nil
+}
+
+// Загрузка конфигурации сервера
+func (r *Registry) Fetch(name string, server *Server) ([]byte, error) {
+	p, _, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Fetch(server)
+}
+
+// Перечитывание файла описаний, если он изменился. Кэш серверов изменённых провайдеров сбрасывается
+func (r *Registry) reload() error {
+	info, err := os.Stat(r.cnf.Path)
+	if os.IsNotExist(err) {
+		r.entries = make(map[string]*entry)
+		r.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.cnf.Path)
+	if err != nil {
+		return err
+	}
+
+	var defs []*Definition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("Invalid providers file %s: %s", r.cnf.Path, err)
+	}
+
+	entries := make(map[string]*entry, len(defs))
+	for _, def := range defs {
+		if _, ok := entries[def.Name]; ok {
+			return fmt.Errorf("Invalid providers file %s: duplicate provider %q", r.cnf.Path, def.Name)
+		}
+
+		// описание не изменилось, список серверов остаётся в кэше
+		if old, ok := r.entries[def.Name]; ok && old.def.equal(def) {
+			entries[def.Name] = old
+			continue
+		}
+
+		p, err := newProvider(def, r.cnf)
+		if err != nil {
+			return fmt.Errorf("Invalid providers file %s: provider %q: %s", r.cnf.Path, def.Name, err)
+		}
+		entries[def.Name] = &entry{def: def, provider: p}
+	}
+
+	r.entries = entries
+	r.modTime = info.ModTime()
+
+	return nil
+}
+
+// Создание провайдера по описанию
+func newProvider(def *Definition, cnf *config.Providers) (Provider, error) {
+	if !namePattern.MatchString(def.Name) {
+		return nil, fmt.Errorf("invalid name")
+	}
+
+	switch def.Type {
+	case TypeHTTP, "":
+		return newHTTP(def, cnf)
+	}
+
+	return nil, fmt.Errorf("unknown type %q", def.Type)
+}
+
+// Допустимое имя провайдера, используется в именах конфигураций
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,31}$`)
+
+// Символы, недопустимые в имени конфигурации библиотеки
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Имя конфигурации сервера в библиотеке
+func ConfigName(provider string, server *Server) string {
+	name := provider + "-" + strings.Trim(unsafeChars.ReplaceAllString(server.ID, "-"), "-.")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return strings.TrimRight(name, ".")
+}
+
+// Сведения о провайдере без заголовков запросов
+func (d *Definition) Info() *Info {
+	typ := d.Type
+	if typ == "" {
+		typ = TypeHTTP
+	}
+
+	return &Info{
+		Name:        d.Name,
+		Type:        typ,
+		URL:         d.URL,
+		Format:      d.Format,
+		Country:     d.Country,
+		Credentials: d.Credentials,
+	}
+}
+
+func (d *Definition) equal(other *Definition) bool {
+	a, _ := json.Marshal(d)
+	b, _ := json.Marshal(other)
+
+	return string(a) == string(b)
+}
+
+func (f *Filter) match(s *Server) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Server != "" && f.Server != s.ID {
+		return false
+	}
+	if f.Country != "" && !strings.EqualFold(f.Country, s.Country) {
+		return false
+	}
+	if f.City != "" && !strings.EqualFold(f.City, s.City) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,298 @@
+// пакет реестра туннелей, хранит сведения о туннелях между перезапусками
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/storage"
+)
+
+const bucket = "tunnels"
+
+// Состояния туннеля
+const (
+	StateRunning = "running"
+	StateStopped = "stopped"
+	StateMissing = "missing"
+	StateFailed  = "failed"
+)
+
+// Ошибка отсутствия туннеля в реестре
+var ErrNotFound = fmt.Errorf("Tunnel not found")
+
+// Результат проверки туннеля
+type Check struct {
+	Success        bool      `json:"success"`
+	Error          string    `json:"error,omitempty"`
+	ExitIP         string    `json:"exit_ip,omitempty"`
+	Latency        int64     `json:"latency_ms,omitempty"`
+	ExpectedRemote string    `json:"expected_remote,omitempty"`
+	CheckedAt      time.Time `json:"checked_at"`
+}
+
+// Состояния здоровья туннеля
+const (
+	HealthUp        = "up"
+	HealthVPNDown   = "vpn_down"
+	HealthProxyDown = "proxy_down"
+)
+
+// Запись истории здоровья туннеля
+type Health struct {
+	State     string    `json:"state"`
+	Latency   int64     `json:"latency_ms"`
+	ExitIP    string    `json:"exit_ip,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Действия по восстановлению туннеля
+const (
+	ActionRestart   = "restart"
+	ActionRecreate  = "recreate"
+	ActionRotate    = "rotate"
+	ActionFailed    = "failed"
+	ActionRecovered = "recovered"
+)
+
+// Запись о действии, выполненном над туннелем
+type Action struct {
+	Type    string    `json:"type"`
+	Attempt int       `json:"attempt,omitempty"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Состояние восстановления туннеля
+type Healing struct {
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	Failed        bool      `json:"failed"`
+}
+
+// Запись о туннеле.
+// ID постоянен, в отличие от идентификатора контейнера, который меняется при пересоздании
+type Tunnel struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Type           string    `json:"type"`
+	ContainerID    string    `json:"container_id"`
+	ConfigPath     string    `json:"config_path"`
+	RemoteHost     string    `json:"remote_host,omitempty"`
+	RemotePort     int       `json:"remote_port,omitempty"`
+	Protocol       string    `json:"protocol,omitempty"`
+	Credentials    string    `json:"credentials,omitempty"`
+	Provider       string    `json:"provider,omitempty"`
+	Pool           string    `json:"pool,omitempty"`
+	HostPort       int       `json:"host_port"`
+	HTTPPort       int       `json:"http_port,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	Tags           []string  `json:"tags,omitempty"`
+	DesiredState   string    `json:"desired_state"`
+	ObservedState  string    `json:"observed_state"`
+	LastVPNCheck   *Check    `json:"last_vpn_check,omitempty"`
+	LastProxyCheck *Check    `json:"last_proxy_check,omitempty"`
+	Health         []Health  `json:"health,omitempty"`
+	Failures       int       `json:"consecutive_failures"`
+	Healing        *Healing  `json:"healing,omitempty"`
+	Actions        []Action  `json:"actions,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type Registry struct {
+	mu    sync.Mutex
+	store *storage.Storage
+}
+
+// Инициализация реестра туннелей
+func New(store *storage.Storage) *Registry {
+	return &Registry{store: store}
+}
+
+// Генерация постоянного идентификатора туннеля
+func NewID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Сохранение туннеля
+func (r *Registry) Save(t *Tunnel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.save(t)
+}
+
+// Изменение туннеля, чтение и запись выполняются атомарно
+func (r *Registry) Update(id string, fn func(t *Tunnel) error) (*Tunnel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, err := r.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+
+	if err := r.save(t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Получение туннеля по идентификатору
+func (r *Registry) Get(id string) (*Tunnel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.get(id)
+}
+
+// Поиск туннеля по идентификатору туннеля или (сокращённому) идентификатору контейнера
+func (r *Registry) Lookup(id string) (*Tunnel, error) {
+	if id == "" {
+		return nil, ErrNotFound
+	}
+
+	if t, err := r.Get(id); err != ErrNotFound {
+		return t, err
+	}
+
+	return r.FindByContainerID(id)
+}
+
+// Поиск туннеля по (сокращённому) идентификатору контейнера
+func (r *Registry) FindByContainerID(id string) (*Tunnel, error) {
+	tunnels, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tunnels {
+		if t.ContainerID != "" && strings.HasPrefix(t.ContainerID, id) {
+			return t, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Получение списка туннелей, упорядоченного по времени создания
+func (r *Registry) List() ([]*Tunnel, error) {
+	tunnels := make([]*Tunnel, 0)
+
+	err := r.store.List(bucket, func(key string, data []byte) error {
+		t := &Tunnel{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return err
+		}
+		tunnels = append(tunnels, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(tunnels, func(i, j int) bool {
+		return tunnels[i].CreatedAt.Before(tunnels[j].CreatedAt)
+	})
+
+	return tunnels, nil
+}
+
+// Удаление туннеля из реестра
+func (r *Registry) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.store.Delete(bucket, id)
+}
+
+// Последняя запись истории здоровья
+func (t *Tunnel) LastHealth() *Health {
+	if len(t.Health) == 0 {
+		return nil
+	}
+
+	return &t.Health[len(t.Health)-1]
+}
+
+// Добавление записи в историю здоровья с ограничением её длины
+func (t *Tunnel) AddHealth(h Health, size int) {
+	t.Health = append(t.Health, h)
+	if size > 0 && len(t.Health) > size {
+		t.Health = append([]Health(nil), t.Health[len(t.Health)-size:]...)
+	}
+}
+
+// Проверка наличия метки у туннеля
+func (t *Tunnel) HasTag(tag string) bool {
+	for _, item := range t.Tags {
+		if strings.EqualFold(item, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Туннель должен быть запущен и последняя проверка прошла успешно
+func (t *Tunnel) Healthy() bool {
+	if t.DesiredState != StateRunning || (t.Healing != nil && t.Healing.Failed) {
+		return false
+	}
+
+	health := t.LastHealth()
+
+	return health != nil && health.State == HealthUp
+}
+
+// Добавление записи в журнал действий с ограничением его длины
+func (t *Tunnel) AddAction(a Action, size int) {
+	t.Actions = append(t.Actions, a)
+	if size > 0 && len(t.Actions) > size {
+		t.Actions = append([]Action(nil), t.Actions[len(t.Actions)-size:]...)
+	}
+}
+
+func (r *Registry) get(id string) (*Tunnel, error) {
+	t := &Tunnel{}
+	if err := r.store.Get(bucket, id, t); err != nil {
+		if err == storage.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (r *Registry) save(t *Tunnel) error {
+	if t.ID == "" {
+		return fmt.Errorf("Tunnel ID is empty")
+	}
+
+	now := time.Now()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = now
+	}
+	t.UpdatedAt = now
+
+	return r.store.Put(bucket, t.ID, t)
+}
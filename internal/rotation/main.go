@@ -0,0 +1,179 @@
+// пакет выбора конфигураций, на которые переключается туннель при смене сервера
+package rotation
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/vpn"
+)
+
+// Количество пробуемых конфигураций по умолчанию
+const DefaultAttempts = 3
+
+// Источники новой конфигурации туннеля
+type Source struct {
+	// имена конфигураций из библиотеки
+	Configs []string `json:"configs,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+	// каталог или шаблон путей конфигураций
+	Dir string `json:"dir,omitempty"`
+	// метка конфигураций библиотеки
+	Tag string `json:"tag,omitempty"`
+	// провайдер, по умолчанию провайдер, у которого создан туннель
+	Provider string `json:"provider,omitempty"`
+	// страна и город сервера провайдера, по умолчанию страна туннеля
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	// количество пробуемых конфигураций, по умолчанию DefaultAttempts
+	Attempts int `json:"attempts,omitempty"`
+}
+
+type Resolver struct {
+	library   *library.Library
+	providers *provider.Registry
+}
+
+// Инициализация выбора конфигураций
+func New(lib *library.Library, providers *provider.Registry) *Resolver {
+	return &Resolver{library: lib, providers: providers}
+}
+
+// Конфигурации, на которые может переключиться туннель, кроме текущей.
+// Без источников используется провайдер, у которого создан туннель, страна по умолчанию берётся у туннеля
+func (r *Resolver) Targets(t *registry.Tunnel, src *Source) ([]*vpn.RotateTarget, error) {
+	effective := *src
+	if effective.Provider == "" && len(effective.Configs) == 0 && len(effective.Paths) == 0 &&
+		effective.Dir == "" && effective.Tag == "" {
+		if t.Provider == "" {
+			return nil, fmt.Errorf("configs, paths, dir, tag or provider is required: tunnel %s was not created from a provider", t.ID)
+		}
+		effective.Provider = t.Provider
+	}
+	if effective.Country == "" {
+		effective.Country = t.Country
+	}
+
+	limit := src.Attempts
+	if limit == 0 {
+		limit = DefaultAttempts
+	}
+
+	targets, err := r.Candidates(&effective, map[string]bool{t.ConfigPath: true}, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No other configs to rotate tunnel %s to", t.ID)
+	}
+
+	// путь без известного расширения считается конфигурацией того же типа
+	for _, target := range targets {
+		if target.Type == "" {
+			target.Type = t.Type
+		}
+	}
+
+	return targets, nil
+}
+
+// Не более limit конфигураций из источников, кроме путей из exclude, в который добавляются выбранные.
+// Берутся по порядку из configs, paths, каталога dir, конфигураций библиотеки с меткой tag
+// и серверов провайдера по возрастанию нагрузки
+func (r *Resolver) Candidates(src *Source, exclude map[string]bool, limit int) ([]*vpn.RotateTarget, error) {
+	targets := make([]*vpn.RotateTarget, 0, limit)
+	add := func(target *vpn.RotateTarget) {
+		if len(targets) < limit && !exclude[target.Path] {
+			exclude[target.Path] = true
+			targets = append(targets, target)
+		}
+	}
+	fromConfig := func(cfg *library.Config) *vpn.RotateTarget {
+		return &vpn.RotateTarget{Source: cfg.Name, Type: cfg.Type, Path: r.library.Path(cfg), Country: cfg.Country}
+	}
+
+	for _, name := range src.Configs {
+		cfg, err := r.library.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("Config %s: %s", name, err)
+		}
+		add(fromConfig(cfg))
+	}
+
+	for _, path := range src.Paths {
+		add(&vpn.RotateTarget{Source: path, Type: vpn.TypeByExtension(path), Path: path})
+	}
+
+	if src.Dir != "" {
+		paths, err := vpn.GlobConfigs(src.Dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if typ := vpn.TypeByExtension(path); typ != "" {
+				add(&vpn.RotateTarget{Source: path, Type: typ, Path: path, Country: src.Country})
+			}
+		}
+	}
+
+	if src.Tag != "" {
+		configs, err := r.library.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, cfg := range configs {
+			for _, tag := range cfg.Tags {
+				if tag == src.Tag {
+					add(fromConfig(cfg))
+					break
+				}
+			}
+		}
+	}
+
+	if src.Provider != "" && len(targets) < limit {
+		servers, err := r.providers.Ranked(src.Provider, &provider.Filter{Country: src.Country, City: src.City})
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range servers {
+			if len(targets) >= limit {
+				break
+			}
+			// конфигурация уже выбранного сервера не загружается повторно
+			if exclude[r.library.Path(&library.Config{Name: provider.ConfigName(src.Provider, &servers[i]), Type: servers[i].Type})] {
+				continue
+			}
+
+			cfg, err := r.ServerConfig(src.Provider, &servers[i])
+			if err != nil {
+				logrus.Errorf("Provider %s: fetch of server %s failed: %s", src.Provider, servers[i].ID, err)
+				continue
+			}
+			add(fromConfig(cfg))
+		}
+	}
+
+	return targets, nil
+}
+
+// Загрузка конфигурации сервера провайдера в библиотеку
+func (r *Resolver) ServerConfig(name string, server *provider.Server) (*library.Config, error) {
+	data, err := r.providers.Fetch(name, server)
+	if err != nil {
+		return nil, err
+	}
+
+	// конфигурация сервера заменяется, если провайдер её обновил
+	return r.library.Add(&library.Options{
+		Name:      provider.ConfigName(name, server),
+		Type:      server.Type,
+		FileName:  server.Name,
+		Country:   server.Country,
+		Tags:      []string{name},
+		Overwrite: true,
+	}, data)
+}
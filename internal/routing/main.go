@@ -0,0 +1,377 @@
+// пакет правил маршрутизации соединений шлюза по туннелям
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Ошибка отсутствия правила
+var ErrNotFound = fmt.Errorf("Rule not found")
+
+// Упорядоченный список правил маршрутизации.
+// Правила хранятся в файле и перечитываются при его изменении, не затрагивая установленные соединения
+type Engine struct {
+	cnf *config.Routing
+
+	// последовательность изменений списка
+	writeMu sync.Mutex
+
+	mu      sync.RWMutex
+	rules   []*compiled
+	modTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Инициализация правил из файла, отсутствующий файл означает пустой список
+func New() (*Engine, error) {
+	e := &Engine{
+		cnf:  config.Get().Routing,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Запуск отслеживания изменений файла правил
+func (e *Engine) Start() {
+	go e.watch()
+}
+
+// Остановка отслеживания изменений файла правил
+func (e *Engine) Stop() {
+	close(e.stop)
+	<-e.done
+}
+
+// Получение списка правил в порядке проверки
+func (e *Engine) List() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	res := make([]Rule, 0, len(e.rules))
+	for _, c := range e.rules {
+		res = append(res, c.Rule)
+	}
+
+	return res
+}
+
+// Получение правила по идентификатору
+func (e *Engine) Get(id string) (*Rule, error) {
+	for _, rule := range e.List() {
+		if rule.ID == id {
+			return &rule, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Замена всего списка правил
+func (e *Engine) Replace(rules []Rule) ([]Rule, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	for i := range rules {
+		if rules[i].ID == "" {
+			id, err := newID()
+			if err != nil {
+				return nil, err
+			}
+			rules[i].ID = id
+		}
+	}
+
+	if err := e.save(rules); err != nil {
+		return nil, err
+	}
+
+	return e.List(), nil
+}
+
+// Добавление правила на указанную позицию, при отрицательной или слишком большой позиции - в конец списка
+func (e *Engine) Add(rule Rule, position int) (*Rule, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = id
+
+	rules := e.List()
+	if position < 0 || position > len(rules) {
+		position = len(rules)
+	}
+
+	rules = append(rules, Rule{})
+	copy(rules[position+1:], rules[position:])
+	rules[position] = rule
+
+	if err := e.save(rules); err != nil {
+		return nil, err
+	}
+
+	return e.Get(id)
+}
+
+// Изменение правила с сохранением его позиции
+func (e *Engine) Update(id string, rule Rule) (*Rule, error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	rules := e.List()
+	for i := range rules {
+		if rules[i].ID != id {
+			continue
+		}
+
+		rule.ID = id
+		rules[i] = rule
+
+		if err := e.save(rules); err != nil {
+			return nil, err
+		}
+
+		return e.Get(id)
+	}
+
+	return nil, ErrNotFound
+}
+
+// Удаление правила
+func (e *Engine) Delete(id string) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	rules := e.List()
+	for i := range rules {
+		if rules[i].ID == id {
+			return e.save(append(rules[:i], rules[i+1:]...))
+		}
+	}
+
+	return ErrNotFound
+}
+
+// Поиск первого правила, подходящего для соединения. Если подходящих правил нет, возвращается nil
+func (e *Engine) Match(req *Request) *Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, c := range e.rules {
+		if c.match(req) {
+			rule := c.Rule
+			return &rule
+		}
+	}
+
+	return nil
+}
+
+// Периодическая проверка времени изменения файла правил
+func (e *Engine) watch() {
+	defer close(e.done)
+
+	interval := time.Duration(e.cnf.ReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.reload()
+		}
+	}
+}
+
+// Перечитывание файла правил, если он изменился.
+// При ошибке в файле продолжают действовать прежние правила
+func (e *Engine) reload() {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	info, err := os.Stat(e.cnf.Path)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Error(err)
+		return
+	}
+
+	e.mu.RLock()
+	modTime := e.modTime
+	e.mu.RUnlock()
+
+	if (info == nil && modTime.IsZero()) || (info != nil && info.ModTime().Equal(modTime)) {
+		return
+	}
+
+	if err := e.load(); err != nil {
+		logrus.Error("Cannot reload routing rules: ", err)
+		return
+	}
+
+	logrus.Infof("Routing rules reloaded from %s", e.cnf.Path)
+}
+
+// Чтение и применение файла правил. Правилам без идентификатора он назначается с сохранением файла
+func (e *Engine) load() error {
+	data, err := ioutil.ReadFile(e.cnf.Path)
+	if os.IsNotExist(err) {
+		e.apply(nil, time.Time{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("Invalid routing rules file %s: %s", e.cnf.Path, err)
+	}
+
+	missing := false
+	for i := range rules {
+		if rules[i].ID == "" {
+			if rules[i].ID, err = newID(); err != nil {
+				return err
+			}
+			missing = true
+		}
+	}
+
+	if missing {
+		return e.save(rules)
+	}
+
+	compiledRules, err := compileAll(rules)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(e.cnf.Path)
+	if err != nil {
+		return err
+	}
+
+	e.apply(compiledRules, info.ModTime())
+
+	return nil
+}
+
+// Проверка, запись в файл и применение правил
+func (e *Engine) save(rules []Rule) error {
+	compiledRules, err := compileAll(rules)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(e.cnf.Path), 0755); err != nil {
+		return err
+	}
+
+	// запись через временный файл, чтобы не оставить файл правил недописанным
+	tmp := e.cnf.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.cnf.Path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(e.cnf.Path)
+	if err != nil {
+		return err
+	}
+
+	e.apply(compiledRules, info.ModTime())
+
+	return nil
+}
+
+func (e *Engine) apply(rules []*compiled, modTime time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = rules
+	e.modTime = modTime
+}
+
+// Проверка списка правил без сохранения, правила без идентификатора допускаются
+func Validate(rules []Rule) error {
+	for i, rule := range rules {
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("new-%d", i)
+		}
+		if _, err := compile(rule); err != nil {
+			return err
+		}
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.ID != "" && ids[rule.ID] {
+			return fmt.Errorf("Duplicate rule id %s", rule.ID)
+		}
+		ids[rule.ID] = true
+	}
+
+	return nil
+}
+
+func compileAll(rules []Rule) ([]*compiled, error) {
+	ids := make(map[string]bool)
+
+	res := make([]*compiled, 0, len(rules))
+	for _, rule := range rules {
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("Duplicate rule id %s", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		c, err := compile(rule)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+
+	return res, nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,240 @@
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vpntoproxy/internal/config"
+)
+
+// Движок с файлом правил во временном каталоге теста
+func newTestEngine(t *testing.T) *Engine {
+	e := &Engine{
+		cnf:  &config.Routing{Path: filepath.Join(t.TempDir(), "routes.json")},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// Запись файла правил в обход движка с заметно другим временем изменения
+func writeRules(t *testing.T, e *Engine, data string, modTime time.Time) {
+	if err := ioutil.WriteFile(e.cnf.Path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(e.cnf.Path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Действие первого подходящего правила, пустая строка если правил нет
+func matchAction(e *Engine, req *Request) string {
+	rule := e.Match(req)
+	if rule == nil {
+		return ""
+	}
+
+	return rule.Action + ":" + rule.Target
+}
+
+func TestEngineOrder(t *testing.T) {
+	e := newTestEngine(t)
+
+	if _, err := e.Replace([]Rule{
+		{ID: "reject", Domains: []string{"ads.example.com"}, Action: ActionReject},
+		{ID: "tunnel", Domains: []string{"example.com"}, Action: ActionTunnel, Target: "us"},
+		{ID: "default", Action: ActionDirect},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "ads.example.com", want: "reject:"},
+		{host: "www.example.com", want: "tunnel:us"},
+		{host: "example.org", want: "direct:"},
+	}
+	for _, tt := range tests {
+		if got := matchAction(e, &Request{Host: tt.host, Port: 443}); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.host, got, tt.want)
+		}
+	}
+
+	// правило добавляется на позицию, перекрывая последующие
+	added, err := e.Add(Rule{Domains: []string{"www.example.com"}, Action: ActionTag, Target: "de"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := matchAction(e, &Request{Host: "www.example.com"}); got != "tag:de" {
+		t.Errorf("got %s after add, want tag:de", got)
+	}
+	if rules := e.List(); len(rules) != 4 || rules[1].ID != added.ID {
+		t.Fatalf("added rule is not at position 1: %+v", rules)
+	}
+
+	if _, err := e.Update("default", Rule{Action: ActionReject}); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchAction(e, &Request{Host: "example.org"}); got != "reject:" {
+		t.Errorf("got %s after update, want reject:", got)
+	}
+
+	if err := e.Delete(added.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := matchAction(e, &Request{Host: "www.example.com"}); got != "tunnel:us" {
+		t.Errorf("got %s after delete, want tunnel:us", got)
+	}
+
+	if err := e.Delete(added.ID); err != ErrNotFound {
+		t.Errorf("got error %v deleting a missing rule, want ErrNotFound", err)
+	}
+	if _, err := e.Update("missing", Rule{Action: ActionDirect}); err != ErrNotFound {
+		t.Errorf("got error %v updating a missing rule, want ErrNotFound", err)
+	}
+
+	// недопустимый список не сохраняется и не применяется
+	if _, err := e.Replace([]Rule{{ID: "a", Action: ActionDirect}, {ID: "a", Action: ActionReject}}); err == nil {
+		t.Fatal("expected error for duplicate ids")
+	}
+	if rules := e.List(); len(rules) != 3 {
+		t.Fatalf("got %d rules after failed replace, want 3", len(rules))
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	e := newTestEngine(t)
+	now := time.Now()
+
+	if got := matchAction(e, &Request{Host: "example.com"}); got != "" {
+		t.Fatalf("got %s without rules file, want no match", got)
+	}
+
+	steps := []struct {
+		name string
+		// содержимое файла, nil — файл удаляется
+		data *string
+		// файл записывается с прежним временем изменения
+		sameTime bool
+		want     string
+	}{
+		{name: "file created", data: strPtr(`[{"id": "a", "action": "tunnel", "target": "us"}]`), want: "tunnel:us"},
+		{name: "file changed", data: strPtr(`[{"id": "a", "action": "tunnel", "target": "de"}]`), want: "tunnel:de"},
+		{name: "unchanged time is not reloaded", data: strPtr(`[{"id": "a", "action": "reject"}]`), sameTime: true,
+			want: "tunnel:de"},
+		{name: "invalid json keeps rules", data: strPtr(`[{"id": "a",`), want: "tunnel:de"},
+		{name: "invalid rule keeps rules", data: strPtr(`[{"id": "a", "action": "drop"}]`), want: "tunnel:de"},
+		{name: "rule without id", data: strPtr(`[{"action": "direct"}]`), want: "direct:"},
+		{name: "file removed", want: ""},
+	}
+
+	for i, step := range steps {
+		modTime := now.Add(time.Duration(i+1) * time.Minute)
+		if step.sameTime {
+			modTime = now.Add(time.Duration(i) * time.Minute)
+		}
+
+		if step.data == nil {
+			if err := os.Remove(e.cnf.Path); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			writeRules(t, e, *step.data, modTime)
+		}
+
+		e.reload()
+
+		if got := matchAction(e, &Request{Host: "example.com"}); got != step.want {
+			t.Fatalf("%s: got %s, want %s", step.name, got, step.want)
+		}
+	}
+}
+
+// Изменение файла подхватывается без перезапуска
+func TestEngineWatch(t *testing.T) {
+	e := newTestEngine(t)
+	e.cnf.ReloadInterval = 1
+
+	e.Start()
+	defer e.Stop()
+
+	writeRules(t, e, `[{"id": "a", "action": "reject"}]`, time.Now().Add(time.Minute))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for matchAction(e, &Request{Host: "example.com"}) != "reject:" {
+		if time.Now().After(deadline) {
+			t.Fatal("rules file change is not picked up")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Идентификаторы, назначенные правилам из файла, сохраняются в файл
+func TestEngineLoadAssignsIDs(t *testing.T) {
+	e := newTestEngine(t)
+	writeRules(t, e, `[{"action": "direct"}, {"id": "b", "action": "reject"}]`, time.Now().Add(time.Minute))
+
+	if err := e.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(e.cnf.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []Rule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := e.List()
+	if len(saved) != 2 || len(rules) != 2 {
+		t.Fatalf("got %d saved and %d loaded rules, want 2", len(saved), len(rules))
+	}
+	if saved[0].ID == "" || saved[0].ID != rules[0].ID || saved[1].ID != "b" {
+		t.Fatalf("got saved ids %s, %s and loaded %s", saved[0].ID, saved[1].ID, rules[0].ID)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []Rule
+		wantError string
+	}{
+		{name: "rules without ids", rules: []Rule{{Action: ActionDirect}, {Action: ActionReject}}},
+		{name: "duplicate ids", rules: []Rule{{ID: "a", Action: ActionDirect}, {ID: "a", Action: ActionReject}},
+			wantError: "Duplicate rule id a"},
+		{name: "invalid rule without id", rules: []Rule{{Action: ActionDirect}, {Action: ActionPool}},
+			wantError: "Rule new-1: target is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.rules)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("got error %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,227 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Действия правила маршрутизации
+const (
+	// соединение через туннель с указанным именем или идентификатором
+	ActionTunnel = "tunnel"
+	// соединение через один из туннелей с указанной меткой
+	ActionTag = "tag"
+	// соединение через один из туннелей пула
+	ActionPool = "pool"
+	// прямое соединение с хоста, минуя туннели
+	ActionDirect = "direct"
+	// отказ в соединении
+	ActionReject = "reject"
+)
+
+// Правило маршрутизации.
+// Условия разных видов объединяются через «и», значения одного вида через «или».
+// Правило без условий подходит для любого соединения
+type Rule struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// суффиксы доменов, example.com подходит для example.com и *.example.com
+	Domains     []string `json:"domains,omitempty"`
+	DomainRegex string   `json:"domain_regex,omitempty"`
+	// сети назначения, проверяются только для адресов, переданных клиентом в виде ip
+	CIDRs []string `json:"cidrs,omitempty"`
+	// порты назначения, отдельные или диапазоном: 443, 8000-8100
+	Ports []string `json:"ports,omitempty"`
+	// адреса или сети клиента
+	Sources []string `json:"sources,omitempty"`
+	// имена пользователей socks5 / http прокси
+	Users  []string `json:"users,omitempty"`
+	Action string   `json:"action"`
+	Target string   `json:"target,omitempty"`
+}
+
+// Параметры соединения, по которым выбирается правило
+type Request struct {
+	Host   string
+	Port   int
+	Source net.IP
+	User   string
+}
+
+// Правило с разобранными условиями
+type compiled struct {
+	Rule
+	regex   *regexp.Regexp
+	cidrs   []*net.IPNet
+	ports   [][2]int
+	sources []*net.IPNet
+}
+
+func compile(rule Rule) (*compiled, error) {
+	c := &compiled{Rule: rule}
+
+	switch rule.Action {
+	case ActionTunnel, ActionTag, ActionPool:
+		if rule.Target == "" {
+			return nil, fmt.Errorf("Rule %s: target is required for action %s", rule.ID, rule.Action)
+		}
+	case ActionDirect, ActionReject:
+	default:
+		return nil, fmt.Errorf("Rule %s: unknown action %q", rule.ID, rule.Action)
+	}
+
+	c.Domains = make([]string, 0, len(rule.Domains))
+	for _, domain := range rule.Domains {
+		c.Domains = append(c.Domains, strings.Trim(strings.ToLower(domain), "."))
+	}
+
+	if rule.DomainRegex != "" {
+		regex, err := regexp.Compile(rule.DomainRegex)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %s: %s", rule.ID, err)
+		}
+		c.regex = regex
+	}
+
+	for _, cidr := range rule.CIDRs {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %s: %s", rule.ID, err)
+		}
+		c.cidrs = append(c.cidrs, network)
+	}
+
+	for _, source := range rule.Sources {
+		network, err := parseNetwork(source)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %s: %s", rule.ID, err)
+		}
+		c.sources = append(c.sources, network)
+	}
+
+	for _, port := range rule.Ports {
+		bounds, err := parsePorts(port)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %s: %s", rule.ID, err)
+		}
+		c.ports = append(c.ports, bounds)
+	}
+
+	return c, nil
+}
+
+// Проверка соответствия соединения условиям правила
+func (c *compiled) match(req *Request) bool {
+	host := strings.TrimSuffix(strings.ToLower(req.Host), ".")
+	ip := net.ParseIP(host)
+
+	if len(c.Domains) > 0 && (ip != nil || !matchDomain(c.Domains, host)) {
+		return false
+	}
+	if c.regex != nil && (ip != nil || !c.regex.MatchString(host)) {
+		return false
+	}
+	if len(c.cidrs) > 0 && (ip == nil || !contains(c.cidrs, ip)) {
+		return false
+	}
+	if len(c.ports) > 0 && !matchPort(c.ports, req.Port) {
+		return false
+	}
+	if len(c.sources) > 0 && (req.Source == nil || !contains(c.sources, req.Source)) {
+		return false
+	}
+	if len(c.Users) > 0 && !matchString(c.Users, req.User) {
+		return false
+	}
+
+	return true
+}
+
+func matchDomain(domains []string, host string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchPort(ports [][2]int, port int) bool {
+	for _, bounds := range ports {
+		if port >= bounds[0] && port <= bounds[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Разбор сети, отдельный адрес считается сетью из одного адреса
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address %q", s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid network %q", s)
+	}
+
+	return network, nil
+}
+
+// Разбор порта или диапазона портов
+func parsePorts(s string) ([2]int, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	var bounds [2]int
+	for i := range bounds {
+		part := parts[0]
+		if len(parts) == 2 {
+			part = parts[i]
+		}
+
+		port, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || port < 1 || port > 65535 {
+			return bounds, fmt.Errorf("Invalid port %q", s)
+		}
+		bounds[i] = port
+	}
+
+	if bounds[0] > bounds[1] {
+		return bounds, fmt.Errorf("Invalid port range %q", s)
+	}
+
+	return bounds, nil
+}
@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      string
+		wantError bool
+	}{
+		{value: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{value: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{value: "192.168.1.10", want: "192.168.1.10/32"},
+		{value: "2001:db8::/32", want: "2001:db8::/32"},
+		{value: "2001:db8::1", want: "2001:db8::1/128"},
+		{value: "10.0.0.0/33", wantError: true},
+		{value: "example.com", wantError: true},
+		{value: "", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			network, err := parseNetwork(tt.value)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("expected error, got %s", network)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network.String() != tt.want {
+				t.Fatalf("got %s, want %s", network, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      [2]int
+		wantError bool
+	}{
+		{value: "443", want: [2]int{443, 443}},
+		{value: "8000-8100", want: [2]int{8000, 8100}},
+		{value: " 80 - 81 ", want: [2]int{80, 81}},
+		{value: "1-65535", want: [2]int{1, 65535}},
+		{value: "8100-8000", wantError: true},
+		{value: "0", wantError: true},
+		{value: "65536", wantError: true},
+		{value: "80-", wantError: true},
+		{value: "http", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			bounds, err := parsePorts(tt.value)
+			if tt.wantError {
+				if err == nil {
+					t.Fatalf("expected error, got %v", bounds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bounds != tt.want {
+				t.Fatalf("got %v, want %v", bounds, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      Rule
+		wantError string
+	}{
+		{name: "direct without target", rule: Rule{ID: "r", Action: ActionDirect}},
+		{name: "tunnel without target", rule: Rule{ID: "r", Action: ActionTunnel}, wantError: "target is required"},
+		{name: "unknown action", rule: Rule{ID: "r", Action: "drop"}, wantError: `unknown action "drop"`},
+		{name: "invalid regex", rule: Rule{ID: "r", Action: ActionReject, DomainRegex: "("}, wantError: "Rule r:"},
+		{name: "invalid cidr", rule: Rule{ID: "r", Action: ActionReject, CIDRs: []string{"10.0.0.0/40"}},
+			wantError: "Invalid network"},
+		{name: "invalid source", rule: Rule{ID: "r", Action: ActionReject, Sources: []string{"localhost"}},
+			wantError: "Invalid address"},
+		{name: "invalid port", rule: Rule{ID: "r", Action: ActionReject, Ports: []string{"22-21"}},
+			wantError: "Invalid port range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compile(tt.rule)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("got error %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+		req  Request
+		want bool
+	}{
+		{name: "no conditions", rule: Rule{}, req: Request{Host: "example.com", Port: 443}, want: true},
+		{name: "domain itself", rule: Rule{Domains: []string{"example.com"}}, req: Request{Host: "example.com"}, want: true},
+		{name: "subdomain", rule: Rule{Domains: []string{".Example.com."}}, req: Request{Host: "WWW.example.com."}, want: true},
+		{name: "suffix is not a subdomain", rule: Rule{Domains: []string{"example.com"}},
+			req: Request{Host: "badexample.com"}},
+		{name: "domain rule skips ip", rule: Rule{Domains: []string{"1.1"}}, req: Request{Host: "1.1.1.1"}},
+		{name: "regex", rule: Rule{DomainRegex: `^api\d+\.`}, req: Request{Host: "api12.example.com"}, want: true},
+		{name: "regex mismatch", rule: Rule{DomainRegex: `^api\d+\.`}, req: Request{Host: "www.example.com"}},
+		{name: "cidr", rule: Rule{CIDRs: []string{"10.0.0.0/8"}}, req: Request{Host: "10.2.3.4"}, want: true},
+		{name: "cidr outside", rule: Rule{CIDRs: []string{"10.0.0.0/8"}}, req: Request{Host: "11.2.3.4"}},
+		{name: "cidr ignores names", rule: Rule{CIDRs: []string{"10.0.0.0/8"}}, req: Request{Host: "internal.example.com"}},
+		{name: "ipv6 cidr", rule: Rule{CIDRs: []string{"2001:db8::/32"}}, req: Request{Host: "2001:db8::5"}, want: true},
+		{name: "port in range", rule: Rule{Ports: []string{"80", "8000-8100"}}, req: Request{Port: 8080}, want: true},
+		{name: "port outside", rule: Rule{Ports: []string{"80", "8000-8100"}}, req: Request{Port: 443}},
+		{name: "source", rule: Rule{Sources: []string{"192.168.1.0/24"}},
+			req: Request{Source: net.ParseIP("192.168.1.7")}, want: true},
+		{name: "single source address", rule: Rule{Sources: []string{"192.168.1.7"}},
+			req: Request{Source: net.ParseIP("192.168.1.8")}},
+		{name: "unknown source", rule: Rule{Sources: []string{"0.0.0.0/0"}}, req: Request{}},
+		{name: "user", rule: Rule{Users: []string{"alice", "bob"}}, req: Request{User: "bob"}, want: true},
+		{name: "anonymous user", rule: Rule{Users: []string{"alice"}}, req: Request{}},
+		{name: "all conditions", rule: Rule{Domains: []string{"example.com"}, Ports: []string{"443"}, Users: []string{"alice"}},
+			req: Request{Host: "www.example.com", Port: 443, User: "alice"}, want: true},
+		{name: "one condition fails", rule: Rule{Domains: []string{"example.com"}, Ports: []string{"443"}, Users: []string{"alice"}},
+			req: Request{Host: "www.example.com", Port: 80, User: "alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.ID = "r"
+			tt.rule.Action = ActionDirect
+
+			c, err := compile(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.match(&tt.req); got != tt.want {
+				t.Fatalf("got match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
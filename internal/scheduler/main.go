@@ -0,0 +1,176 @@
+// пакет периодической проверки vpn и прокси всех туннелей
+package scheduler
+
+import (
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/vpn"
+)
+
+// Обработчик результата проверки туннеля
+type Observer func(t *registry.Tunnel)
+
+type Scheduler struct {
+	manager   *vpn.Manager
+	cnf       *config.Scheduler
+	observers []Observer
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Инициализация планировщика проверок
+func New(manager *vpn.Manager) *Scheduler {
+	return &Scheduler{
+		manager: manager,
+		cnf:     config.Get().Scheduler,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Подписка на результаты проверок, вызывается до запуска планировщика
+func (s *Scheduler) Subscribe(observer Observer) {
+	s.observers = append(s.observers, observer)
+}
+
+// Запуск планировщика в отдельной горутине
+func (s *Scheduler) Start() {
+	logrus.Infof("Starting scheduler, interval: %ds, jitter: %ds, concurrency: %d",
+		s.cnf.Interval, s.cnf.Jitter, s.cnf.Concurrency)
+
+	go s.run()
+}
+
+// Остановка планировщика с ожиданием завершения текущих проверок
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	<-s.done
+
+	logrus.Info("Scheduler stopped")
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	interval := time.Duration(s.cnf.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.RunOnce()
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Проверка всех туннелей, которые должны быть запущены.
+// Одновременно проверяется не более Concurrency туннелей, каждая проверка начинается со случайной задержкой
+func (s *Scheduler) RunOnce() {
+	logrus.Debug(">>> Starting scheduled check of tunnels")
+
+	tunnels, err := s.manager.Registry().List()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	concurrency := s.cnf.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, t := range tunnels {
+		// туннель, сервер которого меняется, проверяется самой сменой сервера
+		if t.DesiredState != registry.StateRunning || s.manager.Rotating(t.ID) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(t *registry.Tunnel) {
+			defer wg.Done()
+
+			if !s.wait(s.jitter()) {
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-s.stop:
+				return
+			}
+			defer func() { <-sem }()
+
+			s.probe(t)
+		}(t)
+	}
+
+	wg.Wait()
+
+	logrus.Debug("<<< Ending scheduled check of tunnels")
+}
+
+func (s *Scheduler) probe(t *registry.Tunnel) {
+	// смена сервера могла начаться во время случайной задержки
+	if s.manager.Rotating(t.ID) {
+		return
+	}
+
+	updated, err := s.manager.Probe(t)
+	if err == registry.ErrNotFound {
+		// туннель удалён во время проверки
+		return
+	}
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	if health := updated.LastHealth(); health != nil && health.State != registry.HealthUp {
+		logrus.Warnf("Tunnel %s (%s) is unhealthy: %s %s", t.ID, t.Name, health.State, health.Error)
+	}
+
+	for _, observer := range s.observers {
+		observer(updated)
+	}
+}
+
+// Случайная задержка перед проверкой туннеля
+func (s *Scheduler) jitter() time.Duration {
+	if s.cnf.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(time.Duration(s.cnf.Jitter) * time.Second)))
+}
+
+// Ожидание с возможностью прерывания остановкой планировщика
+func (s *Scheduler) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
@@ -0,0 +1,71 @@
+package apply
+
+import (
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/desired"
+	"vpntoproxy/pkg/responses"
+)
+
+// Наибольший размер описания состояния в теле запроса
+const maxStateSize = 1 << 20
+
+// Обработчик запросов сверки с желаемым состоянием
+type handler struct {
+	applier *desired.Applier
+}
+
+// Обработка запроса на сверку. Описание берётся из тела запроса в yaml или json,
+// без тела - из файла state.path. dry_run=true возвращает план без изменений,
+// prune переопределяет state.prune
+func (h *handler) apply(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for apply state")
+
+	cnf := config.Get().State
+	query := r.URL.Query()
+
+	prune := cnf.Prune
+	if value := query.Get("prune"); value != "" {
+		prune = value == "true"
+	}
+
+	state, err := readState(w, r, cnf.Path)
+	if err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	plan, err := h.applier.Apply(state, prune, query.Get("dry_run") == "true")
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(plan))
+
+	logrus.Debug("<<< Ending handler for apply state")
+}
+
+// Чтение описания из тела запроса, формат json задаётся Content-Type application/json
+func readState(w http.ResponseWriter, r *http.Request, path string) (*desired.State, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return desired.Load(path)
+	}
+
+	format := desired.FormatYAML
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		format = desired.FormatJSON
+	}
+
+	return desired.Parse(data, format)
+}
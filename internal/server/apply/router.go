@@ -0,0 +1,16 @@
+package apply
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/desired"
+)
+
+func Router(applier *desired.Applier) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{applier: applier}
+
+	r.Post("/", h.apply)
+
+	return r
+}
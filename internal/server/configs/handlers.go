@@ -0,0 +1,173 @@
+package configs
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/ovpn"
+	"vpntoproxy/internal/vpn"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов библиотеки конфигураций
+type handler struct {
+	library *library.Library
+	manager *vpn.Manager
+}
+
+// Обработка запроса на получение списка конфигураций
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get config list")
+
+	configs, err := h.library.List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(configs))
+
+	logrus.Debug("<<< Ending handler for get config list")
+}
+
+// Обработка запроса на получение сведений о конфигурации
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get config detail")
+
+	cfg, err := h.library.Get(chi.URLParam(r, "name"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(cfg))
+
+	logrus.Debug("<<< Ending handler for get config detail")
+}
+
+// Обработка запроса на загрузку конфигурации.
+// Принимает json с текстом конфигурации или multipart/form-data с файлом в поле file
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for create config")
+
+	body := &requests.CreateConfigParams{}
+	fileName := ""
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		var err error
+		if fileName, err = bindMultipart(w, r, body); err != nil {
+			logrus.Error(err)
+			render.JSON(w, r, responses.OutputErrorData(err))
+			return
+		}
+	} else if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	logrus.Debug("Config name: ", body.Name)
+
+	cfg, err := h.library.Add(&library.Options{
+		Name:      body.Name,
+		Type:      body.Type,
+		FileName:  fileName,
+		Country:   body.Country,
+		Tags:      body.Tags,
+		Overwrite: body.Overwrite,
+	}, []byte(body.Content))
+	if verr, ok := err.(*ovpn.ValidationError); ok {
+		render.JSON(w, r, responses.OutputErrorDetails(verr, verr.Issues))
+		return
+	}
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(cfg))
+
+	logrus.Debug("<<< Ending handler for create config")
+}
+
+// Обработка запроса на удаление конфигурации, используемая туннелями конфигурация не удаляется
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete config")
+
+	name := chi.URLParam(r, "name")
+
+	cfg, err := h.library.Get(name)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	tunnels, err := h.manager.Registry().List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	path := h.library.Path(cfg)
+	for _, t := range tunnels {
+		if t.ConfigPath == path {
+			render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Config %s is used by tunnel %s", name, t.ID)))
+			return
+		}
+	}
+
+	if err := h.library.Delete(name); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for delete config")
+}
+
+// Заполнение параметров из multipart/form-data, возвращает имя загруженного файла
+func bindMultipart(w http.ResponseWriter, r *http.Request, body *requests.CreateConfigParams) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, library.MaxSize+64*1024)
+
+	if err := r.ParseMultipartForm(library.MaxSize); err != nil {
+		return "", err
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", fmt.Errorf("file: %s", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	body.Name = r.FormValue("name")
+	if body.Name == "" {
+		body.Name = library.NameFromFile(header.Filename)
+	}
+	body.Content = string(data)
+	body.Type = r.FormValue("type")
+	body.Country = r.FormValue("country")
+	body.Overwrite = r.FormValue("overwrite") == "true"
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			body.Tags = append(body.Tags, tag)
+		}
+	}
+
+	return header.Filename, body.Bind(r)
+}
@@ -0,0 +1,20 @@
+package configs
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/vpn"
+)
+
+func Router(lib *library.Library, manager *vpn.Manager) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{library: lib, manager: manager}
+
+	r.Get("/", h.list)
+	r.Post("/", h.create)
+	r.Get("/{name}", h.detail)
+	r.Delete("/{name}", h.del)
+
+	return r
+}
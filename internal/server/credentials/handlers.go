@@ -0,0 +1,89 @@
+package credentials
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов учётных данных, пароли в ответах не возвращаются
+type handler struct {
+	store *credentials.Store
+}
+
+// Обработка запроса на получение списка наборов учётных данных
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get credentials list")
+
+	sets, err := h.store.List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(sets))
+
+	logrus.Debug("<<< Ending handler for get credentials list")
+}
+
+// Обработка запроса на получение сведений о наборе учётных данных
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get credentials detail")
+
+	set, err := h.store.Get(chi.URLParam(r, "name"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(set.Info()))
+
+	logrus.Debug("<<< Ending handler for get credentials detail")
+}
+
+// Обработка запроса на сохранение набора учётных данных
+func (h *handler) save(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for save credentials")
+
+	body := &requests.CredentialsParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	set, err := h.store.Save(body.Name, &credentials.Credentials{
+		User:         body.User,
+		Password:     body.Password,
+		CertPassword: body.CertPassword,
+	})
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	logrus.Debug("Credentials saved: ", set.Name)
+
+	render.JSON(w, r, responses.OutputSuccessData(set.Info()))
+
+	logrus.Debug("<<< Ending handler for save credentials")
+}
+
+// Обработка запроса на удаление набора учётных данных.
+// Туннели, созданные с набором, продолжают работать, так как данные уже записаны в их файлы
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete credentials")
+
+	if err := h.store.Delete(chi.URLParam(r, "name")); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for delete credentials")
+}
@@ -0,0 +1,19 @@
+package credentials
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/credentials"
+)
+
+func Router(store *credentials.Store) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{store: store}
+
+	r.Get("/", h.list)
+	r.Post("/", h.save)
+	r.Get("/{name}", h.detail)
+	r.Delete("/{name}", h.del)
+
+	return r
+}
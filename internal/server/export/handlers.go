@@ -0,0 +1,56 @@
+package export
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/export"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/vpn"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов выгрузки туннелей
+type handler struct {
+	manager *vpn.Manager
+	routes  *routing.Engine
+}
+
+// Обработка запроса на выгрузку исправных туннелей в формате клиентской программы.
+// Туннели отбираются по параметрам tag и country
+func (h *handler) export(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for export tunnels")
+
+	format := chi.URLParam(r, "format")
+	logrus.Debug("Format: ", format)
+
+	tunnels, err := h.manager.Registry().List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	filter := &export.Filter{
+		Tag:     r.URL.Query().Get("tag"),
+		Country: r.URL.Query().Get("country"),
+	}
+
+	var rules []routing.Rule
+	if h.routes != nil {
+		rules = h.routes.List()
+	}
+
+	data, err := export.Render(format, export.Healthy(tunnels, filter), rules)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	if _, err := w.Write(data); err != nil {
+		logrus.Error(err)
+	}
+
+	logrus.Debug("<<< Ending handler for export tunnels")
+}
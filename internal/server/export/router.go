@@ -0,0 +1,17 @@
+package export
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/vpn"
+)
+
+func Router(manager *vpn.Manager, routes *routing.Engine) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{manager: manager, routes: routes}
+
+	r.Get("/{format}", h.export)
+
+	return r
+}
@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/gateway"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов шлюза
+type handler struct {
+	gateway *gateway.Gateway
+}
+
+// Обработка запроса на получение состояния шлюза
+func (h *handler) status(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get gateway status")
+
+	status, err := h.gateway.Status()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(status))
+
+	logrus.Debug("<<< Ending handler for get gateway status")
+}
+
+// Обработка запроса на получение таблицы закреплённых сессий
+func (h *handler) sessions(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get gateway sessions")
+
+	sessions, err := h.gateway.Sessions()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(sessions))
+
+	logrus.Debug("<<< Ending handler for get gateway sessions")
+}
+
+// Обработка запроса на удаление закреплённой сессии
+func (h *handler) removeSession(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for remove gateway session")
+
+	token := chi.URLParam(r, "token")
+	if !h.gateway.RemoveSession(token) {
+		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Session %s not found", token)))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for remove gateway session")
+}
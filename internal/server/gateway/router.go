@@ -0,0 +1,18 @@
+package gateway
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/gateway"
+)
+
+func Router(gw *gateway.Gateway) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{gateway: gw}
+
+	r.Get("/", h.status)
+	r.Get("/sessions", h.sessions)
+	r.Delete("/sessions/{token}", h.removeSession)
+
+	return r
+}
@@ -0,0 +1,175 @@
+package policies
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/policy"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/vpn"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов политик смены сервера
+type handler struct {
+	store   *policy.Store
+	runner  *policy.Runner
+	manager *vpn.Manager
+}
+
+// Обработка запроса на получение списка политик
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get policies list")
+
+	policies, err := h.store.List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(policies))
+
+	logrus.Debug("<<< Ending handler for get policies list")
+}
+
+// Обработка запроса на получение политики
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get policy")
+
+	p, err := h.store.Get(chi.URLParam(r, "ID"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(p))
+
+	logrus.Debug("<<< Ending handler for get policy")
+}
+
+// Обработка запроса на добавление политики
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for create policy")
+
+	p, ok := h.bind(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := h.store.Add(p)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	logrus.Infof("Policy %s created", p.ID)
+
+	render.JSON(w, r, responses.OutputSuccessData(p))
+
+	logrus.Debug("<<< Ending handler for create policy")
+}
+
+// Обработка запроса на замену параметров политики
+func (h *handler) update(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for update policy")
+
+	p, ok := h.bind(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := h.store.Replace(chi.URLParam(r, "ID"), p)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(p))
+
+	logrus.Debug("<<< Ending handler for update policy")
+}
+
+// Обработка запроса на удаление политики
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete policy")
+
+	if err := h.store.Delete(chi.URLParam(r, "ID")); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for delete policy")
+}
+
+// Обработка запроса на немедленное выполнение политики, расписание считается от окончания выполнения
+func (h *handler) run(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for run policy")
+
+	p, err := h.store.Get(chi.URLParam(r, "ID"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	p, err = h.runner.Run(p)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(p))
+
+	logrus.Debug("<<< Ending handler for run policy")
+}
+
+// Разбор параметров политики, туннель должен существовать
+func (h *handler) bind(w http.ResponseWriter, r *http.Request) (*policy.Policy, bool) {
+	body := &requests.PolicyParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return nil, false
+	}
+
+	if body.Tunnel != "" {
+		if _, err := h.manager.Registry().Get(body.Tunnel); err != nil {
+			if err == registry.ErrNotFound {
+				err = fmt.Errorf("Tunnel %s not found", body.Tunnel)
+			}
+			render.JSON(w, r, responses.OutputErrorData(err))
+			return nil, false
+		}
+	}
+
+	enabled := true
+	if body.Enabled != nil {
+		enabled = *body.Enabled
+	}
+
+	return &policy.Policy{
+		Name:         body.Name,
+		Tunnel:       body.Tunnel,
+		Tag:          body.Tag,
+		Every:        body.Every,
+		Cron:         body.Cron,
+		Drain:        body.Drain,
+		DrainTimeout: body.DrainTimeout,
+		Enabled:      enabled,
+		Rotate: rotation.Source{
+			Configs:  body.Rotate.Configs,
+			Paths:    body.Rotate.Paths,
+			Dir:      body.Rotate.Dir,
+			Tag:      body.Rotate.Tag,
+			Provider: body.Rotate.Provider,
+			Country:  body.Rotate.Country,
+			City:     body.Rotate.City,
+			Attempts: body.Rotate.Attempts,
+		},
+	}, true
+}
@@ -0,0 +1,22 @@
+package policies
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/policy"
+	"vpntoproxy/internal/vpn"
+)
+
+func Router(store *policy.Store, runner *policy.Runner, manager *vpn.Manager) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{store: store, runner: runner, manager: manager}
+
+	r.Get("/", h.list)
+	r.Post("/", h.create)
+	r.Get("/{ID}", h.detail)
+	r.Put("/{ID}", h.update)
+	r.Delete("/{ID}", h.del)
+	r.Post("/{ID}/run", h.run)
+
+	return r
+}
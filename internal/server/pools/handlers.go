@@ -0,0 +1,147 @@
+package pools
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов пулов туннелей
+type handler struct {
+	store      *pool.Store
+	controller *pool.Controller
+}
+
+// Обработка запроса на получение списка пулов с состоянием
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get pools list")
+
+	pools, err := h.store.List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	res := make([]*pool.Info, 0, len(pools))
+	for _, p := range pools {
+		res = append(res, h.controller.Info(p))
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for get pools list")
+}
+
+// Обработка запроса на получение пула с состоянием
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get pool")
+
+	p, err := h.store.Get(chi.URLParam(r, "name"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(h.controller.Info(p)))
+
+	logrus.Debug("<<< Ending handler for get pool")
+}
+
+// Обработка запроса на добавление пула, туннели создаются контроллером
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for create pool")
+
+	body := &requests.PoolParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	p, err := h.store.Add(poolFromParams(body))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	logrus.Infof("Pool %s created", p.Name)
+	h.controller.Trigger()
+
+	render.JSON(w, r, responses.OutputSuccessData(h.controller.Info(p)))
+
+	logrus.Debug("<<< Ending handler for create pool")
+}
+
+// Обработка запроса на замену параметров пула
+func (h *handler) update(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for update pool")
+
+	name := chi.URLParam(r, "name")
+
+	// имя пула в теле запроса необязательно
+	body := &requests.PoolParams{Name: name}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+	if body.Name != name {
+		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Pool %s cannot be renamed", name)))
+		return
+	}
+
+	p, err := h.store.Replace(name, poolFromParams(body))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	h.controller.Trigger()
+
+	render.JSON(w, r, responses.OutputSuccessData(h.controller.Info(p)))
+
+	logrus.Debug("<<< Ending handler for update pool")
+}
+
+// Обработка запроса на удаление пула.
+// Туннели пула удаляются, с ?keep_tunnels=true остаются без пула
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete pool")
+
+	keep := r.URL.Query().Get("keep_tunnels") == "true"
+
+	if err := h.controller.Remove(chi.URLParam(r, "name"), keep); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for delete pool")
+}
+
+func poolFromParams(params *requests.PoolParams) *pool.Pool {
+	return &pool.Pool{
+		Name: params.Name,
+		Source: rotation.Source{
+			Configs:  params.Source.Configs,
+			Paths:    params.Source.Paths,
+			Dir:      params.Source.Dir,
+			Tag:      params.Source.Tag,
+			Provider: params.Source.Provider,
+			Country:  params.Source.Country,
+			City:     params.Source.City,
+		},
+		Size:        params.Size,
+		Min:         params.Min,
+		Max:         params.Max,
+		Tags:        params.Tags,
+		Credentials: params.Credentials,
+	}
+}
@@ -0,0 +1,20 @@
+package pools
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/pool"
+)
+
+func Router(store *pool.Store, controller *pool.Controller) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{store: store, controller: controller}
+
+	r.Get("/", h.list)
+	r.Post("/", h.create)
+	r.Get("/{name}", h.detail)
+	r.Put("/{name}", h.update)
+	r.Delete("/{name}", h.del)
+
+	return r
+}
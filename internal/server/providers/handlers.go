@@ -0,0 +1,50 @@
+package providers
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов провайдеров vpn
+type handler struct {
+	providers *provider.Registry
+}
+
+// Обработка запроса на получение списка провайдеров
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get provider list")
+
+	providers, err := h.providers.List()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(providers))
+
+	logrus.Debug("<<< Ending handler for get provider list")
+}
+
+// Обработка запроса на получение серверов провайдера с отбором по стране и городу
+func (h *handler) servers(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get provider servers")
+
+	query := r.URL.Query()
+
+	servers, err := h.providers.Servers(chi.URLParam(r, "name"), &provider.Filter{
+		Country: query.Get("country"),
+		City:    query.Get("city"),
+	})
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(servers))
+
+	logrus.Debug("<<< Ending handler for get provider servers")
+}
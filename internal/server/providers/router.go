@@ -0,0 +1,17 @@
+package providers
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/provider"
+)
+
+func Router(providers *provider.Registry) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{providers: providers}
+
+	r.Get("/", h.list)
+	r.Get("/{name}/servers", h.servers)
+
+	return r
+}
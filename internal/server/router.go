@@ -3,23 +3,45 @@ package server
 import (
 	"github.com/go-chi/chi"
 	"net/http"
+	"vpntoproxy/internal/server/apply"
+	"vpntoproxy/internal/server/configs"
+	"vpntoproxy/internal/server/credentials"
+	"vpntoproxy/internal/server/export"
+	"vpntoproxy/internal/server/gateway"
+	"vpntoproxy/internal/server/policies"
+	"vpntoproxy/internal/server/pools"
+	"vpntoproxy/internal/server/providers"
+	"vpntoproxy/internal/server/routes"
 	"vpntoproxy/internal/server/vpn"
 )
 
-func route() http.Handler {
+func route(services *Services) http.Handler {
 	// create `ServerMux`
 	mux := chi.NewRouter()
 
 	mux.Get("/", home)
-	mux.Mount("/api", apiRoute())
+	mux.Mount("/api", apiRoute(services))
 
 	return mux
 }
 
-func apiRoute() http.Handler {
+func apiRoute(services *Services) http.Handler {
 	r := chi.NewRouter()
 
-	r.Mount("/vpn", vpn.Router())
+	r.Mount("/vpn", vpn.Router(services.Manager, services.Library, services.Credentials, services.Providers))
+	r.Mount("/configs", configs.Router(services.Library, services.Manager))
+	r.Mount("/credentials", credentials.Router(services.Credentials))
+	r.Mount("/providers", providers.Router(services.Providers))
+	r.Mount("/policies", policies.Router(services.Policies, services.Runner, services.Manager))
+	r.Mount("/pools", pools.Router(services.Pools, services.Controller))
+	if services.Gateway != nil {
+		r.Mount("/gateway", gateway.Router(services.Gateway))
+	}
+	if services.Routes != nil {
+		r.Mount("/routes", routes.Router(services.Routes))
+	}
+	r.Mount("/export", export.Router(services.Manager, services.Routes))
+	r.Mount("/apply", apply.Router(services.Applier))
 
 	return r
 }
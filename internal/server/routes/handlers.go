@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработчик запросов правил маршрутизации
+type handler struct {
+	engine *routing.Engine
+}
+
+// Обработка запроса на получение списка правил
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get routing rules")
+
+	render.JSON(w, r, responses.OutputSuccessData(h.engine.List()))
+
+	logrus.Debug("<<< Ending handler for get routing rules")
+}
+
+// Обработка запроса на получение правила
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get routing rule")
+
+	rule, err := h.engine.Get(chi.URLParam(r, "ID"))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(rule))
+
+	logrus.Debug("<<< Ending handler for get routing rule")
+}
+
+// Обработка запроса на замену всего списка правил
+func (h *handler) replace(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for replace routing rules")
+
+	body := &requests.RoutesParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	rules := make([]routing.Rule, 0, len(body.Rules))
+	for i := range body.Rules {
+		rules = append(rules, rule(&body.Rules[i]))
+	}
+
+	res, err := h.engine.Replace(rules)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for replace routing rules")
+}
+
+// Обработка запроса на добавление правила
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for create routing rule")
+
+	body := &requests.RouteParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	position := -1
+	if body.Position != nil {
+		position = *body.Position
+	}
+
+	res, err := h.engine.Add(rule(body), position)
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for create routing rule")
+}
+
+// Обработка запроса на изменение правила
+func (h *handler) update(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for update routing rule")
+
+	body := &requests.RouteParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	res, err := h.engine.Update(chi.URLParam(r, "ID"), rule(body))
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for update routing rule")
+}
+
+// Обработка запроса на удаление правила
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete routing rule")
+
+	if err := h.engine.Delete(chi.URLParam(r, "ID")); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(nil))
+
+	logrus.Debug("<<< Ending handler for delete routing rule")
+}
+
+// Обработка запроса на проверку, какое правило сработает для соединения.
+// Параметры: addr (хост:порт), source (адрес клиента), user
+func (h *handler) match(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for match routing rule")
+
+	query := r.URL.Query()
+
+	req := &routing.Request{
+		Host:   query.Get("addr"),
+		Source: net.ParseIP(query.Get("source")),
+		User:   query.Get("user"),
+	}
+	if host, port, err := net.SplitHostPort(req.Host); err == nil {
+		req.Host = host
+		req.Port, _ = strconv.Atoi(port)
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(h.engine.Match(req)))
+
+	logrus.Debug("<<< Ending handler for match routing rule")
+}
+
+func rule(params *requests.RouteParams) routing.Rule {
+	return routing.Rule{
+		Name:        params.Name,
+		Domains:     params.Domains,
+		DomainRegex: params.DomainRegex,
+		CIDRs:       params.CIDRs,
+		Ports:       params.Ports,
+		Sources:     params.Sources,
+		Users:       params.Users,
+		Action:      params.Action,
+		Target:      params.Target,
+	}
+}
@@ -0,0 +1,22 @@
+package routes
+
+import (
+	"github.com/go-chi/chi"
+	"net/http"
+	"vpntoproxy/internal/routing"
+)
+
+func Router(engine *routing.Engine) http.Handler {
+	r := chi.NewRouter()
+	h := &handler{engine: engine}
+
+	r.Get("/", h.list)
+	r.Put("/", h.replace)
+	r.Post("/", h.create)
+	r.Get("/match", h.match)
+	r.Get("/{ID}", h.detail)
+	r.Put("/{ID}", h.update)
+	r.Delete("/{ID}", h.del)
+
+	return r
+}
@@ -9,19 +9,43 @@ import (
 	"strconv"
 	"syscall"
 	"time"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/desired"
+	"vpntoproxy/internal/gateway"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/policy"
+	"vpntoproxy/internal/pool"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/routing"
+	"vpntoproxy/internal/vpn"
 )
 
 type HttpServer struct {
 	server *http.Server
 }
 
-func New(port int) *HttpServer {
+// Сервисы, с которыми работают обработчики API
+type Services struct {
+	Manager     *vpn.Manager
+	Library     *library.Library
+	Credentials *credentials.Store
+	Providers   *provider.Registry
+	Gateway     *gateway.Gateway
+	Routes      *routing.Engine
+	Policies    *policy.Store
+	Runner      *policy.Runner
+	Pools       *pool.Store
+	Controller  *pool.Controller
+	Applier     *desired.Applier
+}
+
+func New(port int, services *Services) *HttpServer {
 	logrus.Infof("Starting listening on port: %d", port)
 
 	return &HttpServer{
 		server: &http.Server{
 			Addr:    ":" + strconv.Itoa(port),
-			Handler: route(),
+			Handler: route(services),
 		},
 	}
 }
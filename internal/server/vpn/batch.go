@@ -0,0 +1,340 @@
+package vpn
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/vpn"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+const (
+	// максимальный размер загружаемого архива
+	maxArchiveSize = 64 << 20
+	// количество туннелей, создаваемых одновременно, по умолчанию
+	defaultConcurrency = 4
+)
+
+// Обработка запроса на пакетное создание vpn.
+// Принимает json со списком путей, конфигураций библиотеки или шаблоном путей,
+// либо multipart/form-data с zip архивом в поле file
+func (h *handler) batch(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for create vpn batch")
+
+	body := &requests.BatchVPNParams{}
+	var archive *zip.Reader
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		var err error
+		if archive, err = bindBatchMultipart(w, r, body); err != nil {
+			logrus.Error(err)
+			render.JSON(w, r, responses.OutputErrorData(err))
+			return
+		}
+	} else if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	creds, credsName, err := h.resolveCredentials(body.Credentials, &credentials.Credentials{
+		User:         body.User,
+		Password:     body.Password,
+		CertPassword: body.CertPassword,
+	})
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	newItem := func(source string) *vpn.BatchItem {
+		return &vpn.BatchItem{Source: source, Options: &vpn.Options{
+			Type:            body.Type,
+			Name:            body.Name,
+			Country:         body.Country,
+			Tags:            body.Tags,
+			Credentials:     creds,
+			CredentialsName: credsName,
+		}}
+	}
+
+	paths := body.Paths
+	if body.Glob != "" {
+		matches, err := vpn.GlobConfigs(body.Glob)
+		if err != nil {
+			render.JSON(w, r, responses.OutputErrorData(err))
+			return
+		}
+		paths = append(paths, matches...)
+	}
+
+	var files []*zip.File
+	if archive != nil {
+		files = archiveFiles(archive)
+	}
+
+	// шаблон имени проверяется до сохранения конфигураций из архива в библиотеку
+	if err := body.ValidateName(len(body.Configs) + len(paths) + len(files)); err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	items := make([]*vpn.BatchItem, 0)
+
+	for _, name := range body.Configs {
+		item := newItem(name)
+		items = append(items, item)
+
+		cfg, err := h.library.Get(name)
+		if err != nil {
+			item.Fail(err)
+			continue
+		}
+		h.applyConfig(item, cfg)
+	}
+
+	for _, path := range paths {
+		item := newItem(path)
+		item.Options.Path = path
+		if item.Options.Type == "" {
+			item.Options.Type = vpn.TypeByExtension(path)
+		}
+		items = append(items, item)
+	}
+
+	archiveItems, imported := h.archiveItems(files, body, newItem)
+	items = append(items, archiveItems...)
+
+	concurrency := body.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+
+	res, err := h.manager.CreateBatch(items, concurrency, body.Rollback)
+	if err != nil {
+		if body.Rollback {
+			h.removeImported(imported)
+		}
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	if body.Rollback && res.Failed > 0 {
+		h.removeImported(imported)
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for create vpn batch")
+}
+
+// Путь, тип, страна и метки конфигурации из библиотеки, если они не указаны в запросе
+func (h *handler) applyConfig(item *vpn.BatchItem, cfg *library.Config) {
+	opts := item.Options
+
+	if opts.Type != "" && opts.Type != cfg.Type {
+		item.Fail(fmt.Errorf("Config %s is a %s config", cfg.Name, cfg.Type))
+		return
+	}
+
+	opts.Type = cfg.Type
+	opts.Path = h.library.Path(cfg)
+	if opts.Country == "" {
+		opts.Country = cfg.Country
+	}
+	if opts.Tags == nil {
+		opts.Tags = cfg.Tags
+	}
+}
+
+// Файлы конфигураций в архиве
+func archiveFiles(archive *zip.Reader) []*zip.File {
+	files := make([]*zip.File, 0, len(archive.File))
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") || vpn.TypeByExtension(file.Name) == "" {
+			continue
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// Сохранение конфигураций из архива в библиотеку, каждый файл становится элементом пакета.
+// Возвращает также имена конфигураций, которых не было в библиотеке до пакета
+func (h *handler) archiveItems(files []*zip.File, body *requests.BatchVPNParams,
+	newItem func(source string) *vpn.BatchItem) ([]*vpn.BatchItem, map[*vpn.BatchItem]string) {
+
+	items := make([]*vpn.BatchItem, 0, len(files))
+	imported := make(map[*vpn.BatchItem]string)
+
+	names := archiveNames(files)
+	count := make(map[string]int, len(names))
+	for _, name := range names {
+		count[name]++
+	}
+
+	for i, file := range files {
+		item := newItem(file.Name)
+		items = append(items, item)
+
+		name := names[i]
+		if name == "" {
+			item.Fail(fmt.Errorf("Cannot derive a config name from %s", file.Name))
+			continue
+		}
+		if count[name] > 1 {
+			item.Fail(fmt.Errorf("Config name %s is derived from several files in the archive", name))
+			continue
+		}
+
+		data, err := readArchiveFile(file)
+		if err != nil {
+			item.Fail(err)
+			continue
+		}
+
+		_, err = h.library.Get(name)
+		existed := err == nil
+
+		cfg, err := h.library.Add(&library.Options{
+			Name:     name,
+			Type:     body.Type,
+			FileName: path.Base(file.Name),
+			Country:  body.Country,
+			Tags:     body.Tags,
+		}, data)
+		if err != nil {
+			item.Fail(err)
+			continue
+		}
+		if !existed {
+			imported[item] = cfg.Name
+		}
+
+		h.applyConfig(item, cfg)
+	}
+
+	return items, imported
+}
+
+// Имена конфигураций из путей файлов в архиве без общего для всех файлов каталога:
+// configs/jp/01.ovpn и configs/us/01.ovpn становятся jp-01 и us-01
+func archiveNames(files []*zip.File) []string {
+	prefix := ""
+	if len(files) > 0 {
+		dir := path.Dir(files[0].Name)
+		for _, file := range files[1:] {
+			for dir != "." && dir != "/" && !strings.HasPrefix(file.Name, dir+"/") {
+				dir = path.Dir(dir)
+			}
+		}
+		if dir != "." && dir != "/" {
+			prefix = dir + "/"
+		}
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = library.NameFromPath(strings.TrimPrefix(file.Name, prefix))
+	}
+
+	return names
+}
+
+// Удаление из библиотеки конфигураций, сохранённых из архива, при откате пакета.
+// Конфигурации туннелей, которые не удалось откатить, остаются
+func (h *handler) removeImported(imported map[*vpn.BatchItem]string) {
+	for item, name := range imported {
+		if item.Status == vpn.BatchCreated {
+			continue
+		}
+		if err := h.library.Delete(name); err != nil {
+			logrus.Errorf("Rollback of config %s failed: %s", name, err)
+		}
+	}
+}
+
+// Чтение файла из архива с ограничением размера
+func readArchiveFile(file *zip.File) ([]byte, error) {
+	r, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, library.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > library.MaxSize {
+		return nil, fmt.Errorf("Config is larger than %d bytes", library.MaxSize)
+	}
+
+	return data, nil
+}
+
+// Заполнение параметров из multipart/form-data, возвращает загруженный архив
+func bindBatchMultipart(w http.ResponseWriter, r *http.Request, body *requests.BatchVPNParams) (*zip.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxArchiveSize+64*1024)
+
+	if err := r.ParseMultipartForm(maxArchiveSize); err != nil {
+		return nil, err
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("file: %s", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("file: invalid zip archive: %s", err)
+	}
+
+	body.Archive = true
+	body.Type = r.FormValue("type")
+	body.Name = r.FormValue("name")
+	body.Country = r.FormValue("country")
+	body.Credentials = r.FormValue("credentials")
+	body.User = r.FormValue("user")
+	body.Password = r.FormValue("password")
+	body.CertPassword = r.FormValue("cert_password")
+	body.Rollback = r.FormValue("rollback") == "true"
+	if value := r.FormValue("concurrency"); value != "" {
+		if body.Concurrency, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("concurrency: must be a number")
+		}
+	}
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			body.Tags = append(body.Tags, tag)
+		}
+	}
+
+	return archive, body.Bind(r)
+}
@@ -0,0 +1,51 @@
+package vpn
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{name: "flat", files: []string{"us-nyc-01.ovpn", "de.conf"}, want: []string{"us-nyc-01", "de"}},
+		{name: "same basename in different directories", files: []string{"jp/01.ovpn", "us/01.ovpn"},
+			want: []string{"jp-01", "us-01"}},
+		{name: "common directory is dropped", files: []string{"configs/jp/01.ovpn", "configs/us/01.ovpn"},
+			want: []string{"jp-01", "us-01"}},
+		{name: "single file in directory", files: []string{"configs/nl 1.ovpn"}, want: []string{"nl-1"}},
+		{name: "common prefix is not a directory", files: []string{"us-east/a.ovpn", "us-west/a.ovpn"},
+			want: []string{"us-east-a", "us-west-a"}},
+		{name: "duplicates", files: []string{"a b.ovpn", "a_b.ovpn", "a-b.ovpn", "__MACOSX/a-b.ovpn", "readme.txt"},
+			want: []string{"a-b", "a_b", "a-b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := zip.NewWriter(buf)
+			for _, name := range tt.files {
+				if _, err := w.Create(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := archiveNames(archiveFiles(archive)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,75 +5,86 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/proxy"
 	"net/http"
-	"vpntoproxy/internal/config"
-	"vpntoproxy/internal/docker"
-	"vpntoproxy/internal/network"
+	"strconv"
+	"time"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/ovpn"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/rotation"
 	"vpntoproxy/internal/vpn"
 	"vpntoproxy/pkg/requests"
 	"vpntoproxy/pkg/responses"
 )
 
-// Обработка запроса на получение списка контейнеров
-func list(w http.ResponseWriter, r *http.Request) {
-	// TODO: middleware for log
+// Обработчик запросов vpn, получает менеджер туннелей при создании роутера
+type handler struct {
+	manager     *vpn.Manager
+	library     *library.Library
+	credentials *credentials.Store
+	providers   *provider.Registry
+	rotation    *rotation.Resolver
+}
 
-	logrus.Debug(">>> Starting handler for get container list")
+// Обработка запроса на получение списка туннелей
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	// TODO: middleware for log
 
-	cli, err := docker.New()
-	if err != nil {
-		render.JSON(w, r, responses.OutputErrorData(err))
-		return
-	}
+	logrus.Debug(">>> Starting handler for get tunnel list")
 
-	containers, err := cli.ContainersVPNList()
+	tunnels, err := h.manager.List()
 	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
-	logrus.Debug("Containers list provided successfully")
+	logrus.Debug("Tunnels list provided successfully")
 
-	render.JSON(w, r, responses.OutputSuccessData(containers))
+	render.JSON(w, r, responses.OutputSuccessData(tunnels))
 
-	logrus.Debug("<<< Ending handler for get container list")
+	logrus.Debug("<<< Ending handler for get tunnel list")
 }
 
-func detail(w http.ResponseWriter, r *http.Request) {
-	logrus.Debug(">>> Starting handler for get container detail")
+// Принятие в реестр контейнеров с образом vpn без меток vpntoproxy
+func (h *handler) adopt(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for adopt containers")
 
-	id := chi.URLParam(r, "ID")
-	if id == "" {
-		errMsg := "ID is empty"
-		logrus.Error(errMsg)
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
+	tunnels, err := h.manager.Adopt()
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
-	logrus.Debug("Container ID: ", id)
+	render.JSON(w, r, responses.OutputSuccessData(tunnels))
 
-	cli, err := docker.New()
-	if err != nil {
-		render.JSON(w, r, responses.OutputErrorData(err))
+	logrus.Debug("<<< Ending handler for adopt containers")
+}
+
+func (h *handler) detail(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for get tunnel detail")
+
+	tunnel, ok := h.tunnel(w, r, chi.URLParam(r, "ID"))
+	if !ok {
 		return
 	}
 
-	container, err := cli.GetContainerByID(id)
+	info, err := h.manager.Info(tunnel)
 	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
-	logrus.Debug("Containers detail provided successfully")
+	logrus.Debug("Tunnel detail provided successfully")
 
-	render.JSON(w, r, responses.OutputSuccessData(container))
+	render.JSON(w, r, responses.OutputSuccessData(info))
 
-	logrus.Debug("<<< Ending handler for get container detail")
+	logrus.Debug("<<< Ending handler for get tunnel detail")
 }
 
 // Обработка запроса на создание vpn
-func create(w http.ResponseWriter, r *http.Request) {
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug(">>> Starting handler for create vpn")
 
 	body := &requests.CreateVPNParams{}
@@ -83,13 +94,83 @@ func create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logrus.Debug("Path: ", body.Path)
+	opts := &vpn.Options{
+		Provider:   body.Provider,
+		Type:       body.Type,
+		Path:       body.Path,
+		Name:       body.Name,
+		OnConflict: body.OnConflict,
+		Country:    body.Country,
+		Tags:       body.Tags,
+	}
+
+	var cfg *library.Config
+	var err error
+	providerCredentials := ""
+	switch {
+	case body.Config != "":
+		cfg, err = h.library.Get(body.Config)
+	case body.Provider != "":
+		cfg, providerCredentials, err = h.providerConfig(body)
+	}
+	if verr, ok := err.(*ovpn.ValidationError); ok {
+		render.JSON(w, r, responses.OutputErrorDetails(verr, verr.Issues))
+		return
+	}
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
 
-	info, err := vpn.Create(body.Path)
+	// страна и метки конфигурации из библиотеки используются, если не указаны в запросе
+	if cfg != nil {
+		if opts.Type != "" && opts.Type != cfg.Type {
+			render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Config %s is a %s config", cfg.Name, cfg.Type)))
+			return
+		}
+
+		opts.Type = cfg.Type
+		opts.Path = h.library.Path(cfg)
+		if opts.Country == "" {
+			opts.Country = cfg.Country
+		}
+		if opts.Tags == nil {
+			opts.Tags = cfg.Tags
+		}
+	}
+
+	// без учётных данных в запросе используется набор из описания провайдера, WireGuard их не использует
+	if body.Credentials == "" && body.User == "" && body.CertPassword == "" && opts.Type != vpn.TypeWireGuard {
+		body.Credentials = providerCredentials
+	}
+
+	opts.Credentials, opts.CredentialsName, err = h.resolveCredentials(body.Credentials, &credentials.Credentials{
+		User:         body.User,
+		Password:     body.Password,
+		CertPassword: body.CertPassword,
+	})
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	logrus.Debug("Path: ", opts.Path)
+
+	info, err := h.manager.Create(opts)
+	if verr, ok := err.(*ovpn.ValidationError); ok {
+		logrus.Debug("Error, invalid vpn config")
+		render.JSON(w, r, responses.OutputErrorDetails(verr, verr.Issues))
+		return
+	}
+	if nerr, ok := err.(*vpn.NameError); ok {
+		logrus.Debug("Error, invalid or used tunnel name")
+		render.JSON(w, r, responses.OutputErrorData(nerr))
+		return
+	}
 	if err != nil {
 		errMsg := "Не удалось создать vpn"
 		logrus.Debug("Error, cannot create config for vpn")
-		logrus.Error(errMsg)
+		logrus.Error(errMsg, ": ", err)
 		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
 		return
 	}
@@ -100,35 +181,91 @@ func create(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("<<< Ending handler for create vpn")
 }
 
-// Обработка запроса на удаление vpn
-func del(w http.ResponseWriter, r *http.Request) {
-	logrus.Debug(">>> Starting handler for delete vpn")
+// Учётные данные из сохранённого набора name или переданные в запросе.
+// Возвращает данные и имя набора, сами данные не попадают в журнал
+func (h *handler) resolveCredentials(name string, creds *credentials.Credentials) (*credentials.Credentials, string, error) {
+	if name == "" {
+		return creds, "", nil
+	}
 
-	id := chi.URLParam(r, "ID")
-	if id == "" {
-		errMsg := "ID is empty"
-		logrus.Error(errMsg)
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
-		return
+	set, err := h.credentials.Get(name)
+	if err != nil {
+		return nil, "", err
 	}
 
-	logrus.Debug("Container ID: ", id)
+	return &set.Credentials, set.Name, nil
+}
 
-	cli, err := docker.New()
+// Загрузка конфигурации выбранного сервера провайдера в библиотеку.
+// Возвращает конфигурацию и имя набора учётных данных провайдера
+func (h *handler) providerConfig(body *requests.CreateVPNParams) (*library.Config, string, error) {
+	server, err := h.providers.Pick(body.Provider, &provider.Filter{
+		Country: body.Country,
+		City:    body.City,
+		Server:  body.Server,
+	})
 	if err != nil {
-		render.JSON(w, r, responses.OutputErrorData(err))
+		return nil, "", err
+	}
+
+	logrus.Debugf("Provider %s: server %s selected", body.Provider, server.ID)
+
+	cfg, err := h.rotation.ServerConfig(body.Provider, server)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, def, err := h.providers.Get(body.Provider)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cfg, def.Credentials, nil
+}
+
+// Обработка запроса на изменение страны и меток vpn
+func (h *handler) update(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for update vpn")
+
+	tunnel, ok := h.tunnel(w, r, chi.URLParam(r, "ID"))
+	if !ok {
 		return
 	}
 
-	if _, err := cli.Kill(id); err != nil {
+	body := &requests.UpdateVPNParams{}
+	if err := render.Bind(r, body); err != nil {
+		logrus.Error(err)
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
-	if _, err := cli.Remove(id); err != nil {
+
+	tunnel, err := h.manager.Label(tunnel, body.Country, body.Tags)
+	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
+	render.JSON(w, r, responses.OutputSuccessData(tunnel))
+
+	logrus.Debug("<<< Ending handler for update vpn")
+}
+
+// Обработка запроса на удаление vpn
+func (h *handler) del(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for delete vpn")
+
+	tunnel, ok := h.tunnel(w, r, chi.URLParam(r, "ID"))
+	if !ok {
+		return
+	}
+
+	force := r.URL.Query().Get("force") == "true"
+
+	if err := h.manager.Delete(tunnel, force); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
 	logrus.Debug("The vpn was deleted succesfully")
 
 	render.JSON(w, r, responses.OutputSuccessData(nil))
@@ -136,30 +273,86 @@ func del(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug("<<< Ending handler for delete vpn")
 }
 
-func checkVpn(w http.ResponseWriter, r *http.Request) {
-	logrus.Debug(">>> Starting handler for check vpn container")
+// Остановка туннеля, ?timeout= задаёт время ожидания в секундах
+func (h *handler) stop(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for stop vpn")
 
-	var id string
+	h.lifecycle(w, r, func(t *registry.Tunnel, timeout time.Duration) (*registry.Tunnel, error) {
+		return h.manager.Stop(t, timeout)
+	})
 
-	q := r.URL.Query()
-	if v, ok := q["id"]; !ok || v[0] == "" {
-		errMsg := "ID is empty"
-		logrus.Error(errMsg)
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
+	logrus.Debug("<<< Ending handler for stop vpn")
+}
+
+// Запуск остановленного туннеля
+func (h *handler) start(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for start vpn")
+
+	h.lifecycle(w, r, func(t *registry.Tunnel, _ time.Duration) (*registry.Tunnel, error) {
+		return h.manager.Start(t)
+	})
+
+	logrus.Debug("<<< Ending handler for start vpn")
+}
+
+// Перезапуск туннеля, ?timeout= задаёт время ожидания остановки в секундах
+func (h *handler) restart(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for restart vpn")
+
+	h.lifecycle(w, r, func(t *registry.Tunnel, timeout time.Duration) (*registry.Tunnel, error) {
+		if err := h.manager.Restart(t, timeout); err != nil {
+			return nil, err
+		}
+		// перезапущенный вручную туннель снова должен работать и проверяться
+		return h.manager.Start(t)
+	})
+
+	logrus.Debug("<<< Ending handler for restart vpn")
+}
+
+// Выполнение действия над туннелем из URL и ответ его сведениями
+func (h *handler) lifecycle(w http.ResponseWriter, r *http.Request,
+	action func(t *registry.Tunnel, timeout time.Duration) (*registry.Tunnel, error)) {
+
+	tunnel, ok := h.tunnel(w, r, chi.URLParam(r, "ID"))
+	if !ok {
 		return
-	} else {
-		id = v[0]
 	}
 
-	logrus.Debug("Container ID: ", id)
+	var timeout time.Duration
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("timeout: must be a number of seconds")))
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	updated, err := action(tunnel, timeout)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
 
-	cli, err := docker.New()
+	info, err := h.manager.Info(updated)
 	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
-	ok, err := cli.CheckVPN(id)
+	render.JSON(w, r, responses.OutputSuccessData(info))
+}
+
+func (h *handler) checkVpn(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for check vpn container")
+
+	tunnel, ok := h.tunnel(w, r, r.URL.Query().Get("id"))
+	if !ok {
+		return
+	}
+
+	ok, err := h.manager.CheckVPN(tunnel)
 	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
@@ -170,83 +363,64 @@ func checkVpn(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		render.JSON(w, r, responses.OutputSuccessData(nil))
 	} else {
-		render.JSON(w, r, responses.OutputErrorData(nil))
+		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Vpn is not connected")))
 	}
 
 	logrus.Debug("<<< Ending handler for check vpn container")
 }
 
-func checkProxy(w http.ResponseWriter, r *http.Request) {
+func (h *handler) checkProxy(w http.ResponseWriter, r *http.Request) {
 	logrus.Debug(">>> Starting handler for check proxy container")
 
-	var id string
-
-	q := r.URL.Query()
-	if v, ok := q["id"]; !ok || v[0] == "" {
-		errMsg := "ID is empty"
-		logrus.Error(errMsg)
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
-		return
-	} else {
-		id = v[0]
-	}
-
-	logrus.Debug("Container ID: ", id)
-
-	cli, err := docker.New()
-	if err != nil {
-		render.JSON(w, r, responses.OutputErrorData(err))
+	tunnel, ok := h.tunnel(w, r, r.URL.Query().Get("id"))
+	if !ok {
 		return
 	}
 
-	container, err := cli.GetContainerByID(id)
+	res, err := h.manager.CheckProxy(tunnel)
 	if err != nil {
+		// при неудачной проверке, в том числе при утечке, клиент получает найденные IP и задержку
+		if res != nil {
+			render.JSON(w, r, responses.OutputErrorDetails(err, res))
+			return
+		}
 		render.JSON(w, r, responses.OutputErrorData(err))
 		return
 	}
 
-	if container == nil {
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Container not found")))
-		return
-	}
+	logrus.Debug("Proxy checked successfully")
 
-	conf := config.Get()
+	render.JSON(w, r, responses.OutputSuccessData(res))
 
-	if container.Image != conf.Docker.ImageName {
-		err = fmt.Errorf("Container image is not %s", conf.Docker.ImageName)
-		render.JSON(w, r, responses.OutputErrorData(err))
-		return
-	}
+	logrus.Debug("<<< Ending handler for check proxy container")
+}
 
-	if len(container.Ports) < 1 {
-		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf("Empty container exposed ports")))
-		return
+// Поиск туннеля по идентификатору туннеля или контейнера, при ошибке отправляет ответ
+func (h *handler) tunnel(w http.ResponseWriter, r *http.Request, id string) (*registry.Tunnel, bool) {
+	if id == "" {
+		errMsg := "ID is empty"
+		logrus.Error(errMsg)
+		render.JSON(w, r, responses.OutputErrorData(fmt.Errorf(errMsg)))
+		return nil, false
 	}
 
-	proxyStr := fmt.Sprintf(
-		"%s:%d",
-		container.Ports[0].IP,
-		container.Ports[0].PublicPort,
-	)
+	logrus.Debug("Tunnel ID: ", id)
 
-	proxyAuth := proxy.Auth{
-		User:     conf.Docker.ProxyUser,
-		Password: conf.Docker.ProxyPassword,
-	}
-
-	ok, err := network.TestSuccessOfRequest(proxyStr, &proxyAuth, conf.Proxy.TestURL)
+	tunnel, err := h.manager.Find(id)
 	if err != nil {
 		render.JSON(w, r, responses.OutputErrorData(err))
-		return
+		return nil, false
 	}
 
-	logrus.Debug("Proxy checked successfully")
+	return tunnel, true
+}
 
-	if ok {
-		render.JSON(w, r, responses.OutputSuccessData(nil))
-	} else {
-		render.JSON(w, r, responses.OutputErrorData(nil))
+// Ответ ошибкой, действие над туннелем во время смены его сервера отклоняется с кодом 409
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+	case *vpn.RotatingError, *vpn.StoppedError:
+		render.Status(r, http.StatusConflict)
 	}
 
-	logrus.Debug("<<< Ending handler for check proxy container")
+	render.JSON(w, r, responses.OutputErrorData(err))
 }
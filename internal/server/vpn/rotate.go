@@ -0,0 +1,63 @@
+package vpn
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/pkg/requests"
+	"vpntoproxy/pkg/responses"
+)
+
+// Обработка запроса на смену сервера туннеля.
+// Новая конфигурация берётся из списка configs или paths, из конфигураций библиотеки с меткой tag
+// или у провайдера, по умолчанию у провайдера, у которого создан туннель
+func (h *handler) rotate(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug(">>> Starting handler for rotate vpn")
+
+	tunnel, ok := h.tunnel(w, r, chi.URLParam(r, "ID"))
+	if !ok {
+		return
+	}
+
+	body := &requests.RotateVPNParams{}
+	// тело запроса необязательно
+	if r.ContentLength != 0 {
+		if err := render.Bind(r, body); err != nil {
+			logrus.Error(err)
+			render.JSON(w, r, responses.OutputErrorData(err))
+			return
+		}
+	}
+
+	targets, err := h.rotation.Targets(tunnel, &rotation.Source{
+		Configs:  body.Configs,
+		Paths:    body.Paths,
+		Dir:      body.Dir,
+		Tag:      body.Tag,
+		Provider: body.Provider,
+		Country:  body.Country,
+		City:     body.City,
+		Attempts: body.Attempts,
+	})
+	if err != nil {
+		render.JSON(w, r, responses.OutputErrorData(err))
+		return
+	}
+
+	res, err := h.manager.Rotate(tunnel, targets)
+	if err != nil {
+		logrus.Error(err)
+		if res != nil {
+			render.JSON(w, r, responses.OutputErrorDetails(err, res.Attempts))
+			return
+		}
+		renderError(w, r, err)
+		return
+	}
+
+	render.JSON(w, r, responses.OutputSuccessData(res))
+
+	logrus.Debug("<<< Ending handler for rotate vpn")
+}
@@ -3,18 +3,32 @@ package vpn
 import (
 	"github.com/go-chi/chi"
 	"net/http"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/library"
+	"vpntoproxy/internal/provider"
+	"vpntoproxy/internal/rotation"
+	"vpntoproxy/internal/vpn"
 )
 
-func Router() http.Handler {
+func Router(manager *vpn.Manager, lib *library.Library, creds *credentials.Store, providers *provider.Registry) http.Handler {
 	r := chi.NewRouter()
+	h := &handler{manager: manager, library: lib, credentials: creds, providers: providers,
+		rotation: rotation.New(lib, providers)}
 
-	r.Get("/", list)
-	r.Get("/{ID}", detail)
-	r.Post("/", create)
-	r.Delete("/{ID}", del)
+	r.Get("/", h.list)
+	r.Get("/{ID}", h.detail)
+	r.Post("/", h.create)
+	r.Post("/batch", h.batch)
+	r.Post("/adopt", h.adopt)
+	r.Patch("/{ID}", h.update)
+	r.Delete("/{ID}", h.del)
+	r.Post("/{ID}/stop", h.stop)
+	r.Post("/{ID}/start", h.start)
+	r.Post("/{ID}/restart", h.restart)
+	r.Post("/{ID}/rotate", h.rotate)
 
-	r.Get("/checkVpn", checkVpn)
-	r.Get("/checkProxy", checkProxy)
+	r.Get("/checkVpn", h.checkVpn)
+	r.Get("/checkProxy", h.checkProxy)
 
 	return r
 }
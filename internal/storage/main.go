@@ -0,0 +1,104 @@
+// пакет хранения данных приложения во встроенной базе bbolt
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Ошибка отсутствия записи в хранилище
+var ErrNotFound = fmt.Errorf("Record not found")
+
+type Storage struct {
+	db *bolt.DB
+}
+
+// Открытие (создание) файла базы данных
+func Open(path string) (*Storage, error) {
+	logrus.Debug(">>> Starting open storage")
+	logrus.Debug("Storage path: ", path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		logrus.Debug("Error open storage")
+		return nil, err
+	}
+
+	logrus.Debug("<<< Ending open storage")
+
+	return &Storage{db: db}, nil
+}
+
+// Закрытие базы данных
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Сохранение значения в виде json по ключу
+func (s *Storage) Put(bucket string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Получение значения по ключу, при отсутствии возвращается ErrNotFound
+func (s *Storage) Get(bucket string, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		data := b.Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		return json.Unmarshal(data, v)
+	})
+}
+
+// Удаление значения по ключу
+func (s *Storage) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// Перебор всех значений раздела в порядке ключей
+func (s *Storage) List(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"vpntoproxy/internal/ovpn"
+)
+
+// Результаты создания туннеля в пакете
+const (
+	BatchCreated    = "created"
+	BatchSkipped    = "skipped"
+	BatchFailed     = "failed"
+	BatchRolledBack = "rolled_back"
+)
+
+// Элемент пакетного создания туннелей
+type BatchItem struct {
+	// путь, имя конфигурации или имя файла в архиве
+	Source string       `json:"source"`
+	Status string       `json:"status"`
+	Tunnel *Info        `json:"tunnel,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Issues []ovpn.Issue `json:"issues,omitempty"`
+	// параметры создания, элемент с заполненным Status не создаётся
+	Options *Options `json:"-"`
+}
+
+// Результат пакетного создания туннелей
+type BatchResult struct {
+	Created    int          `json:"created"`
+	Skipped    int          `json:"skipped"`
+	Failed     int          `json:"failed"`
+	RolledBack int          `json:"rolled_back"`
+	Items      []*BatchItem `json:"items"`
+}
+
+// Отметка элемента как неудавшегося
+func (item *BatchItem) Fail(err error) {
+	item.Status = BatchFailed
+	item.Error = err.Error()
+	if verr, ok := err.(*ovpn.ValidationError); ok {
+		item.Issues = verr.Issues
+	}
+}
+
+// Пакетное создание туннелей не более чем concurrency одновременно.
+// Конфигурации, уже используемые туннелями или повторяющиеся в пакете, пропускаются.
+// При rollback и хотя бы одной ошибке созданные в пакете туннели удаляются
+func (m *Manager) CreateBatch(items []*BatchItem, concurrency int, rollback bool) (*BatchResult, error) {
+	logrus.Debugf(">>> Starting create batch of %d tunnels", len(items))
+
+	tunnels, err := m.registry.List()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]string, len(tunnels))
+	for _, t := range tunnels {
+		used[t.ConfigPath] = t.ID
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item.Status != "" {
+			continue
+		}
+
+		path := item.Options.Path
+		if id, ok := used[path]; ok {
+			item.Status = BatchSkipped
+			item.Error = fmt.Sprintf("Config is already used by tunnel %s", id)
+			continue
+		}
+		if seen[path] {
+			item.Status = BatchSkipped
+			item.Error = "Duplicate config in batch"
+			continue
+		}
+		seen[path] = true
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item *BatchItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			info, err := m.Create(item.Options)
+			if err != nil {
+				item.Fail(err)
+				return
+			}
+
+			item.Status = BatchCreated
+			item.Tunnel = info
+		}(item)
+	}
+
+	wg.Wait()
+
+	res := &BatchResult{Items: items}
+	for _, item := range items {
+		if item.Status == BatchFailed {
+			res.Failed++
+		}
+	}
+
+	if rollback && res.Failed > 0 {
+		for _, item := range items {
+			if item.Status != BatchCreated {
+				continue
+			}
+
+			if err := m.Delete(item.Tunnel.Tunnel, true); err != nil {
+				logrus.Errorf("Rollback of tunnel %s failed: %s", item.Tunnel.ID, err)
+				item.Error = "Rollback failed: " + err.Error()
+				continue
+			}
+
+			item.Status = BatchRolledBack
+			item.Tunnel = nil
+		}
+	}
+
+	for _, item := range items {
+		switch item.Status {
+		case BatchCreated:
+			res.Created++
+		case BatchSkipped:
+			res.Skipped++
+		case BatchRolledBack:
+			res.RolledBack++
+		}
+	}
+
+	logrus.Debugf("<<< Ending create batch: %d created, %d skipped, %d failed, %d rolled back",
+		res.Created, res.Skipped, res.Failed, res.RolledBack)
+
+	return res, nil
+}
@@ -0,0 +1,139 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/network"
+	"vpntoproxy/internal/registry"
+)
+
+// Результат проверки прокси туннеля
+type ProxyCheck struct {
+	ExitIP         string `json:"exit_ip"`
+	DirectIP       string `json:"direct_ip,omitempty"`
+	Latency        int64  `json:"latency_ms"`
+	StatusCode     int    `json:"status_code"`
+	ExpectedRemote string `json:"expected_remote,omitempty"`
+}
+
+// Запись результата в проверку, сохраняемую в реестре
+func (c *ProxyCheck) apply(t *registry.Tunnel, check *registry.Check) {
+	if c != nil {
+		check.ExitIP = c.ExitIP
+		check.Latency = c.Latency
+		check.ExpectedRemote = c.ExpectedRemote
+	}
+
+	t.LastProxyCheck = check
+}
+
+// Запрос внешнего IP через прокси туннеля.
+// Проверка не проходит, если внешний IP совпадает с IP хоста, то есть трафик идёт мимо vpn
+func (m *Manager) checkProxy(t *registry.Tunnel) (*ProxyCheck, error) {
+	_container, err := m.runtime.GetContainerByID(t.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := config.Get()
+
+	if !docker.IsManaged(_container) && !docker.IsVPNImage(_container.Image) {
+		return nil, fmt.Errorf("Container %s is not a vpn container", _container.ID)
+	}
+
+	if t.HostPort == 0 {
+		return nil, fmt.Errorf("Tunnel %s has no proxy port", t.ID)
+	}
+
+	// прокси проверяется по тому же адресу, по которому к нему подключаются шлюз и клиенты экспорта
+	proxyStr := ProxyAddress(t)
+
+	proxyAuth := proxy.Auth{
+		User:     conf.Docker.ProxyUser,
+		Password: conf.Docker.ProxyPassword,
+	}
+
+	res := &ProxyCheck{ExpectedRemote: expectedRemote(t)}
+
+	result, err := network.RequestThroughProxy(proxyStr, &proxyAuth, ipEcho(conf.Proxy.TestURL))
+	if err != nil {
+		return res, err
+	}
+
+	res.StatusCode = result.StatusCode
+	res.ExitIP = result.IP
+	res.Latency = result.Latency.Milliseconds()
+
+	if !result.Success {
+		return res, fmt.Errorf("Unexpected response code %d", result.StatusCode)
+	}
+
+	if conf.Proxy.LeakCheck {
+		direct, err := m.hostIP()
+		if err != nil {
+			// без IP хоста утечку не проверить, но туннель при этом может быть исправен
+			logrus.Warn("Cannot get direct IP of the host: ", err)
+		} else {
+			res.DirectIP = direct
+			if direct == res.ExitIP {
+				return res, fmt.Errorf("Exit IP %s matches direct IP of the host, traffic leaks past vpn", res.ExitIP)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Прямой внешний IP хоста, кэшируется на proxy.direct_cache_ttl
+func (m *Manager) hostIP() (string, error) {
+	m.directMu.Lock()
+	defer m.directMu.Unlock()
+
+	conf := config.Get().Proxy
+
+	if m.directIP != "" && time.Since(m.directAt) < time.Duration(conf.DirectCacheTTL)*time.Second {
+		return m.directIP, nil
+	}
+
+	url := conf.DirectURL
+	if url == "" {
+		url = conf.TestURL
+	}
+
+	ip, err := network.DirectIP(ipEcho(url))
+	if err != nil {
+		return "", err
+	}
+
+	m.directIP = ip
+	m.directAt = time.Now()
+
+	return ip, nil
+}
+
+// Сервис внешнего IP с настройками из конфигурации
+func ipEcho(url string) *network.IPEcho {
+	conf := config.Get().Proxy
+
+	return &network.IPEcho{
+		URL:     url,
+		Format:  conf.TestFormat,
+		Field:   conf.TestField,
+		Timeout: time.Duration(conf.TestTimeout) * time.Second,
+	}
+}
+
+// Ожидаемый сервер vpn туннеля
+func expectedRemote(t *registry.Tunnel) string {
+	if t.RemoteHost == "" {
+		return ""
+	}
+
+	return net.JoinHostPort(t.RemoteHost, strconv.Itoa(t.RemotePort))
+}
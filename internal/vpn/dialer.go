@@ -0,0 +1,31 @@
+package vpn
+
+import (
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+)
+
+// Адрес socks5 прокси туннеля на хосте
+func ProxyAddress(t *registry.Tunnel) string {
+	return net.JoinHostPort(config.Get().Proxy.Host, strconv.Itoa(t.HostPort))
+}
+
+// Создание socks5 клиента, соединяющегося через прокси туннеля
+func ProxyDialer(t *registry.Tunnel, forward proxy.Dialer) (proxy.Dialer, error) {
+	if t.HostPort == 0 {
+		return nil, fmt.Errorf("Tunnel %s has no proxy port", t.ID)
+	}
+
+	conf := config.Get()
+
+	auth := &proxy.Auth{
+		User:     conf.Docker.ProxyUser,
+		Password: conf.Docker.ProxyPassword,
+	}
+
+	return proxy.SOCKS5("tcp", ProxyAddress(t), auth, forward)
+}
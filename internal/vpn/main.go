@@ -1,72 +1,59 @@
 package vpn
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/go-connections/nat"
 	"github.com/sirupsen/logrus"
-	"path/filepath"
+	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 	"vpntoproxy/internal/config"
 	"vpntoproxy/internal/docker"
 	"vpntoproxy/internal/network"
 )
 
-// Метод создания vpn прокси-серверов
-func Create(path string) (*types.Container, error) {
+// Метод создания vpn прокси-серверов в контейнере name для туннеля id, прокси публикуется на порту хоста port
+func Create(cli docker.ContainerRuntime, typ Type, id string, path string, name string, port int, secrets *Secrets) (*types.Container, error) {
 	logrus.Debug(">>> Starting create vpn")
-	logrus.Debug("Config path: ", path)
+	logrus.Debug("Tunnel type: ", typ.Name(), " Config path: ", path)
 
 	conf := config.Get()
 
-	cli, err := docker.New()
-	if err != nil {
-		return nil, err
-	}
-
-	//pathToConfigs := conf.Proxy.PathToConfigs
-	//projectDir := config.ProjectDir
-
-	logrus.Debug(
-		"MaxAttempts: ", conf.Docker.MaxAttempts,
-		" StartingPort: ", conf.Proxy.StartingPort,
-		//" PathToConfigs: ", pathToConfigs,
-		//" ProjectDir: ", projectDir,
-	)
-
-	port := network.GetFreePort(conf.Docker.MaxAttempts, conf.Proxy.StartingPort)
-
-	imagesList, err := cli.GetListImages()
-	if err != nil {
-		return nil, err
-	}
-	imagesListStr := strings.Trim(strings.Replace(fmt.Sprint(imagesList), " ", ",", -1), "[]")
+	logrus.Debug("Container name: ", name, " Host port: ", port)
 
-	if !strings.Contains(imagesListStr, conf.Docker.ImageName) {
-		logrus.Debug("Image not exist")
-		im, err := cli.BuildImage(conf.Docker.ImageName, "")
-		if err != nil {
+	spec := typ.Spec(path, secrets)
+	for _, image := range spec.Images {
+		if err := ensureImage(cli, image); err != nil {
 			return nil, err
 		}
-		logrus.Debug("Image: ", im)
-	} else {
-		logrus.Debug("Image ", conf.Docker.ImageName, " exist")
 	}
 
 	_config := &container.Config{
-		Image:        conf.Docker.ImageName,
+		Image:        spec.Images[len(spec.Images)-1].Name,
 		ExposedPorts: network.MakePortSet(conf.Docker.ProxyPort),
 		Env: []string{
 			fmt.Sprintf("PROXY_PORT=%d", conf.Docker.ProxyPort),
 			fmt.Sprintf("PROXY_USER=%s", conf.Docker.ProxyUser),
 			fmt.Sprintf("PROXY_PASSWORD=%s", conf.Docker.ProxyPassword),
 		},
+		Labels: map[string]string{
+			docker.LabelManager:    docker.ManagerName,
+			docker.LabelTunnel:     id,
+			docker.LabelType:       typ.Name(),
+			docker.LabelConfigHash: configHash(path),
+			docker.LabelPort:       strconv.Itoa(port),
+			docker.LabelCreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		},
 	}
 
 	hostConfig := &container.HostConfig{
-		Binds: []string{fmt.Sprintf("%s:/vpn/config.ovpn", path)},
+		Binds: spec.Binds,
 		PortBindings: nat.PortMap{
 			nat.Port(fmt.Sprintf("%d/tcp", conf.Docker.ProxyPort)): []nat.PortBinding{
 				{
@@ -74,11 +61,12 @@ func Create(path string) (*types.Container, error) {
 				},
 			},
 		},
-		CapAdd: []string{"NET_ADMIN"},
-		DNS:    conf.Docker.DNS,
+		CapAdd:  spec.CapAdd,
+		Sysctls: spec.Sysctls,
+		DNS:     conf.Docker.DNS,
 	}
 
-	res, err := cli.RunContainer(_config, hostConfig, filepath.Base(path))
+	res, err := cli.RunContainer(_config, hostConfig, name)
 	if err != nil {
 		return nil, err
 	}
@@ -94,49 +82,49 @@ func Create(path string) (*types.Container, error) {
 	return _container, nil
 }
 
-type TestResp struct {
-	IP string `json:"origin"`
-}
+// Хэш sha256 файла конфигурации, пустая строка если файл не прочитать
+func configHash(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logrus.Error(err)
+		return ""
+	}
 
-// Тестирование vpn проски, проверяет что внешний IP соответствует последнему прокси-серверу
-/*func TestConnection(vpnAddress string, contProxy uint16, testURL string) (bool, error) {
-	log.Debug(">>> Starting test proxychain")
-	log.Debug("Last proxy in chain: ", chainAddress, " Container port: ", contProxy, " Testing URL: ", testURL)
+	sum := sha256.Sum256(data)
 
-	proxyUrl, err := url.Parse(fmt.Sprintf("socks5://0.0.0.0:%d", contProxy))
-	http.DefaultTransport = &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	return hex.EncodeToString(sum[:])
+}
 
-	resp, err := http.Get(testURL)
+// Сборка образа, если его ещё нет
+func ensureImage(cli docker.ContainerRuntime, image Image) error {
+	imagesList, err := cli.GetListImages()
 	if err != nil {
-		log.Debug("Failed get http request")
-		return false, err
+		return err
 	}
-	defer func(){
-		err = resp.Body.Close()
-		log.Error(err)
-	}()
-
-	if resp.StatusCode != 200 {
-		log.Debug("Response code: ", resp.StatusCode, ", request failed")
-		return false, nil
+
+	for _, summary := range imagesList {
+		for _, tag := range summary.RepoTags {
+			if tag == image.Name || strings.TrimSuffix(tag, ":latest") == image.Name {
+				logrus.Debug("Image ", image.Name, " exist")
+				return nil
+			}
+		}
 	}
 
-	_json := TestResp{}
-	err = json.NewDecoder(resp.Body).Decode(&_json)
+	logrus.Debug("Image ", image.Name, " not exist")
+
+	im, err := cli.BuildImage(image.Name, image.Context, image.BuildArgs)
 	if err != nil {
-		log.Debug("Error decode json")
-		return false, err
+		return err
 	}
+	defer im.Body.Close()
 
-	log.Debug("<<< Ending test proxychain")
-
-	if _json.IP == chainAddress {
-		log.Debug("Proxychain passed the test successfully")
-		return true, nil
-	} else {
-		log.Debug("Proxychain failed test")
-		return false, nil
+	// сборка завершается только после чтения всего ответа
+	if _, err := io.Copy(ioutil.Discard, im.Body); err != nil {
+		return err
 	}
 
+	logrus.Debug("Image ", image.Name, " built")
+
+	return nil
 }
-*/
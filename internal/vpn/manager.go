@@ -0,0 +1,687 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/ovpn"
+	"vpntoproxy/internal/registry"
+)
+
+// Менеджер туннелей, связывает реестр туннелей с контейнерами
+type Manager struct {
+	runtime  docker.ContainerRuntime
+	registry *registry.Registry
+	ports    *portAllocator
+	names    *nameAllocator
+
+	// туннели, сервер которых сейчас меняется
+	rotatingMu sync.Mutex
+	rotating   map[string]bool
+	// время плановой смены сервера
+	plan RotationPlan
+
+	// кэш прямого внешнего IP хоста
+	directMu sync.Mutex
+	directIP string
+	directAt time.Time
+}
+
+// Сведения о туннеле вместе с текущим состоянием контейнера
+type Info struct {
+	*registry.Tunnel
+	// нормализованное состояние: creating, connecting, up, degraded, stopped, exited или failed
+	State    string `json:"state"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// ближайшая смена сервера по политике
+	NextRotation *time.Time       `json:"next_rotation,omitempty"`
+	Container    *types.Container `json:"container"`
+}
+
+// Время ближайшей плановой смены сервера туннеля, nil если её нет
+type RotationPlan func(t *registry.Tunnel) *time.Time
+
+// Инициализация менеджера туннелей
+func NewManager(runtime docker.ContainerRuntime, reg *registry.Registry) *Manager {
+	return &Manager{
+		runtime:  runtime,
+		registry: reg,
+		ports:    newPortAllocator(),
+		names:    newNameAllocator(),
+		rotating: make(map[string]bool),
+	}
+}
+
+// Подключение расписания смены серверов для сведений о туннелях
+func (m *Manager) SetRotationPlan(plan RotationPlan) {
+	m.plan = plan
+}
+
+// Получение среды выполнения контейнеров
+func (m *Manager) Runtime() docker.ContainerRuntime {
+	return m.runtime
+}
+
+// Получение реестра туннелей
+func (m *Manager) Registry() *registry.Registry {
+	return m.registry
+}
+
+// Параметры создания туннеля
+type Options struct {
+	// тип туннеля, по умолчанию OpenVPN
+	Type string
+	Path string
+	// имя или шаблон имени туннеля, по умолчанию docker.name_template
+	Name string
+	// действие при совпадении имени с существующим туннелем: fail, reuse или replace
+	OnConflict string
+	Country    string
+	Tags       []string
+	// учётные данные vpn и имя сохранённого набора, из которого они взяты
+	Credentials     *credentials.Credentials
+	CredentialsName string
+	// провайдер, сервер которого выбран для туннеля
+	Provider string
+	// пул, которому принадлежит туннель
+	Pool string
+}
+
+// Метод создания туннеля с записью в реестр
+func (m *Manager) Create(opts *Options) (*Info, error) {
+	typ, err := GetType(opts.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := typ.Check(opts.Path, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	name, existing, err := m.reserveName(opts, typ)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && opts.OnConflict == ConflictReuse {
+		logrus.Debug("Tunnel reused: ", existing.ID)
+		return m.Info(existing)
+	}
+	defer m.releaseName(name)
+
+	if existing != nil {
+		logrus.Debug("Replace tunnel: ", existing.ID)
+		if err := m.Delete(existing, false); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := registry.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := m.reservePort(0, "")
+	if err != nil {
+		return nil, err
+	}
+	// после записи в реестр порт занят туннелем
+	defer m.releasePort(port)
+
+	secrets, err := writeSecrets(id, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	_container, err := Create(m.runtime, typ, id, opts.Path, name, port, secrets)
+	if err != nil {
+		if err := removeSecrets(id); err != nil {
+			logrus.Error("Remove tunnel credentials failed: ", err)
+		}
+		return nil, err
+	}
+
+	t := tunnelFromContainer(id, _container)
+	t.Type = typ.Name()
+	t.ConfigPath = opts.Path
+	t.Credentials = opts.CredentialsName
+	t.Provider = opts.Provider
+	t.Pool = opts.Pool
+	setRemote(t, remote)
+	t.Country = strings.ToLower(opts.Country)
+	t.Tags = opts.Tags
+
+	if err := m.registry.Save(t); err != nil {
+		// контейнер без записи в реестре был бы принят при сверке как чужой
+		if err := m.removeContainer(_container.ID, true); err != nil {
+			logrus.Error("Remove container failed: ", err)
+		}
+		if err := removeSecrets(id); err != nil {
+			logrus.Error("Remove tunnel credentials failed: ", err)
+		}
+		return nil, err
+	}
+
+	logrus.Debug("Tunnel registered: ", t.ID)
+
+	info := &Info{Tunnel: t, Container: _container}
+	info.State, info.ExitCode, info.Reason = m.state(t, _container)
+
+	return info, nil
+}
+
+// Изменение страны и меток туннеля, nil означает отсутствие изменений
+func (m *Manager) Label(t *registry.Tunnel, country *string, tags []string) (*registry.Tunnel, error) {
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		if country != nil {
+			t.Country = strings.ToLower(*country)
+		}
+		if tags != nil {
+			t.Tags = tags
+		}
+		return nil
+	})
+}
+
+// Поиск туннеля по идентификатору туннеля или контейнера
+func (m *Manager) Find(id string) (*registry.Tunnel, error) {
+	return m.registry.Lookup(id)
+}
+
+// Получение сведений о туннеле с обновлением наблюдаемого состояния
+func (m *Manager) Info(t *registry.Tunnel) (*Info, error) {
+	_container, _ := m.runtime.GetContainerByID(t.ContainerID)
+
+	observed := observedState(_container)
+	if t.Healing != nil && t.Healing.Failed {
+		observed = registry.StateFailed
+	}
+	if observed != t.ObservedState {
+		updated, err := m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+			t.ObservedState = observed
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		t = updated
+	}
+
+	info := &Info{Tunnel: t, Container: _container}
+	info.State, info.ExitCode, info.Reason = m.state(t, _container)
+	if m.plan != nil {
+		info.NextRotation = m.plan(t)
+	}
+
+	return info, nil
+}
+
+// Получение списка туннелей
+func (m *Manager) List() ([]*Info, error) {
+	tunnels, err := m.registry.List()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*Info, 0, len(tunnels))
+	for _, t := range tunnels {
+		info, err := m.Info(t)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+
+	return res, nil
+}
+
+// Метод удаления туннеля вместе с контейнером.
+// Контейнер сначала останавливается с ожиданием docker.stop_timeout, при force сразу закрывается
+func (m *Manager) Delete(t *registry.Tunnel, force bool) error {
+	logrus.Debug("Delete tunnel: ", t.ID)
+
+	if m.Rotating(t.ID) {
+		return &RotatingError{ID: t.ID}
+	}
+
+	if err := m.removeContainer(t.ContainerID, force); err != nil {
+		return err
+	}
+
+	if err := removeSecrets(t.ID); err != nil {
+		return err
+	}
+
+	return m.registry.Delete(t.ID)
+}
+
+// Остановка и удаление контейнера, если он существует
+func (m *Manager) removeContainer(id string, force bool) error {
+	if id == "" {
+		return nil
+	}
+
+	if force {
+		if _, err := m.runtime.Kill(id); err != nil {
+			// контейнер может быть уже остановлен
+			logrus.Debug("Kill container failed: ", err)
+		}
+	} else if _, err := m.runtime.Stop(id, stopTimeout(0)); err != nil && !docker.IsNotFound(err) {
+		return err
+	}
+
+	if _, err := m.runtime.Remove(id); err != nil && !docker.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Остановка туннеля с сохранением контейнера, порта и конфигурации.
+// Проверки и восстановление остановленного туннеля не выполняются
+func (m *Manager) Stop(t *registry.Tunnel, timeout time.Duration) (*registry.Tunnel, error) {
+	logrus.Debug("Stop tunnel: ", t.ID)
+
+	if m.Rotating(t.ID) {
+		return nil, &RotatingError{ID: t.ID}
+	}
+
+	if _, err := m.runtime.Stop(t.ContainerID, stopTimeout(timeout)); err != nil {
+		return nil, err
+	}
+
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.DesiredState = registry.StateStopped
+		return nil
+	})
+}
+
+// Запуск остановленного туннеля на прежнем порту, состояние восстановления сбрасывается
+func (m *Manager) Start(t *registry.Tunnel) (*registry.Tunnel, error) {
+	logrus.Debug("Start tunnel: ", t.ID)
+
+	if m.Rotating(t.ID) {
+		return nil, &RotatingError{ID: t.ID}
+	}
+
+	if _, err := m.runtime.Start(t.ContainerID); err != nil {
+		return nil, err
+	}
+
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.DesiredState = registry.StateRunning
+		t.Healing = nil
+		t.Failures = 0
+		return nil
+	})
+}
+
+// Время ожидания остановки контейнера, если docker.stop_timeout не задан
+const defaultStopTimeout = 10 * time.Second
+
+// Время ожидания остановки контейнера, по умолчанию docker.stop_timeout
+func stopTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	if seconds := config.Get().Docker.StopTimeout; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultStopTimeout
+}
+
+// Проверка подключения vpn с сохранением результата
+func (m *Manager) CheckVPN(t *registry.Tunnel) (bool, error) {
+	typ, err := GetType(t.Type)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := typ.Ready(m.runtime, t.ContainerID)
+
+	m.saveCheck(t, ok, err, func(t *registry.Tunnel, check *registry.Check) {
+		t.LastVPNCheck = check
+	})
+
+	return ok, err
+}
+
+// Проверка прокси с сохранением результата
+func (m *Manager) CheckProxy(t *registry.Tunnel) (*ProxyCheck, error) {
+	res, err := m.checkProxy(t)
+
+	m.saveCheck(t, err == nil, err, res.apply)
+
+	return res, err
+}
+
+// Полная проверка туннеля (vpn и прокси) с записью в историю здоровья
+func (m *Manager) Probe(t *registry.Tunnel) (*registry.Tunnel, error) {
+	logrus.Debug("Probe tunnel: ", t.ID)
+
+	health := registry.Health{State: registry.HealthUp}
+
+	start := time.Now()
+
+	vpnOk, vpnErr := m.CheckVPN(t)
+	if !vpnOk {
+		health.State = registry.HealthVPNDown
+		if vpnErr != nil {
+			health.Error = vpnErr.Error()
+		}
+	} else {
+		res, err := m.checkProxy(t)
+		m.saveCheck(t, err == nil, err, res.apply)
+
+		if err != nil {
+			health.State = registry.HealthProxyDown
+			health.Error = err.Error()
+		}
+		if res != nil {
+			health.ExitIP = res.ExitIP
+		}
+	}
+
+	health.Latency = time.Since(start).Milliseconds()
+	health.CheckedAt = time.Now()
+
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.AddHealth(health, config.Get().Scheduler.HistorySize)
+		if health.State == registry.HealthUp {
+			t.Failures = 0
+		} else {
+			t.Failures++
+		}
+		return nil
+	})
+}
+
+// Перезапуск контейнера туннеля, timeout 0 означает docker.stop_timeout
+func (m *Manager) Restart(t *registry.Tunnel, timeout time.Duration) error {
+	logrus.Debug("Restart tunnel: ", t.ID)
+
+	if m.Rotating(t.ID) {
+		return &RotatingError{ID: t.ID}
+	}
+
+	_, err := m.runtime.Restart(t.ContainerID, stopTimeout(timeout))
+
+	return err
+}
+
+// Пересоздание контейнера туннеля из исходной конфигурации.
+// Идентификатор туннеля сохраняется, идентификатор контейнера меняется
+func (m *Manager) Recreate(t *registry.Tunnel) (*registry.Tunnel, error) {
+	logrus.Debug("Recreate tunnel: ", t.ID)
+
+	// на время пересоздания туннель недоступен для смены сервера и других действий
+	if !m.beginRotation(t.ID) {
+		return nil, &RotatingError{ID: t.ID}
+	}
+	defer m.endRotation(t.ID)
+
+	if t.ConfigPath == "" {
+		return nil, fmt.Errorf("Tunnel %s has no config path", t.ID)
+	}
+
+	if err := m.removeContainer(t.ContainerID, true); err != nil {
+		return nil, err
+	}
+
+	typ, err := GetType(t.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	// учётные данные остаются в файлах, записанных при создании туннеля
+	secrets, err := loadSecrets(t.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// туннель по возможности остаётся на прежнем порту
+	port, err := m.reservePort(t.HostPort, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer m.releasePort(port)
+
+	_container, err := Create(m.runtime, typ, t.ID, t.ConfigPath, t.Name, port, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.ContainerID = _container.ID
+		t.HostPort = hostPort(_container)
+		t.ObservedState = observedState(_container)
+		return nil
+	})
+}
+
+// Сверка реестра с контейнерами Docker.
+// Контейнеры находятся по меткам vpntoproxy: для пересозданного вне менеджера контейнера
+// обновляется запись туннеля, контейнер без записи восстанавливается в реестре с прежним идентификатором.
+// Контейнеры с образом vpn без меток принимаются только при docker.adopt_unlabeled
+func (m *Manager) Reconcile() error {
+	logrus.Debug(">>> Starting reconcile tunnels")
+
+	containers, err := m.runtime.ContainersVPNList()
+	if err != nil {
+		return err
+	}
+
+	tunnels, err := m.registry.List()
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	byID := make(map[string]*registry.Tunnel)
+	for _, t := range tunnels {
+		known[t.ContainerID] = true
+		byID[t.ID] = t
+	}
+
+	for i := range containers {
+		_container := &containers[i]
+		if known[_container.ID] {
+			continue
+		}
+
+		id := _container.Labels[docker.LabelTunnel]
+		if t, ok := byID[id]; ok {
+			updated, err := m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+				t.ContainerID = _container.ID
+				t.HostPort = hostPort(_container)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			byID[id] = updated
+			logrus.Infof("Tunnel %s is now served by container %s", t.ID, _container.ID)
+			continue
+		}
+
+		typ, err := GetType(_container.Labels[docker.LabelType])
+		if err != nil {
+			typ = typeByImage(_container.Image)
+		}
+		if id == "" {
+			if id, err = registry.NewID(); err != nil {
+				return err
+			}
+		}
+
+		t, err := m.register(id, _container, typ)
+		if err != nil {
+			return err
+		}
+		byID[t.ID] = t
+
+		logrus.Infof("Restored tunnel %s of container %s", t.ID, t.ContainerID)
+	}
+
+	for _, t := range byID {
+		info, err := m.Info(t)
+		if err != nil {
+			return err
+		}
+		if info.DesiredState == registry.StateRunning && info.ObservedState != registry.StateRunning {
+			logrus.Warnf("Tunnel %s (%s) is not running, observed state: %s", t.ID, t.Name, info.ObservedState)
+		}
+	}
+
+	if config.Get().Docker.AdoptUnlabeled {
+		if _, err := m.Adopt(); err != nil {
+			return err
+		}
+	}
+
+	logrus.Debug("<<< Ending reconcile tunnels")
+
+	return nil
+}
+
+// Принятие в реестр контейнеров с образом vpn, созданных без меток vpntoproxy
+// (вручную или прежними версиями). Метки у таких контейнеров появятся после пересоздания
+func (m *Manager) Adopt() ([]*registry.Tunnel, error) {
+	containers, err := m.runtime.UnmanagedVPNList()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnels, err := m.registry.List()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, t := range tunnels {
+		known[t.ContainerID] = true
+	}
+
+	res := make([]*registry.Tunnel, 0)
+	for i := range containers {
+		if known[containers[i].ID] {
+			continue
+		}
+
+		id, err := registry.NewID()
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := m.register(id, &containers[i], typeByImage(containers[i].Image))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+
+		logrus.Infof("Adopted container %s as tunnel %s", t.ContainerID, t.ID)
+	}
+
+	return res, nil
+}
+
+// Запись в реестр туннеля существующего контейнера
+func (m *Manager) register(id string, _container *types.Container, typ Type) (*registry.Tunnel, error) {
+	t := tunnelFromContainer(id, _container)
+	t.Type = typ.Name()
+	for _, mount := range _container.Mounts {
+		if mount.Destination == typ.ConfigMountPath() {
+			t.ConfigPath = mount.Source
+		}
+	}
+	if remote, _ := typ.Check(t.ConfigPath, nil); remote != nil {
+		setRemote(t, remote)
+	}
+
+	if err := m.registry.Save(t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (m *Manager) saveCheck(t *registry.Tunnel, ok bool, checkErr error,
+	set func(t *registry.Tunnel, check *registry.Check)) {
+
+	check := &registry.Check{Success: ok && checkErr == nil, CheckedAt: time.Now()}
+	if checkErr != nil {
+		check.Error = checkErr.Error()
+	}
+
+	_, err := m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		set(t, check)
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// Формирование записи о туннеле по контейнеру
+func tunnelFromContainer(id string, _container *types.Container) *registry.Tunnel {
+	t := &registry.Tunnel{
+		ID:            id,
+		ContainerID:   _container.ID,
+		HostPort:      hostPort(_container),
+		DesiredState:  registry.StateRunning,
+		ObservedState: observedState(_container),
+		CreatedAt:     time.Unix(_container.Created, 0),
+	}
+
+	if len(_container.Names) > 0 {
+		t.Name = strings.TrimPrefix(_container.Names[0], "/")
+	}
+
+	return t
+}
+
+// Опубликованный на хосте порт прокси. У остановленного контейнера Docker не отдаёт порты,
+// тогда порт берётся из метки, записанной при создании
+func hostPort(_container *types.Container) int {
+	proxyPort := uint16(config.Get().Docker.ProxyPort)
+
+	for _, port := range _container.Ports {
+		if port.PrivatePort == proxyPort && port.PublicPort != 0 {
+			return int(port.PublicPort)
+		}
+	}
+
+	if port, err := strconv.Atoi(_container.Labels[docker.LabelPort]); err == nil && port > 0 {
+		return port
+	}
+
+	return 0
+}
+
+// Сохранение сервера и протокола из конфигурации vpn
+func setRemote(t *registry.Tunnel, remote *ovpn.Remote) {
+	if remote == nil {
+		return
+	}
+
+	t.RemoteHost = remote.Host
+	t.RemotePort = remote.Port
+	t.Protocol = remote.Proto
+}
+
+func observedState(_container *types.Container) string {
+	if _container == nil {
+		return registry.StateMissing
+	}
+
+	return _container.State
+}
@@ -0,0 +1,385 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/registry"
+	"vpntoproxy/internal/storage"
+)
+
+const testStartingPort = 42000
+
+// Конфигурация читается из ./configs, поэтому тесты работают во временном каталоге
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "vpntoproxy-vpn-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	code := func() int {
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+
+		if err := os.Mkdir(filepath.Join(dir, "configs"), 0755); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if err := os.Chdir(dir); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+
+		cnf := config.Get()
+		cnf.Docker.DryRun = true
+		cnf.Docker.ServicePrefix = "vpn_"
+		cnf.Docker.NameTemplate = "{config}"
+
+		return m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+// Менеджер с хранимой в памяти средой выполнения и диапазоном из size портов
+func newTestManager(t *testing.T, size int) (*Manager, *docker.Fake) {
+	cnf := config.Get().Proxy
+	starting, ending := cnf.StartingPort, cnf.EndingPort
+	cnf.StartingPort, cnf.EndingPort = testStartingPort, testStartingPort+size-1
+	t.Cleanup(func() {
+		cnf.StartingPort, cnf.EndingPort = starting, ending
+	})
+
+	store, err := storage.Open(filepath.Join(t.TempDir(), "vpn.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	runtime := docker.NewFake()
+	m := NewManager(runtime, registry.New(store))
+	// порты проверяются только по реестру и контейнерам, а не на хосте
+	m.ports.available = func(port int) bool { return true }
+
+	return m, runtime
+}
+
+// Файл конфигурации OpenVPN name.ovpn во временном каталоге теста
+func writeConfig(t *testing.T, dir string, name string, extra string) string {
+	path := filepath.Join(dir, name+".ovpn")
+	data := fmt.Sprintf("client\ndev tun\nproto udp\nremote %s.example.com 1194\n%s<ca>\nCA\n</ca>\n", name, extra)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Контейнер, созданный не vpntoproxy, с именем name и портом хоста port
+func runForeign(t *testing.T, runtime *docker.Fake, name string, port int) {
+	bindings := nat.PortMap{}
+	if port != 0 {
+		bindings["1080/tcp"] = []nat.PortBinding{{HostPort: fmt.Sprint(port)}}
+	}
+	if _, err := runtime.RunContainer(&container.Config{Image: "nginx"},
+		&container.HostConfig{PortBindings: bindings}, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Резервы портов и имён должны сниматься и при ошибке создания
+func assertNoReservations(t *testing.T, m *Manager) {
+	t.Helper()
+
+	if len(m.ports.pending) != 0 {
+		t.Errorf("ports left reserved: %v", m.ports.pending)
+	}
+	if len(m.names.pending) != 0 {
+		t.Errorf("names left reserved: %v", m.names.pending)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	type create struct {
+		config     string
+		extra      string
+		name       string
+		onConflict string
+		country    string
+	}
+
+	tests := []struct {
+		name string
+		// порты хоста, занятые контейнерами не vpntoproxy, по имени контейнера
+		foreign map[string]int
+		creates []create
+		// имена и порты созданных туннелей, пустое имя — ошибка создания
+		wantNames []string
+		wantPorts []int
+		wantError string
+	}{
+		{
+			name:      "default template",
+			creates:   []create{{config: "us1"}, {config: "us2"}},
+			wantNames: []string{"vpn_us1", "vpn_us2"},
+			wantPorts: []int{testStartingPort, testStartingPort + 1},
+		},
+		{
+			name:      "index template",
+			creates:   []create{{config: "us1", name: "edge-{index}"}, {config: "us2", name: "edge-{index}"}},
+			wantNames: []string{"vpn_edge-1", "vpn_edge-2"},
+			wantPorts: []int{testStartingPort, testStartingPort + 1},
+		},
+		{
+			name:      "country and type placeholders",
+			creates:   []create{{config: "us1", name: "{country}-{type}-{config}", country: "US"}},
+			wantNames: []string{"vpn_us-openvpn-us1"},
+			wantPorts: []int{testStartingPort},
+		},
+		{
+			name:      "prefix is not repeated",
+			creates:   []create{{config: "us1", name: "vpn_main"}},
+			wantNames: []string{"vpn_main"},
+			wantPorts: []int{testStartingPort},
+		},
+		{
+			name:      "name conflict fails by default",
+			creates:   []create{{config: "us1", name: "main"}, {config: "us2", name: "main"}},
+			wantNames: []string{"vpn_main", ""},
+			wantPorts: []int{testStartingPort, 0},
+			wantError: "Tunnel name vpn_main is already used by tunnel",
+		},
+		{
+			name:      "foreign container name",
+			foreign:   map[string]int{"vpn_us1": 0},
+			creates:   []create{{config: "us1"}},
+			wantNames: []string{""},
+			wantPorts: []int{0},
+			wantError: "not managed by vpntoproxy",
+		},
+		{
+			name:      "foreign container port is skipped",
+			foreign:   map[string]int{"web": testStartingPort},
+			creates:   []create{{config: "us1"}},
+			wantNames: []string{"vpn_us1"},
+			wantPorts: []int{testStartingPort + 1},
+		},
+		{
+			name:      "unknown placeholder",
+			creates:   []create{{config: "us1", name: "{city}"}},
+			wantNames: []string{""},
+			wantPorts: []int{0},
+			wantError: "Unknown placeholder {city}",
+		},
+		{
+			name:      "invalid name",
+			creates:   []create{{config: "us1", name: "a..b{config}!"}},
+			wantNames: []string{""},
+			wantPorts: []int{0},
+			wantError: "Invalid tunnel name",
+		},
+		{
+			name:      "credentials required",
+			creates:   []create{{config: "us1", extra: "auth-user-pass\n"}},
+			wantNames: []string{""},
+			wantPorts: []int{0},
+			wantError: "requires user name and password",
+		},
+		{
+			name:      "port range exhausted",
+			creates:   []create{{config: "us1"}, {config: "us2"}, {config: "us3"}, {config: "us4"}},
+			wantNames: []string{"vpn_us1", "vpn_us2", "vpn_us3", ""},
+			wantPorts: []int{testStartingPort, testStartingPort + 1, testStartingPort + 2, 0},
+			wantError: fmt.Sprintf("No free host ports in range %d-%d", testStartingPort, testStartingPort+2),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, runtime := newTestManager(t, 3)
+			dir := t.TempDir()
+
+			for name, port := range tt.foreign {
+				runForeign(t, runtime, name, port)
+			}
+
+			var lastErr error
+			for i, c := range tt.creates {
+				info, err := m.Create(&Options{
+					Path:       writeConfig(t, dir, c.config, c.extra),
+					Name:       c.name,
+					OnConflict: c.onConflict,
+					Country:    c.country,
+				})
+
+				if tt.wantNames[i] == "" {
+					if err == nil {
+						t.Fatalf("create %d: expected error, got tunnel %s", i, info.Name)
+					}
+					lastErr = err
+					continue
+				}
+				if err != nil {
+					t.Fatalf("create %d: %s", i, err)
+				}
+
+				if info.Name != tt.wantNames[i] {
+					t.Errorf("create %d: got name %s, want %s", i, info.Name, tt.wantNames[i])
+				}
+				if info.HostPort != tt.wantPorts[i] {
+					t.Errorf("create %d: got port %d, want %d", i, info.HostPort, tt.wantPorts[i])
+				}
+
+				saved, err := m.registry.Get(info.ID)
+				if err != nil {
+					t.Fatalf("create %d: tunnel is not registered: %s", i, err)
+				}
+				if saved.ContainerID == "" || saved.ContainerID != info.Container.ID {
+					t.Errorf("create %d: registered container %q, created %q", i, saved.ContainerID, info.Container.ID)
+				}
+				if _, err := runtime.GetContainerByID(saved.ContainerID); err != nil {
+					t.Errorf("create %d: container is missing: %s", i, err)
+				}
+			}
+
+			if tt.wantError != "" && (lastErr == nil || !strings.Contains(lastErr.Error(), tt.wantError)) {
+				t.Errorf("got error %v, want %q", lastErr, tt.wantError)
+			}
+
+			assertNoReservations(t, m)
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		force    bool
+		rotating bool
+		// контейнер удалён вне vpntoproxy
+		removed   bool
+		wantError bool
+	}{
+		{name: "stop and remove"},
+		{name: "force", force: true},
+		{name: "container already removed", removed: true},
+		{name: "rotating", rotating: true, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, runtime := newTestManager(t, 1)
+			dir := t.TempDir()
+			path := writeConfig(t, dir, "us1", "")
+
+			info, err := m.Create(&Options{Path: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.removed {
+				if err := m.removeContainer(info.Container.ID, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.rotating {
+				m.rotating[info.ID] = true
+			}
+
+			err = m.Delete(info.Tunnel, tt.force)
+			if tt.wantError {
+				if _, ok := err.(*RotatingError); !ok {
+					t.Fatalf("got error %v, want *RotatingError", err)
+				}
+				if _, err := m.registry.Get(info.ID); err != nil {
+					t.Errorf("tunnel is deleted during rotation: %s", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := m.registry.Get(info.ID); err == nil {
+				t.Error("tunnel is still registered")
+			}
+			if _, err := runtime.GetContainerByID(info.Container.ID); !docker.IsNotFound(err) {
+				t.Errorf("container is not removed: %v", err)
+			}
+
+			// имя и единственный порт диапазона снова свободны
+			again, err := m.Create(&Options{Path: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Name != info.Name || again.HostPort != info.HostPort {
+				t.Errorf("got name %s and port %d, want %s and %d", again.Name, again.HostPort, info.Name, info.HostPort)
+			}
+		})
+	}
+}
+
+// Docker не отдаёт порты остановленных контейнеров, порт туннеля берётся из метки
+func TestReconcileStoppedTunnel(t *testing.T) {
+	m, runtime := newTestManager(t, 2)
+	dir := t.TempDir()
+
+	info, err := m.Create(&Options{Path: writeConfig(t, dir, "us1", "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stop(info.Tunnel, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped, err := runtime.GetContainerByID(info.Container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped.Ports) != 0 {
+		t.Fatalf("stopped container lists ports %v", stopped.Ports)
+	}
+
+	// запись туннеля потеряна, контейнер восстанавливается в реестре при сверке
+	if err := m.registry.Delete(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := m.registry.Get(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.HostPort != info.HostPort {
+		t.Fatalf("got port %d after reconcile, want %d", restored.HostPort, info.HostPort)
+	}
+
+	other, err := m.Create(&Options{Path: writeConfig(t, dir, "us2", "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.HostPort == info.HostPort {
+		t.Fatalf("port %d of the stopped tunnel is given to another tunnel", info.HostPort)
+	}
+
+	started, err := m.Start(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.HostPort != info.HostPort {
+		t.Fatalf("got port %d after start, want %d", started.HostPort, info.HostPort)
+	}
+}
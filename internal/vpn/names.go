@@ -0,0 +1,198 @@
+package vpn
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/registry"
+)
+
+// Действия при совпадении имени нового туннеля с именем существующего
+const (
+	// ошибка создания, по умолчанию
+	ConflictFail = "fail"
+	// возвращается существующий туннель
+	ConflictReuse = "reuse"
+	// существующий туннель удаляется
+	ConflictReplace = "replace"
+)
+
+// Максимальный номер для {index}
+const maxNameIndex = 9999
+
+// Шаблон имени, если docker.name_template не задан
+const defaultNameTemplate = "{config}"
+
+// Имя контейнера по правилам Docker
+var containerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+var (
+	namePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+	unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// Ошибка имени туннеля: неверный шаблон или занятое имя, отдаётся клиенту как есть
+type NameError struct {
+	Message string
+}
+
+func (e *NameError) Error() string {
+	return e.Message
+}
+
+func nameError(format string, args ...interface{}) error {
+	return &NameError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Имена контейнеров, зарезервированные незавершённым созданием туннелей
+type nameAllocator struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newNameAllocator() *nameAllocator {
+	return &nameAllocator{pending: make(map[string]bool)}
+}
+
+// Резервирование имени контейнера нового туннеля по шаблону opts.Name или docker.name_template.
+// Шаблон может содержать {config} (имя файла конфигурации без расширения), {country}, {type}
+// и {index} (наименьший номер, с которым имя свободно). К имени добавляется docker.service_prefix.
+// Если имя занято туннелем и opts.OnConflict равно reuse или replace, возвращается этот туннель
+func (m *Manager) reserveName(opts *Options, typ Type) (string, *registry.Tunnel, error) {
+	cnf := config.Get().Docker
+
+	template := opts.Name
+	if template == "" {
+		template = cnf.NameTemplate
+	}
+	if template == "" {
+		template = defaultNameTemplate
+	}
+
+	base := filepath.Base(opts.Path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	values := map[string]string{
+		"{config}":  unsafeNameChars.ReplaceAllString(base, "-"),
+		"{country}": strings.ToLower(opts.Country),
+		"{type}":    typ.Name(),
+	}
+
+	var unknown string
+	template = namePlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		if value, ok := values[p]; ok {
+			return value
+		}
+		if p != "{index}" && unknown == "" {
+			unknown = p
+		}
+		return p
+	})
+	if unknown != "" {
+		return "", nil, nameError("Unknown placeholder %s in tunnel name", unknown)
+	}
+
+	render := func(index int) (string, error) {
+		name := strings.Replace(template, "{index}", strconv.Itoa(index), -1)
+		if !strings.HasPrefix(name, cnf.ServicePrefix) {
+			name = cnf.ServicePrefix + name
+		}
+		if !containerName.MatchString(name) {
+			return "", nameError("Invalid tunnel name %q: only letters, digits, '_', '.' and '-' are allowed", name)
+		}
+		return name, nil
+	}
+
+	m.names.mu.Lock()
+	defer m.names.mu.Unlock()
+
+	tunnels, containers, err := m.usedNames()
+	if err != nil {
+		return "", nil, err
+	}
+
+	taken := func(name string) bool {
+		return m.names.pending[name] || tunnels[name] != nil || containers[name]
+	}
+
+	if strings.Contains(template, "{index}") {
+		for i := 1; i <= maxNameIndex; i++ {
+			name, err := render(i)
+			if err != nil {
+				return "", nil, err
+			}
+			if !taken(name) {
+				m.names.pending[name] = true
+				return name, nil, nil
+			}
+		}
+		return "", nil, nameError("No free tunnel name for template %q", template)
+	}
+
+	name, err := render(0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch {
+	case m.names.pending[name]:
+		return "", nil, nameError("Tunnel %s is already being created", name)
+	case tunnels[name] != nil:
+		existing := tunnels[name]
+		switch opts.OnConflict {
+		case ConflictReuse:
+			return name, existing, nil
+		case ConflictReplace:
+			m.names.pending[name] = true
+			return name, existing, nil
+		}
+		return "", nil, nameError("Tunnel name %s is already used by tunnel %s", name, existing.ID)
+	case containers[name]:
+		return "", nil, nameError("Container name %s is already in use by a container not managed by vpntoproxy", name)
+	}
+
+	m.names.pending[name] = true
+
+	return name, nil, nil
+}
+
+// Снятие резерва имени
+func (m *Manager) releaseName(name string) {
+	m.names.mu.Lock()
+	defer m.names.mu.Unlock()
+
+	delete(m.names.pending, name)
+}
+
+// Имена туннелей из реестра и имена контейнеров Docker
+func (m *Manager) usedNames() (map[string]*registry.Tunnel, map[string]bool, error) {
+	list, err := m.registry.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	containersList, err := m.runtime.GetContainersList()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tunnels := make(map[string]*registry.Tunnel, len(list))
+	for _, t := range list {
+		if t.Name != "" {
+			tunnels[t.Name] = t
+		}
+	}
+
+	containers := make(map[string]bool, len(containersList))
+	for _, _container := range containersList {
+		for _, name := range _container.Names {
+			containers[strings.TrimPrefix(name, "/")] = true
+		}
+	}
+
+	return tunnels, containers, nil
+}
@@ -0,0 +1,117 @@
+package vpn
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"vpntoproxy/internal/docker"
+)
+
+func TestCreateOnConflict(t *testing.T) {
+	tests := []struct {
+		onConflict string
+		sameID     bool
+		wantError  bool
+	}{
+		{onConflict: ConflictFail, wantError: true},
+		{onConflict: ConflictReuse, sameID: true},
+		{onConflict: ConflictReplace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.onConflict, func(t *testing.T) {
+			m, runtime := newTestManager(t, 3)
+			dir := t.TempDir()
+
+			first, err := m.Create(&Options{Path: writeConfig(t, dir, "us1", ""), Name: "main"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := m.Create(&Options{Path: writeConfig(t, dir, "us2", ""), Name: "main", OnConflict: tt.onConflict})
+			assertNoReservations(t, m)
+			if tt.wantError {
+				if err == nil {
+					t.Fatal("expected name conflict error")
+				}
+				if _, ok := err.(*NameError); !ok {
+					t.Fatalf("got %T error, want *NameError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if second.Name != "vpn_main" {
+				t.Errorf("got name %s, want vpn_main", second.Name)
+			}
+			if (second.ID == first.ID) != tt.sameID {
+				t.Errorf("first tunnel %s, second %s, same tunnel expected: %v", first.ID, second.ID, tt.sameID)
+			}
+
+			tunnels, err := m.registry.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tunnels) != 1 {
+				t.Fatalf("got %d registered tunnels, want 1", len(tunnels))
+			}
+
+			_, err = runtime.GetContainerByID(first.Container.ID)
+			if replaced := docker.IsNotFound(err); replaced == tt.sameID {
+				t.Errorf("container of the first tunnel removed: %v, want %v", replaced, !tt.sameID)
+			}
+			// порт удалённого туннеля достаётся новому
+			if second.HostPort != testStartingPort {
+				t.Errorf("got port %d, want %d", second.HostPort, testStartingPort)
+			}
+		})
+	}
+}
+
+func TestCreateConcurrent(t *testing.T) {
+	const count = 8
+
+	m, _ := newTestManager(t, count)
+	dir := t.TempDir()
+
+	paths := make([]string, count)
+	for i := range paths {
+		paths[i] = writeConfig(t, dir, fmt.Sprintf("us%d", i), "")
+	}
+
+	infos := make([]*Info, count)
+	errs := make([]error, count)
+
+	var wg sync.WaitGroup
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			infos[i], errs[i] = m.Create(&Options{Path: paths[i], Name: "edge-{index}"})
+		}(i)
+	}
+	wg.Wait()
+
+	names := make(map[string]bool, count)
+	ports := make(map[int]bool, count)
+	for i := range infos {
+		if errs[i] != nil {
+			t.Fatalf("create %d: %s", i, errs[i])
+		}
+		if names[infos[i].Name] || ports[infos[i].HostPort] {
+			t.Fatalf("create %d: name %s or port %d is used twice", i, infos[i].Name, infos[i].HostPort)
+		}
+		names[infos[i].Name] = true
+		ports[infos[i].HostPort] = true
+	}
+
+	for i := 1; i <= count; i++ {
+		if name := fmt.Sprintf("vpn_edge-%d", i); !names[name] {
+			t.Errorf("name %s is not used, got %v", name, names)
+		}
+	}
+
+	assertNoReservations(t, m)
+}
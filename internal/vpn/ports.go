@@ -0,0 +1,113 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/network"
+)
+
+// Выделение портов хоста для прокси туннелей из диапазона proxy.starting_port - proxy.ending_port.
+// Порт занят, если он записан в реестре, назначен контейнеру Docker (в том числе остановленному),
+// зарезервирован незавершённым созданием туннеля или его не удаётся занять на хосте
+type portAllocator struct {
+	mu      sync.Mutex
+	pending map[int]bool
+	// проверка порта на хосте, в режиме «dry run» порты контейнеров не заняты и проверяются только по реестру
+	available func(port int) bool
+}
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{
+		pending:   make(map[int]bool),
+		available: network.PortAvailable,
+	}
+}
+
+// Резервирование порта для контейнера туннеля.
+// Порт keep (прежний порт пересоздаваемого туннеля except) выбирается, если его не занял другой туннель.
+// Резерв снимается releasePort после записи туннеля в реестр или при ошибке создания
+func (m *Manager) reservePort(keep int, except string) (int, error) {
+	m.ports.mu.Lock()
+	defer m.ports.mu.Unlock()
+
+	used, err := m.usedPorts(except)
+	if err != nil {
+		return 0, err
+	}
+
+	free := func(port int) bool {
+		return !used[port] && !m.ports.pending[port] && m.ports.available(port)
+	}
+
+	cnf := config.Get().Proxy
+	first, last := portRange(cnf)
+
+	port := 0
+	// прежний порт туннеля закреплён за ним в реестре, на хосте его может ещё держать удаляемый контейнер
+	if keep != 0 && !used[keep] && !m.ports.pending[keep] {
+		port = keep
+	} else {
+		for p := first; p <= last; p++ {
+			if free(p) {
+				port = p
+				break
+			}
+		}
+	}
+
+	if port == 0 {
+		return 0, fmt.Errorf("No free host ports in range %d-%d", first, last)
+	}
+
+	m.ports.pending[port] = true
+
+	logrus.Debug("Reserved host port: ", port)
+
+	return port, nil
+}
+
+// Диапазон портов туннелей, без конца диапазона в конфигурации - 1000 портов от начала
+func portRange(cnf *config.Proxy) (int, int) {
+	if cnf.EndingPort == 0 {
+		return cnf.StartingPort, cnf.StartingPort + 1000
+	}
+
+	return cnf.StartingPort, cnf.EndingPort
+}
+
+// Снятие резерва порта
+func (m *Manager) releasePort(port int) {
+	m.ports.mu.Lock()
+	defer m.ports.mu.Unlock()
+
+	delete(m.ports.pending, port)
+}
+
+// Порты туннелей из реестра, кроме туннеля except, и порты контейнеров Docker
+func (m *Manager) usedPorts(except string) (map[int]bool, error) {
+	tunnels, err := m.registry.List()
+	if err != nil {
+		return nil, err
+	}
+
+	published, err := m.runtime.PublishedPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[int]bool, len(tunnels)+len(published))
+	for _, t := range tunnels {
+		if t.ID == except {
+			continue
+		}
+		used[t.HostPort] = true
+		used[t.HTTPPort] = true
+	}
+	for _, port := range published {
+		used[port] = true
+	}
+
+	return used, nil
+}
@@ -0,0 +1,62 @@
+package vpn
+
+import (
+	"testing"
+	"vpntoproxy/internal/config"
+)
+
+func TestReservePortKeep(t *testing.T) {
+	m, _ := newTestManager(t, 3)
+
+	info, err := m.Create(&Options{Path: writeConfig(t, t.TempDir(), "us1", "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// при пересоздании порт резервируется после удаления прежнего контейнера
+	if err := m.removeContainer(info.Container.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		keep   int
+		except string
+		want   int
+	}{
+		{name: "first free port", want: testStartingPort + 1},
+		{name: "own port of recreated tunnel", keep: info.HostPort, except: info.ID, want: info.HostPort},
+		{name: "port of another tunnel", keep: info.HostPort, want: testStartingPort + 1},
+		{name: "port outside of range", keep: 43000, except: info.ID, want: 43000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, err := m.reservePort(tt.keep, tt.except)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.releasePort(port)
+
+			if port != tt.want {
+				t.Fatalf("got port %d, want %d", port, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	tests := []struct {
+		starting, ending int
+		first, last      int
+	}{
+		{starting: 9001, ending: 9500, first: 9001, last: 9500},
+		{starting: 9001, ending: 0, first: 9001, last: 10001},
+	}
+
+	for _, tt := range tests {
+		first, last := portRange(&config.Proxy{StartingPort: tt.starting, EndingPort: tt.ending})
+		if first != tt.first || last != tt.last {
+			t.Errorf("portRange(%d, %d) = %d-%d, want %d-%d", tt.starting, tt.ending, first, last, tt.first, tt.last)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/registry"
+)
+
+// Интервал проверки подключения туннеля после смены сервера
+const rotatePollInterval = time.Second
+
+// Время ожидания подключения, если docker.rotate_timeout не задан
+const defaultRotateTimeout = 60 * time.Second
+
+// Конфигурация, на которую переключается туннель при смене сервера
+type RotateTarget struct {
+	// имя конфигурации, путь или сервер провайдера, для ответа API
+	Source  string
+	Type    string
+	Path    string
+	Country string
+}
+
+// Попытка смены сервера
+type RotateAttempt struct {
+	Source string `json:"source"`
+	ExitIP string `json:"exit_ip,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Результат смены сервера
+type RotateResult struct {
+	Tunnel    *Info  `json:"tunnel,omitempty"`
+	OldExitIP string `json:"old_exit_ip,omitempty"`
+	NewExitIP string `json:"new_exit_ip,omitempty"`
+	// внешний IP изменился, null если прежний IP туннеля неизвестен
+	Changed  *bool           `json:"changed"`
+	Attempts []RotateAttempt `json:"attempts"`
+}
+
+// Смена сервера туннеля с сохранением идентификатора, имени, порта и учётных данных.
+// Конфигурации targets пробуются по очереди, пока новый внешний IP не будет отличаться от прежнего.
+// Если ни одна не подошла, туннель возвращается на исходную конфигурацию
+func (m *Manager) Rotate(t *registry.Tunnel, targets []*RotateTarget) (*RotateResult, error) {
+	logrus.Debug("Rotate tunnel: ", t.ID)
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No other configs to rotate tunnel %s to", t.ID)
+	}
+
+	if !m.beginRotation(t.ID) {
+		return nil, &RotatingError{ID: t.ID}
+	}
+	defer m.endRotation(t.ID)
+
+	// туннель мог быть остановлен до начала смены сервера, остановка во время смены не выполняется
+	t, err := m.registry.Get(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	if t.DesiredState == registry.StateStopped {
+		return nil, &StoppedError{ID: t.ID}
+	}
+
+	secrets, err := loadSecrets(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := secrets.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RotateResult{Attempts: make([]RotateAttempt, 0, len(targets)), OldExitIP: m.currentExitIP(t)}
+	if res.OldExitIP == "" {
+		logrus.Warnf("Tunnel %s: exit IP is unknown, change of exit IP cannot be verified", t.ID)
+	}
+
+	original := &RotateTarget{Source: t.ConfigPath, Type: t.Type, Path: t.ConfigPath, Country: t.Country}
+
+	for _, target := range targets {
+		attempt := RotateAttempt{Source: target.Source}
+
+		updated, check, err := m.switchConfig(t, target, creds, secrets, true)
+		if updated != nil {
+			t = updated
+		}
+		if err == nil && res.OldExitIP != "" && check.ExitIP == res.OldExitIP {
+			err = fmt.Errorf("Exit IP %s did not change", check.ExitIP)
+		}
+		if err != nil {
+			logrus.Warnf("Tunnel %s: rotation to %s failed: %s", t.ID, target.Source, err)
+			attempt.Error = err.Error()
+			res.Attempts = append(res.Attempts, attempt)
+			m.recordRotation(t, &attempt, nil)
+			continue
+		}
+
+		attempt.ExitIP = check.ExitIP
+		res.Attempts = append(res.Attempts, attempt)
+		res.NewExitIP = check.ExitIP
+		if res.OldExitIP != "" {
+			changed := true
+			res.Changed = &changed
+		}
+
+		if t, err = m.recordRotation(t, &attempt, check); err != nil {
+			return nil, err
+		}
+		if res.Tunnel, err = m.Info(t); err != nil {
+			return nil, err
+		}
+
+		logrus.Infof("Tunnel %s rotated to %s, exit IP %s", t.ID, target.Source, check.ExitIP)
+
+		return res, nil
+	}
+
+	// ни одна конфигурация не подошла, туннель возвращается на исходную без проверки
+	if _, _, err := m.switchConfig(t, original, creds, secrets, false); err != nil {
+		logrus.Errorf("Tunnel %s: restore of config %s failed: %s", t.ID, original.Path, err)
+	}
+
+	return res, fmt.Errorf("Rotation of tunnel %s failed, %d configs tried", t.ID, len(targets))
+}
+
+// Внешний IP туннеля до смены сервера: проверка через прокси, если туннель не отвечает -
+// последний известный IP из истории здоровья
+func (m *Manager) currentExitIP(t *registry.Tunnel) string {
+	if check, err := m.checkProxy(t); err == nil {
+		return check.ExitIP
+	}
+
+	for i := len(t.Health) - 1; i >= 0; i-- {
+		if t.Health[i].ExitIP != "" {
+			return t.Health[i].ExitIP
+		}
+	}
+
+	return ""
+}
+
+// Пересоздание контейнера туннеля с конфигурацией target на прежнем порту.
+// При wait ожидается подключение vpn и успешная проверка прокси
+func (m *Manager) switchConfig(t *registry.Tunnel, target *RotateTarget, creds *credentials.Credentials,
+	secrets *Secrets, wait bool) (*registry.Tunnel, *ProxyCheck, error) {
+
+	typ, err := GetType(target.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote, err := typ.Check(target.Path, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := m.removeContainer(t.ContainerID, false); err != nil {
+		return nil, nil, err
+	}
+
+	port, err := m.reservePort(t.HostPort, t.ID)
+	if err != nil {
+		return m.detach(t), nil, err
+	}
+	defer m.releasePort(port)
+
+	if t.HostPort != 0 && port != t.HostPort {
+		return m.detach(t), nil, fmt.Errorf("Host port %d of tunnel %s is busy", t.HostPort, t.ID)
+	}
+
+	_container, err := Create(m.runtime, typ, t.ID, target.Path, t.Name, port, secrets)
+	if err != nil {
+		return m.detach(t), nil, err
+	}
+
+	updated, err := m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.ContainerID = _container.ID
+		t.HostPort = hostPort(_container)
+		t.ObservedState = observedState(_container)
+		t.Type = typ.Name()
+		t.ConfigPath = target.Path
+		t.RemoteHost, t.RemotePort, t.Protocol = "", 0, ""
+		setRemote(t, remote)
+		if target.Country != "" {
+			t.Country = target.Country
+		}
+		return nil
+	})
+	if err != nil || !wait {
+		return updated, nil, err
+	}
+
+	check, err := m.awaitProxy(updated, typ)
+
+	return updated, check, err
+}
+
+// Ожидание подключения vpn и успешной проверки прокси в течение docker.rotate_timeout
+func (m *Manager) awaitProxy(t *registry.Tunnel, typ Type) (*ProxyCheck, error) {
+	timeout := defaultRotateTimeout
+	if seconds := config.Get().Docker.RotateTimeout; seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := fmt.Errorf("VPN is not connected")
+		if ready, _ := typ.Ready(m.runtime, t.ContainerID); ready {
+			var check *ProxyCheck
+			if check, err = m.checkProxy(t); err == nil {
+				return check, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(rotatePollInterval)
+	}
+}
+
+// Запись туннеля без контейнера после неудачного пересоздания
+func (m *Manager) detach(t *registry.Tunnel) *registry.Tunnel {
+	updated, err := m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.ContainerID = ""
+		t.ObservedState = registry.StateMissing
+		return nil
+	})
+	if err != nil {
+		logrus.Error(err)
+		return t
+	}
+
+	return updated
+}
+
+// Запись попытки смены сервера в журнал действий, при успехе и в историю здоровья
+func (m *Manager) recordRotation(t *registry.Tunnel, attempt *RotateAttempt, check *ProxyCheck) (*registry.Tunnel, error) {
+	size := config.Get().Scheduler.HistorySize
+	now := time.Now()
+
+	return m.registry.Update(t.ID, func(t *registry.Tunnel) error {
+		t.AddAction(registry.Action{Type: registry.ActionRotate, Success: check != nil, Error: attempt.Error, At: now}, size)
+		if check != nil {
+			t.AddHealth(registry.Health{State: registry.HealthUp, Latency: check.Latency, ExitIP: check.ExitIP,
+				CheckedAt: now}, size)
+			t.Failures = 0
+			t.Healing = nil
+		}
+		return nil
+	})
+}
+
+// Ошибка действия над туннелем, сервер которого сейчас меняется или контейнер пересоздаётся
+type RotatingError struct {
+	ID string
+}
+
+func (e *RotatingError) Error() string {
+	return fmt.Sprintf("Tunnel %s is being rotated or recreated, try again later", e.ID)
+}
+
+// Ошибка смены сервера туннеля, остановленного пользователем
+type StoppedError struct {
+	ID string
+}
+
+func (e *StoppedError) Error() string {
+	return fmt.Sprintf("Tunnel %s is stopped, start it before rotating", e.ID)
+}
+
+// Проверка, что сервер туннеля сейчас меняется или контейнер пересоздаётся. Проверки, восстановление
+// и действия над контейнером туннеля в это время не выполняются
+func (m *Manager) Rotating(id string) bool {
+	m.rotatingMu.Lock()
+	defer m.rotatingMu.Unlock()
+
+	return m.rotating[id]
+}
+
+// Отметка начала смены сервера, false если она уже выполняется
+func (m *Manager) beginRotation(id string) bool {
+	m.rotatingMu.Lock()
+	defer m.rotatingMu.Unlock()
+
+	if m.rotating[id] {
+		return false
+	}
+	m.rotating[id] = true
+
+	return true
+}
+
+func (m *Manager) endRotation(id string) {
+	m.rotatingMu.Lock()
+	defer m.rotatingMu.Unlock()
+
+	delete(m.rotating, id)
+}
@@ -0,0 +1,41 @@
+package vpn
+
+import "testing"
+
+// Смена сервера остановленного туннеля не должна запускать новый контейнер
+func TestRotateStoppedTunnel(t *testing.T) {
+	m, runtime := newTestManager(t, 2)
+	dir := t.TempDir()
+
+	info, err := m.Create(&Options{Path: writeConfig(t, dir, "us1", "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &RotateTarget{Source: "us2", Type: TypeOpenVPN, Path: writeConfig(t, dir, "us2", "")}
+
+	// туннель остановлен после того, как вызывающий получил его запись
+	if _, err := m.Stop(info.Tunnel, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := m.Rotate(info.Tunnel, []*RotateTarget{target})
+	if _, ok := err.(*StoppedError); !ok {
+		t.Fatalf("got result %+v, error %v, want StoppedError", res, err)
+	}
+
+	containers, err := runtime.GetContainersList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != info.Container.ID || containers[0].State != "exited" {
+		t.Fatalf("got containers %+v, want only the stopped container %s", containers, info.Container.ID)
+	}
+
+	stored, err := m.registry.Get(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ConfigPath != info.ConfigPath {
+		t.Fatalf("got config %s after refused rotation, want %s", stored.ConfigPath, info.ConfigPath)
+	}
+}
@@ -0,0 +1,164 @@
+package vpn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/ovpn"
+)
+
+// Пути к файлам учётных данных внутри контейнера, образ передаёт их openvpn
+// через --auth-user-pass и --askpass
+const (
+	authMountPath     = "/vpn/vpn.auth"
+	certAuthMountPath = "/vpn/vpn.cert_auth"
+)
+
+// Файлы учётных данных туннеля на хосте.
+// Данные передаются в контейнер только через файлы, чтобы они не попали в переменные окружения
+type Secrets struct {
+	AuthFile     string
+	CertAuthFile string
+}
+
+// Монтирование файлов учётных данных в контейнер
+func (s *Secrets) binds() []string {
+	binds := make([]string, 0, 2)
+	if s == nil {
+		return binds
+	}
+
+	if s.AuthFile != "" {
+		binds = append(binds, fmt.Sprintf("%s:%s:ro", s.AuthFile, authMountPath))
+	}
+	if s.CertAuthFile != "" {
+		binds = append(binds, fmt.Sprintf("%s:%s:ro", s.CertAuthFile, certAuthMountPath))
+	}
+
+	return binds
+}
+
+// Каталог учётных данных туннеля
+func secretsDir(id string) (string, error) {
+	return filepath.Abs(filepath.Join(config.Get().Storage.SecretsDir, id))
+}
+
+// Запись учётных данных туннеля в файлы, доступные только владельцу
+func writeSecrets(id string, creds *credentials.Credentials) (*Secrets, error) {
+	if !creds.HasAuth() && !creds.HasCertPassword() {
+		return nil, nil
+	}
+
+	dir, err := secretsDir(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	secrets := &Secrets{}
+
+	if creds.HasAuth() {
+		secrets.AuthFile = filepath.Join(dir, filepath.Base(authMountPath))
+		if err := ioutil.WriteFile(secrets.AuthFile, []byte(creds.User+"\n"+creds.Password+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	if creds.HasCertPassword() {
+		secrets.CertAuthFile = filepath.Join(dir, filepath.Base(certAuthMountPath))
+		if err := ioutil.WriteFile(secrets.CertAuthFile, []byte(creds.CertPassword+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	return secrets, nil
+}
+
+// Поиск ранее записанных файлов учётных данных туннеля
+func loadSecrets(id string) (*Secrets, error) {
+	dir, err := secretsDir(id)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := &Secrets{}
+	if path := filepath.Join(dir, filepath.Base(authMountPath)); exists(path) {
+		secrets.AuthFile = path
+	}
+	if path := filepath.Join(dir, filepath.Base(certAuthMountPath)); exists(path) {
+		secrets.CertAuthFile = path
+	}
+
+	return secrets, nil
+}
+
+// Учётные данные из файлов туннеля, нужны для проверки другой конфигурации при смене сервера
+func (s *Secrets) credentials() (*credentials.Credentials, error) {
+	creds := &credentials.Credentials{}
+	if s == nil {
+		return creds, nil
+	}
+
+	if s.AuthFile != "" {
+		data, err := ioutil.ReadFile(s.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.SplitN(string(data), "\n", 3)
+		creds.User = lines[0]
+		if len(lines) > 1 {
+			creds.Password = lines[1]
+		}
+	}
+
+	if s.CertAuthFile != "" {
+		data, err := ioutil.ReadFile(s.CertAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		creds.CertPassword = strings.TrimSuffix(string(data), "\n")
+	}
+
+	return creds, nil
+}
+
+// Удаление файлов учётных данных туннеля
+func removeSecrets(id string) error {
+	dir, err := secretsDir(id)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Проверка наличия учётных данных, которых требует конфигурация
+func checkCredentials(cfg *ovpn.Config, creds *credentials.Credentials) error {
+	issues := make([]ovpn.Issue, 0, 2)
+
+	if cfg.AuthUserPass && !creds.HasAuth() {
+		issues = append(issues, ovpn.Issue{Directive: "auth-user-pass",
+			Message: "config requires user name and password, pass credentials or a stored credential set"})
+	}
+	if cfg.AskPass && !creds.HasCertPassword() {
+		issues = append(issues, ovpn.Issue{Directive: "askpass",
+			Message: "private key is encrypted, pass cert_password or a stored credential set"})
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	return &ovpn.ValidationError{Issues: issues}
+}
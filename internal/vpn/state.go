@@ -0,0 +1,110 @@
+package vpn
+
+import (
+	"bytes"
+	"github.com/docker/docker/api/types"
+	"regexp"
+	"strconv"
+	"vpntoproxy/internal/registry"
+)
+
+// Состояния туннеля для клиентов API, сводят состояние контейнера, подключение vpn и проверки здоровья
+const (
+	// контейнер создан, но ещё не запущен
+	StateCreating = "creating"
+	// контейнер запущен, vpn ещё не подключился
+	StateConnecting = "connecting"
+	// vpn подключён, последняя проверка успешна
+	StateUp = "up"
+	// vpn подключён, но последняя проверка неуспешна
+	StateDegraded = "degraded"
+	// контейнер остановлен, туннель не должен работать
+	StateStopped = "stopped"
+	// контейнер завершился, хотя туннель должен работать
+	StateExited = "exited"
+	// контейнер отсутствует, повреждён или восстановление туннеля не удалось
+	StateFailed = "failed"
+)
+
+// Максимальная длина причины состояния
+const maxReasonLength = 300
+
+// Код завершения в статусе контейнера: «Exited (137) 5 minutes ago»
+var exitCodePattern = regexp.MustCompile(`^Exited \((-?\d+)\)`)
+
+// Нормализованное состояние туннеля, код завершения контейнера и причина состояния.
+// Причина берётся из последних строк логов контейнера, для degraded из последней проверки
+func (m *Manager) state(t *registry.Tunnel, _container *types.Container) (string, *int, string) {
+	if _container == nil {
+		return StateFailed, nil, "Container not found"
+	}
+
+	var exitCode *int
+	if match := exitCodePattern.FindStringSubmatch(_container.Status); match != nil {
+		if code, err := strconv.Atoi(match[1]); err == nil {
+			exitCode = &code
+		}
+	}
+
+	if t.Healing != nil && t.Healing.Failed {
+		return StateFailed, exitCode, m.reason(_container.ID)
+	}
+
+	switch _container.State {
+	case "created":
+		return StateCreating, nil, ""
+	case "restarting":
+		return StateConnecting, exitCode, m.reason(_container.ID)
+	case "paused":
+		return StateStopped, nil, ""
+	case "exited":
+		if t.DesiredState != registry.StateRunning {
+			return StateStopped, exitCode, m.reason(_container.ID)
+		}
+		return StateExited, exitCode, m.reason(_container.ID)
+	case "running":
+	default:
+		return StateFailed, exitCode, m.reason(_container.ID)
+	}
+
+	health := t.LastHealth()
+	if health != nil && health.State == registry.HealthUp {
+		return StateUp, nil, ""
+	}
+
+	typ, err := GetType(t.Type)
+	if err != nil {
+		return StateFailed, nil, err.Error()
+	}
+	if ready, _ := typ.Ready(m.runtime, _container.ID); !ready {
+		return StateConnecting, nil, m.reason(_container.ID)
+	}
+
+	if health != nil {
+		return StateDegraded, nil, health.Error
+	}
+
+	return StateUp, nil, ""
+}
+
+// Последняя непустая строка логов контейнера
+func (m *Manager) reason(id string) string {
+	started, err := m.runtime.StartedAt(id)
+	if err != nil {
+		return ""
+	}
+
+	// причина берётся из логов последнего запуска
+	logs, err := m.runtime.Logs(id, started)
+	if err != nil {
+		return ""
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(logs), []byte("\n"))
+	line := string(bytes.TrimSpace(lines[len(lines)-1]))
+	if len(line) > maxReasonLength {
+		line = line[:maxReasonLength]
+	}
+
+	return line
+}
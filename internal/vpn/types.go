@@ -0,0 +1,217 @@
+package vpn
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"vpntoproxy/internal/config"
+	"vpntoproxy/internal/credentials"
+	"vpntoproxy/internal/docker"
+	"vpntoproxy/internal/ovpn"
+	"vpntoproxy/internal/wireguard"
+)
+
+// Типы туннелей
+const (
+	TypeOpenVPN   = "openvpn"
+	TypeWireGuard = "wireguard"
+)
+
+// Архивы с контекстом сборки образов
+const (
+	openVPNImagePath   = "deployments/docker-vpnwithproxy/docker-vpnwithproxy.tar"
+	wireGuardImagePath = "deployments/docker-wgwithproxy/docker-wgwithproxy.tar"
+)
+
+// Образ контейнера и архив для его сборки
+type Image struct {
+	Name    string
+	Context string
+	// аргументы сборки из ARG в Dockerfile
+	BuildArgs map[string]*string
+}
+
+// Параметры контейнера туннеля
+type Spec struct {
+	// образы в порядке сборки, контейнер запускается из последнего
+	Images  []Image
+	Binds   []string
+	CapAdd  []string
+	Sysctls map[string]string
+}
+
+// Тип туннеля: проверка конфигурации, параметры контейнера и признак готовности vpn
+type Type interface {
+	// Имя типа, сохраняется в реестре
+	Name() string
+	// Образ, из которого запускаются контейнеры этого типа
+	Image() string
+	// Путь к конфигурации внутри контейнера
+	ConfigMountPath() string
+	// Разбор и проверка конфигурации с учётными данными.
+	// Сервер vpn возвращается и при ошибке проверки, если конфигурацию удалось разобрать
+	Check(path string, creds *credentials.Credentials) (*ovpn.Remote, error)
+	// Параметры контейнера для конфигурации и файлов учётных данных
+	Spec(path string, secrets *Secrets) *Spec
+	// Проверка подключения vpn в контейнере
+	Ready(rt docker.ContainerRuntime, id string) (bool, error)
+}
+
+var tunnelTypes = map[string]Type{
+	TypeOpenVPN:   openVPN{},
+	TypeWireGuard: wireGuard{},
+}
+
+// Получение типа туннеля по имени, пустое имя означает OpenVPN
+func GetType(name string) (Type, error) {
+	if name == "" {
+		name = TypeOpenVPN
+	}
+
+	t, ok := tunnelTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown tunnel type %q", name)
+	}
+
+	return t, nil
+}
+
+// Тип туннеля по расширению файла конфигурации, пустая строка для прочих файлов
+func TypeByExtension(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ovpn":
+		return TypeOpenVPN
+	case ".conf":
+		return TypeWireGuard
+	}
+
+	return ""
+}
+
+// Файлы конфигураций по шаблону. Для каталога берутся все файлы .ovpn и .conf в нём
+func GlobConfigs(pattern string) ([]string, error) {
+	patterns := []string{pattern}
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		patterns = []string{filepath.Join(pattern, "*.ovpn"), filepath.Join(pattern, "*.conf")}
+	}
+
+	res := make([]string, 0)
+	for _, p := range patterns {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				res = append(res, match)
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("No configs match %s", pattern)
+	}
+
+	return res, nil
+}
+
+// Определение типа туннеля по образу контейнера
+func typeByImage(image string) Type {
+	for _, t := range tunnelTypes {
+		if t.Image() == image {
+			return t
+		}
+	}
+
+	return openVPN{}
+}
+
+// Туннель OpenVPN
+type openVPN struct{}
+
+func (openVPN) Name() string {
+	return TypeOpenVPN
+}
+
+func (openVPN) Image() string {
+	return config.Get().Docker.ImageName
+}
+
+func (openVPN) ConfigMountPath() string {
+	return "/vpn/config.ovpn"
+}
+
+func (openVPN) Check(path string, creds *credentials.Credentials) (*ovpn.Remote, error) {
+	cfg, err := ovpn.Check(path)
+	if cfg == nil {
+		return nil, err
+	}
+	if err == nil {
+		err = checkCredentials(cfg, creds)
+	}
+
+	return cfg.Remote(), err
+}
+
+func (o openVPN) Spec(path string, secrets *Secrets) *Spec {
+	return &Spec{
+		Images: []Image{{Name: o.Image(), Context: openVPNImagePath}},
+		Binds:  append([]string{fmt.Sprintf("%s:%s", path, o.ConfigMountPath())}, secrets.binds()...),
+		CapAdd: []string{"NET_ADMIN"},
+	}
+}
+
+func (openVPN) Ready(rt docker.ContainerRuntime, id string) (bool, error) {
+	return docker.CheckVPN(rt, id, "Initialization Sequence Completed")
+}
+
+// Туннель WireGuard, поднимается в контейнере через wg-quick
+type wireGuard struct{}
+
+func (wireGuard) Name() string {
+	return TypeWireGuard
+}
+
+func (wireGuard) Image() string {
+	return docker.WireGuardImage()
+}
+
+func (wireGuard) ConfigMountPath() string {
+	return "/etc/wireguard/wg0.conf"
+}
+
+func (wireGuard) Check(path string, creds *credentials.Credentials) (*ovpn.Remote, error) {
+	cfg, err := wireguard.Check(path)
+	if cfg == nil {
+		return nil, err
+	}
+	if err == nil && (creds.HasAuth() || creds.HasCertPassword()) {
+		err = &ovpn.ValidationError{Issues: []ovpn.Issue{{
+			Directive: "credentials",
+			Message:   "WireGuard tunnels do not use user name, password or key passphrase",
+		}}}
+	}
+
+	return cfg.Remote(), err
+}
+
+func (w wireGuard) Spec(path string, secrets *Secrets) *Spec {
+	base := config.Get().Docker.ImageName
+
+	return &Spec{
+		// образ WireGuard собирается поверх образа OpenVPN, в котором уже есть socks5 прокси
+		Images: []Image{
+			{Name: base, Context: openVPNImagePath},
+			{Name: w.Image(), Context: wireGuardImagePath, BuildArgs: map[string]*string{"BASE_IMAGE": &base}},
+		},
+		Binds:  []string{fmt.Sprintf("%s:%s:ro", path, w.ConfigMountPath())},
+		CapAdd: []string{"NET_ADMIN"},
+		// wg-quick помечает пакеты туннеля, без этого параметра маршрут по умолчанию не поднять
+		Sysctls: map[string]string{"net.ipv4.conf.all.src_valid_mark": "1"},
+	}
+}
+
+func (wireGuard) Ready(rt docker.ContainerRuntime, id string) (bool, error) {
+	return docker.CheckVPN(rt, id, "WireGuard handshake completed")
+}
@@ -0,0 +1,310 @@
+// пакет разбора и проверки конфигураций WireGuard (формат wg-quick)
+package wireguard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"vpntoproxy/internal/ovpn"
+)
+
+// Протокол WireGuard
+const Proto = "udp"
+
+// Узел из секции [Peer]
+type Peer struct {
+	PublicKey  string   `json:"public_key"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowed_ips"`
+	line       int
+}
+
+// Разобранная конфигурация WireGuard
+type Config struct {
+	Addresses []string `json:"addresses"`
+	DNS       []string `json:"dns,omitempty"`
+	Peers     []Peer   `json:"peers"`
+	// ключ не отдаётся в ответах API
+	PrivateKey string `json:"-"`
+	// секции и ключи с номером первой строки, в которой они встретились
+	sections map[string]int
+	keys     map[string]int
+	issues   []ovpn.Issue
+}
+
+// Допустимые ключи секций, имена ключей wg-quick не зависят от регистра
+var sectionKeys = map[string]map[string]bool{
+	"interface": {
+		"privatekey": true, "address": true, "dns": true, "listenport": true, "mtu": true,
+		"table": true, "saveconfig": true, "fwmark": true,
+		"preup": true, "postup": true, "predown": true, "postdown": true,
+	},
+	"peer": {
+		"publickey": true, "presharedkey": true, "endpoint": true, "allowedips": true, "persistentkeepalive": true,
+	},
+}
+
+// Чтение и разбор файла конфигурации
+func ParseFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(bytes.NewReader(data))
+}
+
+// Разбор конфигурации. Ошибки содержимого накапливаются и возвращаются методом Validate
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{
+		sections: make(map[string]int),
+		keys:     make(map[string]int),
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	section := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(strings.TrimSpace(strings.Trim(text, "[]")))
+			if _, ok := sectionKeys[section]; !ok {
+				c.issue(line, section, "unknown section [%s]", section)
+			}
+			if _, ok := c.sections[section]; !ok {
+				c.sections[section] = line
+			}
+			if section == "peer" {
+				c.Peers = append(c.Peers, Peer{line: line})
+			}
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			c.issue(line, "", "expected key = value")
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		if section == "" {
+			c.issue(line, key, "key %s is outside of a section", key)
+			continue
+		}
+		if keys, ok := sectionKeys[section]; ok && !keys[key] {
+			c.issue(line, key, "unknown key %s in section [%s]", key, section)
+			continue
+		}
+		if _, ok := c.keys[section+"."+key]; !ok {
+			c.keys[section+"."+key] = line
+		}
+
+		c.set(line, section, key, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Разбор значения ключа
+func (c *Config) set(line int, section, key, value string) {
+	switch section + "." + key {
+	case "interface.privatekey":
+		c.PrivateKey = value
+		if !validKey(value) {
+			c.issue(line, key, "private key is not a base64 encoded 32 byte key")
+		}
+	case "interface.address":
+		for _, address := range list(value) {
+			if !validAddress(address) {
+				c.issue(line, key, "invalid address %q", address)
+				continue
+			}
+			c.Addresses = append(c.Addresses, address)
+		}
+	case "interface.dns":
+		c.DNS = append(c.DNS, list(value)...)
+	case "interface.listenport", "interface.mtu":
+		if _, err := strconv.Atoi(value); err != nil {
+			c.issue(line, key, "invalid number %q", value)
+		}
+	case "interface.table":
+		if strings.EqualFold(value, "off") {
+			c.issue(line, key, "routing table is disabled, traffic would bypass the tunnel")
+		}
+	case "interface.saveconfig":
+		if strings.EqualFold(value, "true") {
+			c.issue(line, key, "config is mounted read-only and cannot be saved, remove SaveConfig")
+		}
+	case "peer.publickey", "peer.presharedkey", "peer.endpoint", "peer.allowedips":
+		peer := &c.Peers[len(c.Peers)-1]
+		switch key {
+		case "publickey":
+			peer.PublicKey = value
+			if !validKey(value) {
+				c.issue(line, key, "public key is not a base64 encoded 32 byte key")
+			}
+		case "presharedkey":
+			if !validKey(value) {
+				c.issue(line, key, "preshared key is not a base64 encoded 32 byte key")
+			}
+		case "endpoint":
+			peer.Endpoint = value
+			if _, _, err := splitEndpoint(value); err != nil {
+				c.issue(line, key, "invalid endpoint %q, host:port expected", value)
+			}
+		case "allowedips":
+			for _, network := range list(value) {
+				if !validAddress(network) {
+					c.issue(line, key, "invalid allowed ip %q", network)
+					continue
+				}
+				peer.AllowedIPs = append(peer.AllowedIPs, network)
+			}
+		}
+	}
+}
+
+// Сервер vpn: первый узел с адресом
+func (c *Config) Remote() *ovpn.Remote {
+	for _, peer := range c.Peers {
+		if host, port, err := splitEndpoint(peer.Endpoint); err == nil {
+			return &ovpn.Remote{Host: host, Port: port, Proto: Proto}
+		}
+	}
+
+	return nil
+}
+
+// Проверка конфигурации перед запуском контейнера
+func (c *Config) Validate() error {
+	issues := append([]ovpn.Issue(nil), c.issues...)
+
+	add := func(line int, directive string, message string) {
+		issues = append(issues, ovpn.Issue{Line: line, Directive: directive, Message: message})
+	}
+
+	if _, ok := c.sections["interface"]; !ok {
+		add(0, "interface", "section [Interface] is missing")
+	} else {
+		if _, ok := c.keys["interface.privatekey"]; !ok {
+			add(c.sections["interface"], "privatekey", "private key is missing, add PrivateKey to [Interface]")
+		}
+		if _, ok := c.keys["interface.address"]; !ok {
+			add(c.sections["interface"], "address", "address is missing, add Address to [Interface]")
+		}
+	}
+
+	if len(c.Peers) == 0 {
+		add(0, "peer", "section [Peer] is missing")
+	}
+
+	for _, peer := range c.Peers {
+		if peer.PublicKey == "" {
+			add(peer.line, "publickey", "public key of peer is missing")
+		}
+		// в контейнере туннель поднимается только исходящим подключением к серверу
+		if peer.Endpoint == "" {
+			add(peer.line, "endpoint", "endpoint of peer is missing")
+		}
+		if len(peer.AllowedIPs) == 0 {
+			add(peer.line, "allowedips", "allowed ips of peer are missing, traffic would bypass the tunnel")
+		}
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	// ошибки по строкам идут первыми, затем ошибки конфигурации в целом
+	sort.SliceStable(issues, func(i, j int) bool {
+		li, lj := issues[i].Line, issues[j].Line
+		if li == 0 || lj == 0 {
+			return li > 0 && lj == 0
+		}
+		return li < lj
+	})
+
+	return &ovpn.ValidationError{Issues: issues}
+}
+
+func (c *Config) issue(line int, directive string, format string, args ...interface{}) {
+	c.issues = append(c.issues, ovpn.Issue{Line: line, Directive: directive, Message: fmt.Sprintf(format, args...)})
+}
+
+// Разбор и проверка файла конфигурации
+func Check(path string) (*Config, error) {
+	c, err := ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// Проверка, что содержимое похоже на конфигурацию WireGuard
+func Detect(data []byte) bool {
+	return bytes.Contains(bytes.ToLower(data), []byte("[interface]"))
+}
+
+// Значения через запятую
+func list(value string) []string {
+	res := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
+
+// Ключ WireGuard: 32 байта в base64
+func validKey(value string) bool {
+	key, err := base64.StdEncoding.DecodeString(value)
+	return err == nil && len(key) == 32
+}
+
+// Адрес или сеть
+func validAddress(value string) bool {
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return true
+	}
+
+	return net.ParseIP(value) != nil
+}
+
+// Разбор адреса сервера host:port
+func splitEndpoint(value string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, strconv.ErrRange
+	}
+
+	return host, port, nil
+}
@@ -1,15 +1,349 @@
 package requests
 
 import (
+	"fmt"
 	validation "github.com/go-ozzo/ozzo-validation"
 	"net/http"
+	"regexp"
+	"strings"
 )
 
+// Допустимое имя конфигурации в библиотеке и набора учётных данных
+var configName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Допустимые типы туннелей и конфигураций
+var tunnelTypes = []interface{}{"openvpn", "wireguard"}
+
+// Допустимое имя туннеля или шаблон имени с подстановками в фигурных скобках
+var tunnelName = regexp.MustCompile(`^[A-Za-z0-9_.{}-]{1,128}$`)
+
+// Действия при совпадении имени туннеля с существующим
+var conflictActions = []interface{}{"fail", "reuse", "replace"}
+
 type CreateVPNParams struct {
-	Path string `form:"path" json:"path" binding:"required"`
+	// тип туннеля, по умолчанию openvpn, для конфигурации из библиотеки берётся её тип
+	Type string `form:"type" json:"type"`
+	Path string `form:"path" json:"path"`
+	// имя конфигурации из библиотеки, используется вместо path
+	Config string `form:"config" json:"config"`
+	// провайдер, у которого выбирается наименее загруженный сервер страны country и города city
+	Provider string `form:"provider" json:"provider"`
+	City     string `form:"city" json:"city"`
+	// конкретный сервер провайдера
+	Server string `form:"server" json:"server"`
+	// имя туннеля или шаблон с {config}, {country}, {type} и {index}
+	Name string `form:"name" json:"name"`
+	// действие при совпадении имени с существующим туннелем: fail, reuse или replace
+	OnConflict string   `form:"on_conflict" json:"on_conflict"`
+	Country    string   `form:"country" json:"country"`
+	Tags       []string `form:"tags" json:"tags"`
+	// имя сохранённого набора учётных данных, используется вместо user, password и cert_password
+	Credentials  string `form:"credentials" json:"credentials"`
+	User         string `form:"user" json:"user"`
+	Password     string `form:"password" json:"password"`
+	CertPassword string `form:"cert_password" json:"cert_password"`
 }
 
 func (params *CreateVPNParams) Bind(r *http.Request) error {
+	if err := validation.ValidateStruct(params,
+		validation.Field(&params.Type, validation.In(tunnelTypes...)),
+		validation.Field(&params.Name, validation.Match(tunnelName)),
+		validation.Field(&params.OnConflict, validation.In(conflictActions...)),
+		validation.Field(&params.Country, validation.Length(2, 2)),
+		validation.Field(&params.Tags, validation.Each(validation.Required))); err != nil {
+		return err
+	}
+
+	sources := 0
+	for _, source := range []string{params.Path, params.Config, params.Provider} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return validation.Errors{"config": fmt.Errorf("exactly one of path, config or provider is required")}
+	}
+	if params.Provider == "" && (params.City != "" || params.Server != "") {
+		return validation.Errors{"provider": fmt.Errorf("is required with city or server")}
+	}
+
+	if params.Credentials != "" && (params.User != "" || params.Password != "" || params.CertPassword != "") {
+		return validation.Errors{"credentials": fmt.Errorf("cannot be used together with user, password or cert_password")}
+	}
+
+	return validateAuth(params.User, params.Password)
+}
+
+type BatchVPNParams struct {
+	Paths []string `form:"paths" json:"paths"`
+	// имена конфигураций из библиотеки
+	Configs []string `form:"configs" json:"configs"`
+	// шаблон путей к файлам конфигураций или каталог с ними
+	Glob string `form:"glob" json:"glob"`
+	// загружен zip архив с конфигурациями, заполняется при разборе multipart/form-data
+	Archive bool `form:"-" json:"-"`
+	// тип туннелей, по умолчанию определяется по расширению файла
+	Type string `form:"type" json:"type"`
+	// шаблон имён туннелей, для уникальности должен содержать {config} или {index}
+	Name         string   `form:"name" json:"name"`
+	Country      string   `form:"country" json:"country"`
+	Tags         []string `form:"tags" json:"tags"`
+	Credentials  string   `form:"credentials" json:"credentials"`
+	User         string   `form:"user" json:"user"`
+	Password     string   `form:"password" json:"password"`
+	CertPassword string   `form:"cert_password" json:"cert_password"`
+	// количество туннелей, создаваемых одновременно
+	Concurrency int `form:"concurrency" json:"concurrency"`
+	// удаление созданных туннелей при ошибке хотя бы одного
+	Rollback bool `form:"rollback" json:"rollback"`
+}
+
+func (params *BatchVPNParams) Bind(r *http.Request) error {
+	if err := validation.ValidateStruct(params,
+		validation.Field(&params.Paths, validation.Each(validation.Required)),
+		validation.Field(&params.Configs, validation.Each(validation.Required)),
+		validation.Field(&params.Type, validation.In(tunnelTypes...)),
+		validation.Field(&params.Name, validation.Match(tunnelName)),
+		validation.Field(&params.Country, validation.Length(2, 2)),
+		validation.Field(&params.Tags, validation.Each(validation.Required)),
+		validation.Field(&params.Concurrency, validation.Min(0), validation.Max(32))); err != nil {
+		return err
+	}
+
+	if len(params.Paths) == 0 && len(params.Configs) == 0 && params.Glob == "" && !params.Archive {
+		return validation.Errors{"paths": fmt.Errorf("paths, configs, glob or zip archive is required")}
+	}
+	if err := params.ValidateName(len(params.Paths) + len(params.Configs)); err != nil {
+		return err
+	}
+
+	if params.Credentials != "" && (params.User != "" || params.Password != "" || params.CertPassword != "") {
+		return validation.Errors{"credentials": fmt.Errorf("cannot be used together with user, password or cert_password")}
+	}
+
+	return validateAuth(params.User, params.Password)
+}
+
+// Проверка шаблона имён для пакета из count конфигураций: без {config} и {index}
+// все туннели пакета получили бы одно имя
+func (params *BatchVPNParams) ValidateName(count int) error {
+	if count < 2 || params.Name == "" {
+		return nil
+	}
+	if !strings.Contains(params.Name, "{config}") && !strings.Contains(params.Name, "{index}") {
+		return validation.Errors{"name": fmt.Errorf("must contain {config} or {index} for more than one config")}
+	}
+
+	return nil
+}
+
+// Источники конфигураций туннелей для смены сервера и пулов
+type ConfigSourceParams struct {
+	// имена конфигураций из библиотеки
+	Configs []string `form:"configs" json:"configs"`
+	Paths   []string `form:"paths" json:"paths"`
+	// каталог или шаблон путей конфигураций
+	Dir string `form:"dir" json:"dir"`
+	// метка конфигураций библиотеки
+	Tag string `form:"tag" json:"tag"`
+	// провайдер, при смене сервера по умолчанию провайдер, у которого создан туннель
+	Provider string `form:"provider" json:"provider"`
+	// страна и город сервера провайдера, при смене сервера по умолчанию страна туннеля
+	Country string `form:"country" json:"country"`
+	City    string `form:"city" json:"city"`
+}
+
+func (params *ConfigSourceParams) Validate() error {
+	return validation.ValidateStruct(params,
+		validation.Field(&params.Configs, validation.Each(validation.Required)),
+		validation.Field(&params.Paths, validation.Each(validation.Required)),
+		validation.Field(&params.Country, validation.Length(2, 2)))
+}
+
+// Наличие хотя бы одного источника конфигураций
+func (params *ConfigSourceParams) Empty() bool {
+	return len(params.Configs) == 0 && len(params.Paths) == 0 && params.Dir == "" && params.Tag == "" && params.Provider == ""
+}
+
+type RotateVPNParams struct {
+	ConfigSourceParams
+	// количество пробуемых конфигураций
+	Attempts int `form:"attempts" json:"attempts"`
+}
+
+func (params *RotateVPNParams) Bind(r *http.Request) error {
+	if err := params.ConfigSourceParams.Validate(); err != nil {
+		return err
+	}
+
+	return validation.ValidateStruct(params,
+		validation.Field(&params.Attempts, validation.Min(0), validation.Max(10)))
+}
+
+type PolicyParams struct {
+	Name string `form:"name" json:"name"`
+	// туннель или метка туннелей
+	Tunnel string `form:"tunnel" json:"tunnel"`
+	Tag    string `form:"tag" json:"tag"`
+	// интервал (30m, 2h) или расписание cron из пяти полей
+	Every string `form:"every" json:"every"`
+	Cron  string `form:"cron" json:"cron"`
+	// вывод туннеля из балансировки шлюза перед сменой сервера, ожидание в секундах
+	Drain        bool `form:"drain" json:"drain"`
+	DrainTimeout int  `form:"drain_timeout" json:"drain_timeout"`
+	// по умолчанию политика включена
+	Enabled *bool `form:"enabled" json:"enabled"`
+	// откуда берётся новая конфигурация
+	Rotate RotateVPNParams `form:"rotate" json:"rotate"`
+}
+
+func (params *PolicyParams) Bind(r *http.Request) error {
+	if err := validation.ValidateStruct(params,
+		validation.Field(&params.DrainTimeout, validation.Min(0), validation.Max(3600))); err != nil {
+		return err
+	}
+
+	if (params.Tunnel == "") == (params.Tag == "") {
+		return validation.Errors{"tunnel": fmt.Errorf("exactly one of tunnel and tag is required")}
+	}
+	if (params.Every == "") == (params.Cron == "") {
+		return validation.Errors{"every": fmt.Errorf("exactly one of every and cron is required")}
+	}
+
+	if err := params.Rotate.Bind(r); err != nil {
+		return fmt.Errorf("rotate: %s", err)
+	}
+
+	return nil
+}
+
+type PoolParams struct {
+	Name   string             `form:"name" json:"name"`
+	Source ConfigSourceParams `form:"source" json:"source"`
+	// желаемое количество исправных туннелей и пределы общего количества туннелей пула
+	Size int `form:"size" json:"size"`
+	Min  int `form:"min" json:"min"`
+	Max  int `form:"max" json:"max"`
+	// метки и набор учётных данных туннелей пула
+	Tags        []string `form:"tags" json:"tags"`
+	Credentials string   `form:"credentials" json:"credentials"`
+}
+
+func (params *PoolParams) Bind(r *http.Request) error {
+	if err := validation.ValidateStruct(params,
+		validation.Field(&params.Name, validation.Required, validation.Match(configName)),
+		validation.Field(&params.Size, validation.Min(0)),
+		validation.Field(&params.Min, validation.Min(0)),
+		validation.Field(&params.Max, validation.Required, validation.Max(100)),
+		validation.Field(&params.Tags, validation.Each(validation.Required))); err != nil {
+		return err
+	}
+
+	if params.Source.Empty() {
+		return validation.Errors{"source": fmt.Errorf("configs, paths, dir, tag or provider is required")}
+	}
+	if err := params.Source.Validate(); err != nil {
+		return fmt.Errorf("source: %s", err)
+	}
+
+	return nil
+}
+
+type CredentialsParams struct {
+	Name         string `form:"name" json:"name"`
+	User         string `form:"user" json:"user"`
+	Password     string `form:"password" json:"password"`
+	CertPassword string `form:"cert_password" json:"cert_password"`
+}
+
+func (params *CredentialsParams) Bind(r *http.Request) error {
+	if err := validation.ValidateStruct(params,
+		validation.Field(&params.Name, validation.Required, validation.Match(configName))); err != nil {
+		return err
+	}
+
+	if params.User == "" && params.CertPassword == "" {
+		return validation.Errors{"user": fmt.Errorf("user or cert_password is required")}
+	}
+
+	return validateAuth(params.User, params.Password)
+}
+
+// Имя пользователя и пароль передаются только вместе
+func validateAuth(user, password string) error {
+	if user == "" && password != "" {
+		return validation.Errors{"user": fmt.Errorf("cannot be blank when password is set")}
+	}
+	if user != "" && password == "" {
+		return validation.Errors{"password": fmt.Errorf("cannot be blank when user is set")}
+	}
+
+	return nil
+}
+
+type UpdateVPNParams struct {
+	Country *string  `form:"country" json:"country"`
+	Tags    []string `form:"tags" json:"tags"`
+}
+
+func (params *UpdateVPNParams) Bind(r *http.Request) error {
+	return validation.ValidateStruct(params,
+		validation.Field(&params.Country, validation.Length(2, 2)),
+		validation.Field(&params.Tags, validation.Each(validation.Required)))
+}
+
+type RouteParams struct {
+	Name        string   `form:"name" json:"name"`
+	Domains     []string `form:"domains" json:"domains"`
+	DomainRegex string   `form:"domain_regex" json:"domain_regex"`
+	CIDRs       []string `form:"cidrs" json:"cidrs"`
+	Ports       []string `form:"ports" json:"ports"`
+	Sources     []string `form:"sources" json:"sources"`
+	Users       []string `form:"users" json:"users"`
+	Action      string   `form:"action" json:"action"`
+	Target      string   `form:"target" json:"target"`
+	// позиция в списке правил, по умолчанию в конец
+	Position *int `form:"position" json:"position"`
+}
+
+func (params *RouteParams) Bind(r *http.Request) error {
+	return validation.ValidateStruct(params,
+		validation.Field(&params.Domains, validation.Each(validation.Required)),
+		validation.Field(&params.Users, validation.Each(validation.Required)),
+		validation.Field(&params.Action, validation.Required, validation.In("tunnel", "tag", "pool", "direct", "reject")),
+		validation.Field(&params.Position, validation.Min(0)))
+}
+
+type RoutesParams struct {
+	Rules []RouteParams `form:"rules" json:"rules"`
+}
+
+func (params *RoutesParams) Bind(r *http.Request) error {
+	for i := range params.Rules {
+		if err := params.Rules[i].Bind(r); err != nil {
+			return fmt.Errorf("rule %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+type CreateConfigParams struct {
+	Name string `form:"name" json:"name"`
+	// текст конфигурации, при загрузке multipart/form-data передаётся файлом в поле file
+	Content string `form:"content" json:"content"`
+	// тип конфигурации, по умолчанию определяется по содержимому
+	Type      string   `form:"type" json:"type"`
+	Country   string   `form:"country" json:"country"`
+	Tags      []string `form:"tags" json:"tags"`
+	Overwrite bool     `form:"overwrite" json:"overwrite"`
+}
+
+func (params *CreateConfigParams) Bind(r *http.Request) error {
 	return validation.ValidateStruct(params,
-		validation.Field(&params.Path, validation.Required))
+		validation.Field(&params.Name, validation.Required, validation.Match(configName)),
+		validation.Field(&params.Content, validation.Required),
+		validation.Field(&params.Type, validation.In(tunnelTypes...)),
+		validation.Field(&params.Country, validation.Length(2, 2)),
+		validation.Field(&params.Tags, validation.Each(validation.Required)))
 }
@@ -18,3 +18,13 @@ func OutputErrorData(err error) *RespData {
 		Data:   err.Error(),
 	}
 }
+
+func OutputErrorDetails(err error, details interface{}) *RespData {
+	return &RespData{
+		Status: false,
+		Data: &ErrorDetails{
+			Message: err.Error(),
+			Errors:  details,
+		},
+	}
+}
@@ -3,3 +3,8 @@ package responses
 type Slave struct {
 	Host string `json:"host"`
 }
+
+type ErrorDetails struct {
+	Message string      `json:"message"`
+	Errors  interface{} `json:"errors"`
+}